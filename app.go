@@ -41,32 +41,190 @@ Input:
 		}
 	}
 
-Output:
+The source and destination may also be given as URLs, e.g.,
+"s3://venicegeo-sample-data/pointcloud/samp11-utm.laz" or
+"https://example.com/samp11-utm.laz". S3, or an S3-compatible store such as
+MinIO, is configured by the JSON file named in S3_CONFIG (see
+storage.S3Config) and by S3_ENDPOINT, S3_PATH_STYLE, S3_REGION, S3_PROFILE and
+AWS_SHARED_CREDENTIALS_FILE. Bucket regions are detected unless configured.
+Local files may be named with file:///
+URLs if FILE_ROOT is set, in which case they are found beneath that directory.
+
+HTTP(S) destinations are uploaded with PUT, or with POST as multipart/form-data,
+retrying on 5xx responses. Headers, e.g., for an auth token, may be given too:
+
+	"destination": {
+		"url": "https://example.com/upload/output.laz",
+		"method": "POST",
+		"headers": {"Authorization": "Bearer ..."}
+	}
+
+The final URL and response status are reported as "destination" in the
+response.
+The same forms are accepted by /api/v1/pipeline and /api/v1/vo.
+
+Jobs are run in the background. The initial response is 202 Accepted, with the
+job's location given in the Location header:
+
+	{
+		"id": "0f8e3a1c-5d2b-4c7e-9a41-2b6f0d9e7c53",
+		"status": "queued",
+		"started_at": "2015-12-23T18:07:36.987565884Z"
+	}
+
+Poll GET /api/v1/jobs/:id until the status is either "succeeded" or "failed"
+(passing through "queued" and "running" on the way):
 
 	{
-		"input": <echo the input message>,
+		"id": "0f8e3a1c-5d2b-4c7e-9a41-2b6f0d9e7c53",
+		"status": "succeeded",
 		"started_at": "2015-12-23T18:07:36.987565884Z",
 		"finished_at": "2015-12-23T18:07:38.111658707Z",
 		"code": 200,
-		"message": "Success!"
+		"message": "Success"
+	}
+
+Add sync=true to the query string to run the job within the request and receive
+the final output message directly.
+
+At most MAX_WORKERS (by default, the number of CPUs) workers run PDAL at once.
+Heavier functions, such as ground, occupy more than one worker; the weight of
+any function can be set in WORKER_WEIGHTS, e.g., "ground=3,info=1". At most
+MAX_QUEUE (by default, 100) jobs wait for a worker, after which further jobs are
+refused with 429 Too Many Requests and a Retry-After header. GET /api/v1/queue
+reports the number of active workers and queued jobs.
+
+The point cloud may instead be uploaded with the request, as multipart/form-data
+with the job message as its "job" part and the point cloud as its "file" part:
+
+	$ curl -F job='{"function":"ground"}' -F file=@samp11-utm.laz \
+	  -o ground.laz 'http://hostIP:8080/api/v1/pdal?sync=true'
+
+Synchronous jobs that produce a file (a point cloud or raster) but have no
+destination return the file itself, so an uploaded point cloud whose result is
+a file must be given either a destination or sync=true. Requests larger than
+MAX_UPLOAD_SIZE, and results larger than MAX_RESULT_SIZE, are refused with 413
+Request Entity Too Large. Both default to 1 GiB; 0 means no limit.
+
+Downloaded inputs are cached on disk, in INPUT_CACHE_DIR (by default, "cache"
+beneath WORKSPACE_ROOT), so that jobs run repeatedly against the same objects
+download them once. The cache holds at most INPUT_CACHE_SIZE bytes (by default,
+5 GiB; 0 disables it), evicting the least recently used objects. Objects are
+keyed by URL and ETag (or size and modification time), so changed objects are
+downloaded again. GET /api/v1/metrics reports cache hits and misses, along with
+the state of the worker pool.
+
+If RESULT_CACHE_SIZE (in bytes) is set, the results of jobs are remembered in
+RESULT_CACHE_DIR (by default, "results" beneath WORKSPACE_ROOT), so that a job
+identical to an earlier one, i.e., with the same version of the same source,
+function, options and output format, is answered without running PDAL, with
+its output uploaded to the destination, if any. Such jobs report the
+message "Success (cached)". Cached results are discarded when PDAL is
+upgraded. Jobs may ask to be run regardless with "no_cache": true.
+
+To run the same function over many sources, POST a batch to /api/v1/batch,
+listing the sources or giving a prefix to list, and a destination template:
+
+	{
+		"bucket": "venicegeo-sample-data",
+		"prefix": "pointcloud/",
+		"glob": "*.laz",
+		"function": "ground",
+		"destination": "temp/{basename}_ground.laz"
+	}
+
+One job is run per source, through the worker pool. The progress of the batch,
+and the result of each job, are polled at /api/v1/batch/:id.
+
+A job may run several functions in turn, giving "steps" in place of the
+function and options:
+
+	{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"steps": [
+			{"function": "crop", "options": {"bounds": "([0,500],[0,500])"}},
+			{"function": "statistical"},
+			{"function": "ground"},
+			{"function": "height"}
+		],
+		"destination": "s3://venicegeo-sample-data/temp/height.laz"
 	}
 
-These messages are known to be incomplete at the moment. I'm sure there will be things like job IDs, etc. that have not been included at the moment. This is a good starting point though.
+Each step reads the point cloud written by the step before it, in the job's
+workspace, and only the last is uploaded. Steps that produce JSON, such as
+info, report on the point cloud as it stands; the result of the last step is
+the response, and that of any other is reported with its step. The response
+lists the time taken by each step. The job's time limit is the total of its
+functions' limits, and at most 10 steps are allowed.
+
+Every function but info runs a PDAL pipeline. A job with "dry_run": true
+returns the pipelines it would run, under "pipelines", without downloading or
+running anything. Jobs that produce a file, and pipelines, report what PDAL
+made of the run under "metadata": the point count, bounds and SRS of the
+input, the point count, bounds and size of the output (and, for pipelines
+with several writers, of each under "outputs"), and the metadata of each stage.
+
+The translate function runs a list of filters, each with its options, e.g.,
+{"filters": [{"type": "range", "options": {"limits": "Z[0:100]"}}]}. Only the
+filters and options in TRANSLATE_FILTERS (by default, a set that neither
+reads nor writes files), given as "range=limits,crop=bounds|polygon,height",
+are allowed. The legacy "args" string is refused unless TRANSLATE_ARGS is true,
+and may only name the readers and writers of file formats, with -r and -w.
+
+Pipelines POSTed to /api/v1/pipeline may only use the stage types in
+PIPELINE_STAGES, a comma-separated list in which "filters.*" allows every
+filter. By default, stages that run code (e.g., filters.python) or reach
+beyond the job's workspace (e.g., databases) are refused. Stage objects may
+only name files in the job's workspace, as plain file names, except that
+readers and writers may name storage locations, which are downloaded or
+uploaded. Files the job itself writes, named "download_file-*", "upload_file-*"
+and "pipeline.json", may not be written by stages. Pipelines that break these
+rules are refused with 400 Bad Request, listing every problem. The response
+gives the rewritten pipeline that was run.
+
+A pipeline may have several writers. Every writer whose filename is a storage
+location, and a last stage given as one, is uploaded there, keeping its
+extension. The response lists the uploads under "outputs", and gives the last
+as "location".
+
+Pipelines POSTed to /api/v1/pipeline/validate are checked as they would be
+run, against the drivers PDAL has installed, and with "pdal pipeline
+--validate", without downloading or running anything. PDAL is only asked once
+a worker is free, as for jobs. The response lists the errors found with each
+stage, numbered from 0. As inputs are not downloaded, the stages after a
+reader that PDAL cannot open are marked unchecked. A pipeline without errors
+is "valid", and "complete" if PDAL checked every stage.
+
+Pipelines that are used often can be kept as templates, in TEMPLATE_DIR (by
+default, "templates" beneath WORKSPACE_ROOT). PUT /api/v1/templates/:name
+saves a template, i.e., a "pipeline" with ${param} placeholders and the
+"parameters" it takes, each described by a schema with its type (boolean,
+integer, number or string) and default, if any. Its pipeline, with the
+defaults substituted, must pass the checks of /api/v1/pipeline. GET
+/api/v1/templates lists them, GET /api/v1/templates/:name describes one, with
+the schema and defaults of its parameters, as functions are described, and
+DELETE removes one. POST {"parameters": {...}, "sources": [...]} to
+/api/v1/templates/:name/execute to run one as a pipeline, with the sources
+read before the template's stages.
 */
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/julienschmidt/httprouter"
 	"github.com/venicegeo/pzsvc-pdal/functions"
 	"github.com/venicegeo/pzsvc-pdal/handlers"
+	"github.com/venicegeo/pzsvc-pdal/storage"
 	"github.com/venicegeo/pzsvc-sdk-go/gateway"
 )
 
@@ -86,19 +244,16 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func main() {
-	m := gateway.ResourceMetadata{
-		Name:             "pzsvc-pdal",
-		URL:              "http://pzsvc-pdal.cf.piazzageo.io/api/v1/pdal",
-		Description:      "Process point cloud data using PDAL",
-		Method:           "POST",
-		RequestMimeType:  "application/json",
-		ResponseMimeType: "application/json",
-	}
-	if err := gateway.RegisterService(m); err != nil {
-		log.Println(err)
-	}
+type appParamsHandler func(http.ResponseWriter, *http.Request, httprouter.Params) *handlers.AppError
 
+func (fn appParamsHandler) handle(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	appHandler(func(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+		return fn(w, r, ps)
+	}).ServeHTTP(w, r)
+}
+
+// newRouter sets up the routes for all of our endpoints.
+func newRouter() *httprouter.Router {
 	router := httprouter.New()
 
 	router.GET("/",
@@ -108,69 +263,35 @@ func main() {
 
 	router.GET("/api/v1/version",
 		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-			cmd := exec.Command("pdal", "--debug")
-			b, _ := cmd.CombinedOutput()
-			fmt.Printf(string(b))
-			fmt.Fprintf(w, string(b))
+			b, _ := functions.PDAL.Run(r.Context(), "--debug")
+			fmt.Print(string(b))
+			fmt.Fprint(w, string(b))
 		})
 
 	type ListFuncs struct {
 		Functions []string `json:"functions"`
 	}
-	out := ListFuncs{[]string{
-		"crop", "dart", "dtm", "ground", "height", "info", "radius", "statistical",
-		"translate", "vo",
-	}}
 
 	router.GET("/api/v1/functions/:name",
 		func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 			var a interface{}
-			switch ps.ByName("name") {
-			case "crop":
-				a = functions.NewCropOptions()
-				w.WriteHeader(http.StatusOK)
-
-			case "dart":
-				a = functions.NewDartOptions()
-				w.WriteHeader(http.StatusOK)
-
-			case "dtm":
-				a = functions.NewDtmOptions()
-				w.WriteHeader(http.StatusOK)
-
-			case "ground":
-				a = functions.NewGroundOptions()
-				w.WriteHeader(http.StatusOK)
-
-			case "height":
-				w.WriteHeader(http.StatusOK)
-
-			case "info":
-				a = functions.NewInfoOptions()
-				w.WriteHeader(http.StatusOK)
-
-			case "radius":
-				a = functions.NewRadiusOptions()
-				w.WriteHeader(http.StatusOK)
-
-			case "statistical":
-				a = functions.NewStatisticalOptions()
-				w.WriteHeader(http.StatusOK)
-
-			case "translate":
-				w.WriteHeader(http.StatusOK)
-
-			case "vo":
+			if fn, ok := functions.Lookup(ps.ByName("name")); ok {
+				type FunctionMsg struct {
+					*functions.Function
+					Options interface{}       `json:"options"`
+					Schema  *functions.Schema `json:"schema"`
+					Timeout float64           `json:"timeout"`
+				}
+				a = FunctionMsg{fn, fn.DefaultOptions(), fn.OptionsSchema(), fn.TimeLimit().Seconds()}
 				w.WriteHeader(http.StatusOK)
-
-			default:
+			} else {
 				type DefaultMsg struct {
 					Message string `json:"message"`
 					ListFuncs
 				}
 				msg := "Unrecognized function " + ps.ByName("name") + "."
-				a = DefaultMsg{msg, out}
+				a = DefaultMsg{msg, ListFuncs{functions.Names()}}
 				w.WriteHeader(http.StatusBadRequest)
 			}
 			if err := json.NewEncoder(w).Encode(a); err != nil {
@@ -183,7 +304,7 @@ func main() {
 		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 			w.WriteHeader(http.StatusOK)
-			if err := json.NewEncoder(w).Encode(out); err != nil {
+			if err := json.NewEncoder(w).Encode(ListFuncs{functions.Names()}); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -192,10 +313,114 @@ func main() {
 	// Setup the PDAL service.
 	router.Handler("POST", "/api/v1/pdal", appHandler(handlers.PdalHandler))
 
+	router.GET("/api/v1/jobs/:id", appParamsHandler(handlers.JobHandler).handle)
+
+	router.Handler("POST", "/api/v1/batch", appHandler(handlers.BatchHandler))
+
+	router.GET("/api/v1/batch/:id", appParamsHandler(handlers.BatchStatusHandler).handle)
+
+	router.Handler("GET", "/api/v1/queue", appHandler(handlers.QueueHandler))
+
+	router.Handler("GET", "/api/v1/metrics", appHandler(handlers.MetricsHandler))
+
 	router.Handler("POST", "/api/v1/pipeline", appHandler(handlers.PipelineHandler))
 
+	router.Handler("POST", "/api/v1/pipeline/validate", appHandler(handlers.ValidatePipelineHandler))
+
+	router.Handler("GET", "/api/v1/templates", appHandler(handlers.ListTemplatesHandler))
+
+	router.GET("/api/v1/templates/:name", appParamsHandler(handlers.TemplateHandler).handle)
+
+	router.PUT("/api/v1/templates/:name", appParamsHandler(handlers.PutTemplateHandler).handle)
+
+	router.DELETE("/api/v1/templates/:name", appParamsHandler(handlers.DeleteTemplateHandler).handle)
+
+	router.POST("/api/v1/templates/:name/execute", appParamsHandler(handlers.ExecuteTemplateHandler).handle)
+
 	router.Handler("POST", "/api/v1/vo", appHandler(handlers.VoHandler))
 
+	router.GET("/api/v1/vo",
+		func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(handlers.NewVoOptions().JSONSchema()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		})
+
+	return router
+}
+
+func main() {
+	m := gateway.ResourceMetadata{
+		Name:             "pzsvc-pdal",
+		URL:              "http://pzsvc-pdal.cf.piazzageo.io/api/v1/pdal",
+		Description:      "Process point cloud data using PDAL",
+		Method:           "POST",
+		RequestMimeType:  "application/json",
+		ResponseMimeType: "application/json",
+	}
+	if err := gateway.RegisterService(m); err != nil {
+		log.Println(err)
+	}
+
+	// Jobs run in their own workspace beneath WORKSPACE_ROOT. Anything left
+	// there now belongs to a previous instance that did not shut down cleanly.
+	if root := os.Getenv("WORKSPACE_ROOT"); root != "" {
+		handlers.WorkspaceRoot = root
+	}
+	if n, err := handlers.CleanWorkspaces(); err != nil {
+		log.Println("Error cleaning workspaces:", err)
+	} else if n > 0 {
+		log.Println("Removed", n, "stale workspaces from", handlers.WorkspaceRoot)
+	}
+
+	// S3 may be configured in the JSON file named by S3_CONFIG, and by
+	// environment variables, which take precedence.
+	var s3Config storage.S3Config
+	if name := os.Getenv("S3_CONFIG"); name != "" {
+		var err error
+		if s3Config, err = storage.LoadS3Config(name); err != nil {
+			log.Fatal("Error reading S3_CONFIG: ", err)
+		}
+	}
+	s3Config, err := storage.S3ConfigFromEnv(s3Config)
+	if err != nil {
+		log.Fatal("Error configuring S3: ", err)
+	}
+	storage.Register("s3", storage.NewS3(s3Config))
+
+	// Sources and destinations may name local files (file:///path) only if
+	// FILE_ROOT gives a directory to hold them.
+	if root := os.Getenv("FILE_ROOT"); root != "" {
+		storage.Register("file", storage.FileSystem{Root: root})
+	}
+
+	if err := configureWorkers(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureSizeLimits(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureInputCache(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureResultCache(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureTranslate(); err != nil {
+		log.Fatal(err)
+	}
+	if v := os.Getenv("PIPELINE_STAGES"); v != "" {
+		handlers.PipelineStages = strings.Split(v, ",")
+	}
+	if err := configureTemplates(); err != nil {
+		log.Fatal(err)
+	}
+
+	router := newRouter()
+
 	var defaultPort = os.Getenv("PORT")
 	if defaultPort == "" {
 		defaultPort = "8080"
@@ -207,3 +432,173 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// configureWorkers sizes the worker pool from MAX_WORKERS and MAX_QUEUE, and
+// overrides function weights with WORKER_WEIGHTS.
+func configureWorkers() error {
+	stats := handlers.Workers.Stats()
+	maxWorkers, maxQueue := stats.MaxWorkers, stats.MaxQueue
+	var err error
+	if v := os.Getenv("MAX_WORKERS"); v != "" {
+		if maxWorkers, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid MAX_WORKERS %q", v)
+		}
+	}
+	if v := os.Getenv("MAX_QUEUE"); v != "" {
+		if maxQueue, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid MAX_QUEUE %q", v)
+		}
+	}
+	handlers.Workers = handlers.NewPool(maxWorkers, maxQueue)
+	log.Println("Running at most", maxWorkers, "workers, with at most", maxQueue, "jobs queued")
+
+	if v := os.Getenv("WORKER_WEIGHTS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid WORKER_WEIGHTS entry %q", pair)
+			}
+			fn, ok := functions.Lookup(kv[0])
+			if !ok {
+				return fmt.Errorf("WORKER_WEIGHTS names unknown function %q", kv[0])
+			}
+			weight, err := strconv.Atoi(kv[1])
+			if err != nil || weight < 1 {
+				return fmt.Errorf("invalid WORKER_WEIGHTS entry %q", pair)
+			}
+			fn.Weight = weight
+		}
+	}
+	return nil
+}
+
+// configureSizeLimits sets the largest request and inline result from
+// MAX_UPLOAD_SIZE and MAX_RESULT_SIZE, in bytes.
+func configureSizeLimits() error {
+	for _, limit := range []struct {
+		name string
+		size *int64
+	}{
+		{"MAX_UPLOAD_SIZE", &handlers.MaxUploadSize},
+		{"MAX_RESULT_SIZE", &handlers.MaxResultSize},
+	} {
+		if v := os.Getenv(limit.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid %s %q", limit.name, v)
+			}
+			*limit.size = n
+		}
+	}
+	return nil
+}
+
+// configureTranslate replaces the filters that the translate function may run
+// with those in TRANSLATE_FILTERS, e.g., "range=limits,crop=bounds|polygon,height",
+// and allows its legacy "args" option if TRANSLATE_ARGS is true.
+func configureTranslate() error {
+	if v := os.Getenv("TRANSLATE_FILTERS"); v != "" {
+		allowed := make(map[string][]string)
+		for _, entry := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+			if kv[0] == "" {
+				return fmt.Errorf("invalid TRANSLATE_FILTERS entry %q", entry)
+			}
+			allowed[kv[0]] = nil
+			if len(kv) == 2 && kv[1] != "" {
+				allowed[kv[0]] = strings.Split(kv[1], "|")
+			}
+		}
+		functions.TranslateFilters = allowed
+	}
+	if v := os.Getenv("TRANSLATE_ARGS"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid TRANSLATE_ARGS %q", v)
+		}
+		functions.TranslateArgs = enabled
+		if enabled {
+			log.Println("Allowing the legacy args option of translate")
+		}
+	}
+	return nil
+}
+
+// defaultInputCacheSize is the default for INPUT_CACHE_SIZE.
+const defaultInputCacheSize = 5 << 30
+
+// configureInputCache sets up the cache of downloaded inputs in
+// INPUT_CACHE_DIR, holding at most INPUT_CACHE_SIZE bytes.
+func configureInputCache() error {
+	size := int64(defaultInputCacheSize)
+	if v := os.Getenv("INPUT_CACHE_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid INPUT_CACHE_SIZE %q", v)
+		}
+		size = n
+	}
+	if size == 0 {
+		return nil
+	}
+
+	dir := os.Getenv("INPUT_CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join(handlers.WorkspaceRoot, "cache")
+	}
+	c, err := storage.NewCache(dir, size)
+	if err != nil {
+		return fmt.Errorf("error creating input cache: %v", err)
+	}
+	storage.InputCache = c
+	log.Println("Caching at most", size, "bytes of inputs in", dir)
+	return nil
+}
+
+// configureResultCache sets up the cache of job results in RESULT_CACHE_DIR,
+// holding at most RESULT_CACHE_SIZE bytes, if set.
+func configureResultCache() error {
+	v := os.Getenv("RESULT_CACHE_SIZE")
+	if v == "" || v == "0" {
+		return nil
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid RESULT_CACHE_SIZE %q", v)
+	}
+
+	// Results are only valid for the version of PDAL that produced them.
+	b, err := functions.PDAL.Run(context.Background(), "--version")
+	if err != nil {
+		log.Println("Not caching results, as the version of PDAL is unknown:", err)
+		return nil
+	}
+	version := strings.TrimSpace(string(b))
+
+	dir := os.Getenv("RESULT_CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join(handlers.WorkspaceRoot, "results")
+	}
+	c, err := handlers.NewResultCache(dir, size, version)
+	if err != nil {
+		return fmt.Errorf("error creating result cache: %v", err)
+	}
+	handlers.Results = c
+	log.Println("Caching at most", size, "bytes of results in", dir)
+	return nil
+}
+
+// configureTemplates loads the pipeline templates kept in TEMPLATE_DIR.
+func configureTemplates() error {
+	dir := os.Getenv("TEMPLATE_DIR")
+	if dir == "" {
+		dir = filepath.Join(handlers.WorkspaceRoot, "templates")
+	}
+	s, err := handlers.NewTemplateStore(dir)
+	if err != nil {
+		return fmt.Errorf("error loading templates: %v", err)
+	}
+	handlers.Templates = s
+	log.Println("Loaded", len(s.Names()), "templates from", dir)
+	return nil
+}
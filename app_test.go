@@ -16,14 +16,98 @@ limitations under the License.
 
 package main
 
-// func TestListFunctions(t *testing.T) {
-// 	router := httprouter.New()
-// 	router.GET("/api/v1/functions", PdalHandler)
-// 	req, _ := http.NewRequest("GET", "/api/v1/functions", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusOK {
-// 		t.Errorf("StatusOK expected: %d", w.Code)
-// 	}
-// }
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-pdal/handlers"
+)
+
+func TestListFunctions(t *testing.T) {
+	router := newRouter()
+	req, _ := http.NewRequest("GET", "/api/v1/functions", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("StatusOK expected: %d", w.Code)
+	}
+
+	var out struct {
+		Functions []string `json:"functions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Functions) == 0 {
+		t.Error("Expected functions to be listed")
+	}
+}
+
+func TestDescribeFunction(t *testing.T) {
+	router := newRouter()
+	req, _ := http.NewRequest("GET", "/api/v1/functions/crop", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("StatusOK expected: %d", w.Code)
+	}
+
+	var out struct {
+		Name    string          `json:"name"`
+		Options json.RawMessage `json:"options"`
+		Schema  json.RawMessage `json:"schema"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "crop" || out.Options == nil || out.Schema == nil {
+		t.Errorf("Unexpected description %s", w.Body)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/functions/fail", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected: %d", w.Code)
+	}
+}
+
+func TestTemplateRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if handlers.Templates, err = handlers.NewTemplateStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { handlers.Templates = nil }()
+
+	router := newRouter()
+	body := `{"pipeline": [{"type": "filters.range", "limits": "Z[0:${max}]"}], "parameters": {"max": {"type": "number", "default": 100}}}`
+	req, _ := http.NewRequest("PUT", "/api/v1/templates/low", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("StatusCreated expected: %d %s", w.Code, w.Body)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/templates", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"low"`) {
+		t.Errorf("Expected the template to be listed: %d %s", w.Code, w.Body)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/templates/missing/execute", strings.NewReader(`{}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("StatusNotFound expected: %d %s", w.Code, w.Body)
+	}
+}
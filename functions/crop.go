@@ -18,8 +18,7 @@ package functions
 
 import (
 	"encoding/json"
-	"fmt"
-	"os/exec"
+	"errors"
 )
 
 // CropOptions defines options for the Crop function.
@@ -39,18 +38,65 @@ func NewCropOptions() *CropOptions {
 	return &CropOptions{Outside: false}
 }
 
-/*
-Crop calls PDAL translate with a crop filter.
+// JSONSchema describes CropOptions. Exactly one of bounds or polygon is required.
+func (o *CropOptions) JSONSchema() *Schema {
+	s := newObjectSchema("crop", "Options for the Crop function", map[string]*Schema{
+		"bounds": {
+			Description: "extents of the clipping rectangle in the form \"([xmin,xmax],[ymin,ymax])\"",
+			Type:        "string",
+			Pattern:     boundsPattern,
+			Units:       unitsDistance,
+		},
+		"polygon": {
+			Description: "the clipping polygon in well-known text",
+			Type:        "string",
+			Pattern:     polygonPattern,
+		},
+		"outside": flag("invert logic and only keep points outside the bounds/polygon", o.Outside),
+	})
+	s.OneOf = []*Schema{
+		{Required: []string{"bounds"}},
+		{Required: []string{"polygon"}},
+	}
+	return s
+}
 
-The Crop function will invoke the PDAL translate command as follows:
+func init() {
+	Register(Function{
+		Name:        "crop",
+		Description: "Crop a point cloud to a bounding box or polygon",
+		Output:      OutputFile,
+		NewOptions:  func() interface{} { return NewCropOptions() },
+		Pipeline:    Crop,
+	})
+}
 
-	$ pdal translate <input> <output> crop \
-	  [--filters.crop.bounds=<bounds string>] \
-	  [--filters.crop.polygon=<polygon string>] \
-	  [--filters.crop.outside=<true|false>] \
-	  -v10 --debug
+// Validate checks that the bounds or polygon are well formed.
+func (o *CropOptions) Validate() ValidationError {
+	var errs ValidationError
+	if o.Bounds != "" {
+		if _, err := parseBounds(o.Bounds); err != nil {
+			errs = append(errs, FieldError{"bounds", err.Error()})
+		}
+	}
+	if o.Polygon != "" {
+		if err := parsePolygon(o.Polygon); err != nil {
+			errs = append(errs, FieldError{"polygon", err.Error()})
+		}
+	}
+	return errs
+}
+
+/*
+Crop builds a pipeline with a crop filter:
+
+	{"pipeline": [
+	  "<input>",
+	  {"type": "filters.crop", "bounds": "<bounds>" | "polygon": "<polygon>", "outside": <true|false>},
+	  "<output>"
+	]}
 */
-func Crop(i, o string, options *json.RawMessage) ([]byte, error) {
+func Crop(i, o string, options *json.RawMessage) (*Pipeline, error) {
 	opts := NewCropOptions()
 	if options != nil {
 		if err := json.Unmarshal(*options, &opts); err != nil {
@@ -58,29 +104,16 @@ func Crop(i, o string, options *json.RawMessage) ([]byte, error) {
 		}
 	}
 
-	var args []string
-	args = append(args, "translate", i, o, "crop")
 	if (opts.Bounds == "" && opts.Polygon == "") ||
 		(opts.Bounds != "" && opts.Polygon != "") {
-		fmt.Println("must provide bounds OR polygon, but not both")
+		return nil, errors.New("must provide bounds OR polygon, but not both")
 	}
+	crop := map[string]interface{}{"outside": opts.Outside}
 	if opts.Bounds != "" {
-		args = append(args, "--filters.crop.bounds="+opts.Bounds)
-	} else if opts.Polygon != "" {
-		args = append(args, "--filters.crop.polygon="+opts.Polygon)
-	}
-	if opts.Outside {
-		args = append(args, "--filters.crop.outside=true")
+		crop["bounds"] = opts.Bounds
 	} else {
-		args = append(args, "--filters.crop.outside=false")
-	}
-	args = append(args, "-v", "10", "--debug")
-	out, err := exec.Command("pdal", args...).CombinedOutput()
-
-	fmt.Println(string(out))
-	if err != nil {
-		return nil, err
+		crop["polygon"] = opts.Polygon
 	}
 
-	return nil, nil
+	return NewPipeline(i, o, Filter("crop", crop)), nil
 }
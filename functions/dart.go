@@ -16,12 +16,7 @@ limitations under the License.
 
 package functions
 
-import (
-	"encoding/json"
-	"fmt"
-	"os/exec"
-	"strconv"
-)
+import "encoding/json"
 
 // DartOptions defines options for the Dart function.
 type DartOptions struct {
@@ -33,8 +28,25 @@ func NewDartOptions() *DartOptions {
 	return &DartOptions{Radius: 1.0}
 }
 
-// Dart implements pdal height.
-func Dart(i, o string, options *json.RawMessage) ([]byte, error) {
+// JSONSchema describes DartOptions.
+func (o *DartOptions) JSONSchema() *Schema {
+	return newObjectSchema("dart", "Options for the Dart function", map[string]*Schema{
+		"radius": positive("minimum distance between samples", unitsDistance, o.Radius),
+	})
+}
+
+func init() {
+	Register(Function{
+		Name:        "dart",
+		Description: "Thin a point cloud using Poisson dart-throwing sampling",
+		Output:      OutputFile,
+		NewOptions:  func() interface{} { return NewDartOptions() },
+		Pipeline:    Dart,
+	})
+}
+
+// Dart builds a pipeline with a dartsample filter.
+func Dart(i, o string, options *json.RawMessage) (*Pipeline, error) {
 	opts := NewDartOptions()
 	if options != nil {
 		if err := json.Unmarshal(*options, &opts); err != nil {
@@ -42,17 +54,7 @@ func Dart(i, o string, options *json.RawMessage) ([]byte, error) {
 		}
 	}
 
-	var args []string
-	args = append(args, "translate", i, o, "dartsample")
-	args = append(args, "--filters.dartsample.radius="+
-		strconv.FormatFloat(opts.Radius, 'f', -1, 64))
-	args = append(args, "-v", "10", "--debug")
-	out, err := exec.Command("pdal", args...).CombinedOutput()
-
-	fmt.Println(string(out))
-	if err != nil {
-		return nil, err
-	}
-
-	return nil, nil
+	return NewPipeline(i, o, Filter("dartsample", map[string]interface{}{
+		"radius": opts.Radius,
+	})), nil
 }
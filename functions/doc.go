@@ -35,7 +35,11 @@ Remembering that the PDAL handler expects inputs in the form
 		}
 	}
 
-the following sections provide brief examples of valid options for each function. The values provided below do not represent default values.
+(where the source and destination may also be URLs, e.g., "s3://bucket/key" or "https://host/path"), the following sections provide brief examples of valid options for each function. The values provided below do not represent default values.
+
+Options are validated against each function's JSON Schema (see OptionsSchema) and its Validate method, if any, before any data is downloaded. Unknown keys are rejected.
+
+Every function but info builds a PDAL pipeline (see Pipeline), reading the input, running its filters, and writing the output, which is run with "pdal pipeline". Options are set on the stages as JSON values, so WKT polygons and other values containing spaces need no quoting. PDAL writes the metadata of each run, which is returned, along with a summary of the input and output, as Metadata.
 
 Crop
 
@@ -111,9 +115,20 @@ Translate
 
 Example JSON "options" object for the Translate function.
 
+  {
+    "filters": [
+      {"type": "radiusoutlier", "options": {"radius": 2.0}},
+      {"type": "ground", "options": {"classify": true}}
+    ]
+  }
+
+Only the filters and options in TranslateFilters are allowed. If TranslateArgs is set, the same may be given in the legacy form:
+
   {
     "args": "radiusoutlier ground --filters.radiusoutlier.radius=2.0 --filters.ground.classify=true"
   }
 
+The arguments are converted to the equivalent pipeline. Only the readers and writers in TranslateDrivers, and their options listed there, may be named. Values containing spaces must be quoted, e.g., --filters.crop.polygon="POLYGON((0 0, 1 0, 1 1, 0 0))".
+
 */
 package functions
@@ -17,11 +17,11 @@ limitations under the License.
 package functions
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"os"
-	"os/exec"
-	"strconv"
+	"path/filepath"
+	"time"
 )
 
 // DtmOptions defines options for the Dtm function.
@@ -34,8 +34,35 @@ func NewDtmOptions() *DtmOptions {
 	return &DtmOptions{GridSize: 1.0}
 }
 
-// Dtm implements pdal dtm.
-func Dtm(i, o string, options *json.RawMessage) ([]byte, error) {
+// JSONSchema describes DtmOptions.
+func (o *DtmOptions) JSONSchema() *Schema {
+	return newObjectSchema("dtm", "Options for the Dtm function", map[string]*Schema{
+		"grid_size": positive("size of grid cell in XY dimensions", unitsDistance, o.GridSize),
+	})
+}
+
+func init() {
+	Register(Function{
+		Name:        "dtm",
+		Description: "Generate a digital terrain model from ground returns",
+		Output:      OutputRaster,
+		NewOptions:  func() interface{} { return NewDtmOptions() },
+		Run:         Dtm,
+		Pipeline:    DtmPipeline,
+		Timeout:     30 * time.Minute,
+		Weight:      2,
+	})
+}
+
+// dtmBase returns the filename given to writers.p2g, which appends the output
+// type and format to it.
+func dtmBase(o string) string {
+	return filepath.Join(filepath.Dir(o), "output")
+}
+
+// DtmPipeline builds a pipeline that extracts the ground returns and grids
+// their minimum elevations with writers.p2g.
+func DtmPipeline(i, o string, options *json.RawMessage) (*Pipeline, error) {
 	opts := NewDtmOptions()
 	if options != nil {
 		if err := json.Unmarshal(*options, &opts); err != nil {
@@ -43,33 +70,36 @@ func Dtm(i, o string, options *json.RawMessage) ([]byte, error) {
 		}
 	}
 
-	var args []string
-	args = append(args, "translate")
-	args = append(args, i)
-	args = append(args, "output")
-	args = append(args, "ground")
-	args = append(args, "--filters.ground.extract=true")
-	args = append(args, "--filters.ground.classify=false")
-	args = append(args, "-w", "writers.p2g")
-	args = append(args, "--writers.p2g.output_type=min")
-	args = append(args, "--writers.p2g.output_format=tif")
-	args = append(args, "--writers.p2g.grid_dist_x="+
-		strconv.FormatFloat(opts.GridSize, 'f', -1, 64))
-	args = append(args, "--writers.p2g.grid_dist_y="+
-		strconv.FormatFloat(opts.GridSize, 'f', -1, 64))
-	args = append(args, "-v", "10", "--debug")
-
-	out, err := exec.Command("pdal", args...).CombinedOutput()
+	p := NewPipeline(i, dtmBase(o), Filter("ground", map[string]interface{}{
+		"extract":  true,
+		"classify": false,
+	}))
+	w := p.Writer()
+	w.Type = "writers.p2g"
+	w.Options = map[string]interface{}{
+		"output_type":   "min",
+		"output_format": "tif",
+		"grid_dist_x":   opts.GridSize,
+		"grid_dist_y":   opts.GridSize,
+	}
+	return p, nil
+}
 
-	fmt.Println(string(out))
+// Dtm runs the DtmPipeline, returning the Metadata of the run.
+func Dtm(ctx context.Context, i, o string, options *json.RawMessage) ([]byte, error) {
+	p, err := DtmPipeline(i, o, options)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := p.Run(ctx, pipelineFile(o)); err != nil {
+		return nil, err
+	}
 
-	err = os.Rename("output.min.tif", o)
-	if err != nil {
+	// writers.p2g appends the output type and format to the given filename, so
+	// write alongside the requested output and rename when done.
+	if err := os.Rename(dtmBase(o)+".min.tif", o); err != nil {
 		return nil, err
 	}
 
-	return nil, nil
+	return json.Marshal(CollectMetadata(pipelineFile(o), o))
 }
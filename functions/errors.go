@@ -0,0 +1,200 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stable error codes describing why PDAL failed.
+const (
+	// ErrInvalidInput indicates that the input data could not be read.
+	ErrInvalidInput = "INVALID_INPUT"
+	// ErrDriverNotFound indicates that a reader, writer, or filter does not
+	// exist in this build of PDAL.
+	ErrDriverNotFound = "DRIVER_NOT_FOUND"
+	// ErrSRS indicates a problem with a spatial reference system.
+	ErrSRS = "SRS_ERROR"
+	// ErrOutOfMemory indicates that PDAL ran out of memory, or was killed.
+	ErrOutOfMemory = "OUT_OF_MEMORY"
+	// ErrPDAL is used for any other failure.
+	ErrPDAL = "PDAL_ERROR"
+	// ErrTimeout indicates that the work did not finish in time, and was
+	// abandoned.
+	ErrTimeout = "TIMEOUT"
+)
+
+// maxStderrLines limits the number of stderr lines returned to the client.
+const maxStderrLines = 20
+
+/*
+PdalError describes a failed PDAL invocation.
+
+It is encoded as JSON, so that clients receive the exit code, the relevant
+lines of stderr, the stage that failed (if it could be determined), and a
+stable error code.
+*/
+type PdalError struct {
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+	ExitCode int      `json:"exit_code"`
+	Stage    string   `json:"stage,omitempty"`
+	Stderr   []string `json:"stderr,omitempty"`
+}
+
+func (e *PdalError) Error() string {
+	msg := "PDAL failed with exit code " + strconv.Itoa(e.ExitCode) + " (" + e.Code + ")"
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// HTTPStatus maps the error code to an HTTP status. Problems with the request
+// (input, drivers, SRS) are client errors.
+func (e *PdalError) HTTPStatus() int {
+	switch e.Code {
+	case ErrInvalidInput, ErrDriverNotFound, ErrSRS:
+		return http.StatusBadRequest
+	case ErrOutOfMemory:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// errorPattern classifies a line of PDAL stderr.
+type errorPattern struct {
+	code string
+	re   *regexp.Regexp
+}
+
+// errorPatterns are checked in order, so more specific patterns come first.
+var errorPatterns = []errorPattern{
+	{ErrOutOfMemory, regexp.MustCompile(`(?i)bad_alloc|out of memory|cannot allocate memory`)},
+	{ErrDriverNotFound, regexp.MustCompile(`(?i)couldn't create (reader|writer|filter) stage|unable to infer (reader|writer)|no (reader|writer) for|unknown (stage|driver)|driver .* not found`)},
+	{ErrSRS, regexp.MustCompile(`(?i)srs|spatial reference|coordinate system|proj4|projection|reproject`)},
+	{ErrInvalidInput, regexp.MustCompile(`(?i)unable to open|can't open|cannot open|no such file|invalid file|file signature|not a valid|unable to read|failed to read|corrupt|invalid (bounds|polygon|wkt|option)|unexpected (argument|option)`)},
+}
+
+var (
+	// relevantLine picks out lines of stderr that are likely to explain a
+	// failure, rather than debug output.
+	relevantLine = regexp.MustCompile(`(?i)error|exception|unable|couldn't|could not|can't|cannot|invalid|fail|bad_alloc|memory`)
+	// stagePattern extracts the stage name from lines such as
+	// "readers.las: Invalid file signature".
+	stagePattern = regexp.MustCompile(`\b((?:readers|writers|filters)\.[a-z0-9_]+)\b`)
+	// quotedStage extracts the stage name from lines such as
+	// "Couldn't create filter stage of type 'filters.foo'".
+	quotedStage = regexp.MustCompile(`type '([^']+)'`)
+)
+
+/*
+NewPdalError classifies a PDAL failure from its exit code and stderr.
+
+An exit code of -1 indicates that PDAL was killed by a signal, which (absent
+any other explanation) is most likely the out-of-memory killer.
+*/
+func NewPdalError(exitCode int, stderr []byte) *PdalError {
+	e := &PdalError{Code: ErrPDAL, ExitCode: exitCode}
+
+	var lines []string
+	for _, l := range strings.Split(string(stderr), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	for _, l := range lines {
+		if relevantLine.MatchString(l) {
+			e.Stderr = append(e.Stderr, l)
+		}
+	}
+	// If nothing stands out, the tail of stderr is our best guess.
+	if len(e.Stderr) == 0 {
+		e.Stderr = lines
+	}
+	if len(e.Stderr) > maxStderrLines {
+		e.Stderr = e.Stderr[len(e.Stderr)-maxStderrLines:]
+	}
+
+classify:
+	for _, p := range errorPatterns {
+		for _, l := range e.Stderr {
+			if p.re.MatchString(l) {
+				e.Code = p.code
+				e.Message = l
+				break classify
+			}
+		}
+	}
+	if e.Code == ErrPDAL {
+		if exitCode == -1 {
+			e.Code = ErrOutOfMemory
+			e.Message = "PDAL was killed"
+		} else if len(e.Stderr) > 0 {
+			e.Message = e.Stderr[len(e.Stderr)-1]
+		}
+	}
+
+	if m := quotedStage.FindStringSubmatch(e.Message); m != nil {
+		e.Stage = m[1]
+	} else if m := stagePattern.FindStringSubmatch(e.Message); m != nil {
+		e.Stage = m[1]
+	}
+
+	return e
+}
+
+// TimeoutError indicates that PDAL, or a transfer, was stopped because its
+// deadline passed.
+type TimeoutError struct {
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Timeout float64 `json:"timeout,omitempty"`
+}
+
+// NewTimeoutError describes work abandoned after the given limit.
+func NewTimeoutError(limit time.Duration) *TimeoutError {
+	return &TimeoutError{
+		Code:    ErrTimeout,
+		Message: "Timed out after " + limit.String(),
+		Timeout: limit.Seconds(),
+	}
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Message
+}
+
+// HTTPStatus is always 504 Gateway Timeout.
+func (e *TimeoutError) HTTPStatus() int {
+	return http.StatusGatewayTimeout
+}
+
+// ContextError explains why ctx is done: a *TimeoutError if its deadline
+// passed, or context.Canceled otherwise.
+func ContextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Code: ErrTimeout, Message: "Timed out"}
+	}
+	return ctx.Err()
+}
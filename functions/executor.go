@@ -0,0 +1,75 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// Executor runs the PDAL CLI.
+type Executor interface {
+	// Run invokes PDAL with the given arguments, returning its standard
+	// output. If PDAL fails, the error should be a *PdalError. PDAL should be
+	// stopped if ctx is done before it exits.
+	Run(ctx context.Context, args ...string) ([]byte, error)
+}
+
+// killGrace is how long we wait for PDAL's output to be closed after it has
+// been killed, in case a child process is still holding it open.
+const killGrace = 5 * time.Second
+
+// CommandExecutor runs the named PDAL executable as a subprocess.
+type CommandExecutor struct {
+	Name string
+}
+
+// Run implements Executor. Standard error, where PDAL writes its log, is
+// logged on success and used to explain the failure otherwise. If ctx is done
+// first, PDAL and any children it has started are killed.
+func (e CommandExecutor) Run(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = killGrace
+	killProcessGroup(cmd)
+
+	err := cmd.Run()
+	if err != nil {
+		log.Println(stderr.String())
+		if ctx.Err() != nil {
+			return stdout.Bytes(), ContextError(ctx)
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return stdout.Bytes(), NewPdalError(exitErr.ExitCode(), stderr.Bytes())
+		}
+		return stdout.Bytes(), &PdalError{Code: ErrPDAL, Message: err.Error(), ExitCode: -1}
+	}
+	if stderr.Len() > 0 {
+		log.Println(stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// PDAL is the Executor used by every function and handler. It may be replaced,
+// e.g., with a pdaltest.Recorder so that tests can run without PDAL.
+var PDAL Executor = CommandExecutor{Name: "pdal"}
@@ -0,0 +1,377 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+)
+
+func raw(s string) *json.RawMessage {
+	r := json.RawMessage(s)
+	return &r
+}
+
+func TestFunctionPipelines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in.laz")
+	out := filepath.Join(dir, "out.laz")
+	if err := ioutil.WriteFile(in, []byte("fake laz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	quote := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+
+	tests := []struct {
+		name    string
+		options string
+		want    []string
+	}{
+		{"crop", `{"bounds": "([0,1],[0,1])"}`, []string{`{"pipeline":[{"filename":` + quote(in) + `},` +
+			`{"bounds":"([0,1],[0,1])","outside":false,"type":"filters.crop"},{"filename":` + quote(out) + `}]}`}},
+		{"crop", `{"polygon": "POLYGON((30 10, 40 40, 20 40, 10 20, 30 10))"}`,
+			[]string{`"polygon":"POLYGON((30 10, 40 40, 20 40, 10 20, 30 10))"`}},
+		{"dart", `{"radius": 2.5}`, []string{`{"radius":2.5,"type":"filters.dartsample"}`}},
+		{"dtm", `{"grid_size": 2}`, []string{`"type":"writers.p2g"`, `"grid_dist_x":2`,
+			`"filename":` + quote(filepath.Join(dir, "output"))}},
+		{"ground", `{}`, []string{`"cell_size":1`, `"slope":1`, `"type":"filters.ground"`}},
+		{"height", `{}`, []string{`{"type":"filters.ground"},{"type":"filters.height"},` +
+			`{"dimensions":"HeightAboveGround=Z","type":"filters.ferry"}`}},
+		{"radius", `{"neighbors": 4}`, []string{`"min_neighbors":4`, `"radius":1`, `"type":"filters.radiusoutlier"`}},
+		{"statistical", `{"thresh": 3}`, []string{`"thresh":3`, `"type":"filters.statisticaloutlier"`}},
+		{"translate", `{"args": "range --filters.range.limits=Z[0:100]"}`,
+			[]string{`{"limits":"Z[0:100]","type":"filters.range"}`}},
+		{"translate", `{"args": "crop --filters.crop.polygon='POLYGON((0 0, 1 0, 1 1, 0 0))' -w writers.text -v 10"}`,
+			[]string{`"polygon":"POLYGON((0 0, 1 0, 1 1, 0 0))"`, `{"filename":` + quote(out) + `,"type":"writers.text"}`}},
+		{"translate", `{"filters": [{"type": "range", "options": {"limits": "Z[0:100]"}}, {"type": "filters.height"}]}`,
+			[]string{`{"filename":` + quote(in) + `},{"limits":"Z[0:100]","type":"filters.range"},{"type":"filters.height"},{"filename":` + quote(out) + `}`}},
+		{"vo", `{}`, []string{`{"filename":` + quote(out) + `,"type":"writers.vo"}`}},
+	}
+
+	for _, tt := range tests {
+		rec := &pdaltest.Recorder{
+			Output: []byte("{}"),
+			Files:  map[string][]byte{"out.laz": []byte("{}"), "output.min.tif": nil},
+		}
+		restore := pdaltest.Install(rec)
+
+		fn, ok := functions.Lookup(tt.name)
+		if !ok {
+			t.Fatalf("%s is not registered", tt.name)
+		}
+		if _, err := fn.Run(context.Background(), in, out, raw(tt.options)); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		restore()
+
+		if args := rec.Last(); len(args) < 2 || args[0] != "pipeline" {
+			t.Errorf("%s: expected a pipeline to be run, got %v", tt.name, args)
+			continue
+		}
+		p := string(rec.LastPipeline())
+		for _, want := range tt.want {
+			if !strings.Contains(p, want) {
+				t.Errorf("%s: expected %s in %s", tt.name, want, p)
+			}
+		}
+
+		// The pipeline run is the one the function describes.
+		built, err := fn.Pipeline(in, out, raw(tt.options))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if b, _ := json.Marshal(built); string(b) != p {
+			t.Errorf("%s: ran %s, but described %s", tt.name, p, b)
+		}
+	}
+}
+
+func TestInfoCommand(t *testing.T) {
+	rec := &pdaltest.Recorder{Output: []byte(`{"filename": "in.laz"}`)}
+	defer pdaltest.Install(rec)()
+
+	fn, _ := functions.Lookup("info")
+	if fn.Pipeline != nil {
+		t.Error("Expected info to run a command rather than a pipeline")
+	}
+	if _, err := fn.Run(context.Background(), "in.laz", "", raw(`{"boundary": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Join(rec.Last(), " "); args != "info in.laz --boundary" {
+		t.Errorf("Unexpected PDAL arguments %s", args)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		fields  []string
+	}{
+		{"crop", `{"bounds": "([0,1],[0,1])"}`, nil},
+		{"crop", `{"polygon": "POLYGON((30 10, 40 40, 20 40, 10 20, 30 10))"}`, nil},
+		{"crop", `{"polygon": "MULTIPOLYGON(((0 0, 1 0, 1 1, 0 0)), ((5 5, 6 5, 6 6, 5 5)))"}`, nil},
+		{"crop", `{}`, []string{"bounds|polygon"}},
+		{"crop", `{"bounds": "([1,0],[0,1])"}`, []string{"bounds"}},
+		{"crop", `{"polygon": "POLYGON((30 10, 40 40, 20 40, 10 20))"}`, []string{"polygon"}},
+		{"crop", `{"polygon": "POLYGON((30 10, 40, 20 40, 30 10))"}`, []string{"polygon"}},
+		{"ground", `{"slope": -1, "cell_size": 0, "bogus": true}`, []string{"bogus", "cell_size", "slope"}},
+		{"radius", `{"neighbors": 0, "radius": "1"}`, []string{"neighbors", "radius"}},
+		{"statistical", `{"neighbors": 1.5}`, []string{"neighbors"}},
+		{"info", `{"metadata": true}`, nil},
+		{"height", `{"foo": 1}`, []string{"foo"}},
+		{"dtm", `[1]`, []string{"options"}},
+		{"translate", `{"filters": [{"type": "range", "options": {"limits": "Z[0:100]"}}, {"type": "filters.height"}]}`, nil},
+		{"translate", `{"filters": [{"type": "python"}, {"type": "range", "options": {"filename": "/etc/passwd"}}, {"options": {}}]}`,
+			[]string{"filters[0].type", "filters[1].options.filename", "filters[2].type"}},
+		{"translate", `{"filters": {"type": "range"}}`, []string{"filters"}},
+		{"translate", `{"args": "range --filters.range.limits=Z[0:100]"}`, []string{"args"}},
+	}
+
+	for _, tt := range tests {
+		fn, _ := functions.Lookup(tt.name)
+		_, err := fn.ParseOptions(raw(tt.options))
+		if tt.fields == nil {
+			if err != nil {
+				t.Errorf("%s %s: unexpected error %v", tt.name, tt.options, err)
+			}
+			continue
+		}
+		verr, ok := err.(functions.ValidationError)
+		if !ok {
+			t.Errorf("%s %s: expected ValidationError, got %v", tt.name, tt.options, err)
+			continue
+		}
+		var fields []string
+		for _, fe := range verr {
+			fields = append(fields, fe.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+			t.Errorf("%s %s: expected problems with %v, got %v", tt.name, tt.options, tt.fields, verr)
+		}
+	}
+}
+
+func TestSchemaBadPattern(t *testing.T) {
+	s := &functions.Schema{Properties: map[string]*functions.Schema{"name": {Type: "string", Pattern: "("}}}
+	verr := s.Validate(map[string]json.RawMessage{"name": json.RawMessage(`"x"`)})
+	if len(verr) != 1 || verr[0].Field != "name" {
+		t.Errorf("Expected a problem with name, got %v", verr)
+	}
+}
+
+func TestTranslateArgs(t *testing.T) {
+	functions.TranslateArgs = true
+	defer func() { functions.TranslateArgs = false }()
+
+	tests := []struct {
+		options string
+		valid   bool
+	}{
+		{`{"args": "range --filters.range.limits=Z[0:100] -w writers.text"}`, true},
+		{`{"args": "crop --filters.crop.polygon='POLYGON((0 0, 1 1)"}`, false},
+		{`{"args": "range --filters.crop.bounds=([0,1],[0,1])"}`, false},
+		{`{"args": "-i in.laz"}`, false},
+		{`{"args": "python --filters.python.script=evil.py"}`, false},
+		{`{"args": "range --filters.range.filename=/etc/passwd"}`, false},
+		{`{"args": "range", "filters": [{"type": "range"}]}`, false},
+		{`{"args": "range -r readers.pgpointcloud"}`, false},
+		{`{"args": "range -w writers.sqlite"}`, false},
+		{`{"args": "range --writers.las.compression=laszip"}`, true},
+		{`{"args": "range -w writers.text --writers.text.filename=/etc/passwd"}`, false},
+	}
+
+	fn, _ := functions.Lookup("translate")
+	for _, tt := range tests {
+		_, err := fn.ParseOptions(raw(tt.options))
+		if tt.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.options, err)
+		}
+		if verr, ok := err.(functions.ValidationError); !tt.valid && (!ok || verr[0].Field != "args") {
+			t.Errorf("%s: expected a problem with args, got %v", tt.options, err)
+		}
+	}
+}
+
+func TestOptionsSchema(t *testing.T) {
+	for _, name := range functions.Names() {
+		fn, _ := functions.Lookup(name)
+		s := fn.OptionsSchema()
+		if s.Type != "object" {
+			t.Errorf("%s: expected object schema, got %q", name, s.Type)
+		}
+
+		// Every option should be described, and defaults should agree.
+		b, err := json.Marshal(fn.DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var defaults map[string]interface{}
+		json.Unmarshal(b, &defaults)
+		for k, v := range defaults {
+			prop, ok := s.Properties[k]
+			if !ok {
+				t.Errorf("%s: option %q is not described", name, k)
+				continue
+			}
+			if prop.Default != nil {
+				d, _ := json.Marshal(prop.Default)
+				e, _ := json.Marshal(v)
+				if string(d) != string(e) {
+					t.Errorf("%s: default for %q is %s, expected %s", name, k, d, e)
+				}
+			}
+		}
+	}
+}
+
+func TestNewPdalError(t *testing.T) {
+	tests := []struct {
+		exitCode int
+		stderr   string
+		code     string
+		stage    string
+		status   int
+	}{
+		{1, "(pdal translate Debug) Starting\nPDAL: readers.las: Invalid file signature.\n",
+			functions.ErrInvalidInput, "readers.las", 400},
+		{1, "PDAL: Couldn't create filter stage of type 'filters.foo'.\n",
+			functions.ErrDriverNotFound, "filters.foo", 400},
+		{1, "PDAL: filters.reprojection: Invalid spatial reference 'EPSG:0'.\n",
+			functions.ErrSRS, "filters.reprojection", 400},
+		{1, "terminate called after throwing an instance of 'std::bad_alloc'\n",
+			functions.ErrOutOfMemory, "", 503},
+		{-1, "", functions.ErrOutOfMemory, "", 503},
+		{2, "something went sideways\n", functions.ErrPDAL, "", 500},
+	}
+
+	for _, tt := range tests {
+		e := functions.NewPdalError(tt.exitCode, []byte(tt.stderr))
+		if e.Code != tt.code || e.Stage != tt.stage || e.HTTPStatus() != tt.status {
+			t.Errorf("%q: expected %s/%q/%d, got %s/%q/%d", tt.stderr, tt.code, tt.stage,
+				tt.status, e.Code, e.Stage, e.HTTPStatus())
+		}
+		if e.ExitCode != tt.exitCode {
+			t.Errorf("%q: expected exit code %d, got %d", tt.stderr, tt.exitCode, e.ExitCode)
+		}
+	}
+}
+
+func TestCommandExecutorTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	// The child sleep holds stdout open, so we would wait for it too if only
+	// the shell were killed.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := functions.CommandExecutor{Name: "sh"}.Run(ctx, "-c", "sleep 30 & wait")
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the process group to be killed, took %s", elapsed)
+	}
+	if e, ok := err.(*functions.TimeoutError); !ok || e.Code != functions.ErrTimeout {
+		t.Errorf("Expected TimeoutError, got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in.laz")
+	if err := ioutil.WriteFile(in, []byte("fake laz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &pdaltest.Recorder{
+		Files: map[string][]byte{"out.laz": pdaltest.LASHeader(40, [6]float64{0, 1, 2, 3, 4, 5})},
+		Metadata: []byte(`{"stages": {
+			"readers.las": {"count": 100, "minx": -1, "miny": 0, "minz": 1, "maxx": 5, "maxy": 6, "maxz": 7,
+				"comp_spatialreference": "PROJCS[\"UTM\"]"},
+			"filters.crop": {},
+			"writers.las": {"filename": ["out.laz"]}
+		}}`),
+	}
+	defer pdaltest.Install(rec)()
+
+	fn, _ := functions.Lookup("crop")
+	b, err := fn.Run(context.Background(), in, filepath.Join(dir, "out.laz"), raw(`{"bounds": "([0,1],[0,1])"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(rec.Last(), " ")
+	if !strings.Contains(args, "--metadata "+filepath.Join(dir, "out.laz.pipeline.metadata.json")) {
+		t.Errorf("Expected PDAL to write metadata, got %s", args)
+	}
+
+	var m functions.Metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("%v: %s", err, b)
+	}
+	if m.Input == nil || m.Input.Points == nil || *m.Input.Points != 100 || m.Input.SRS != `PROJCS["UTM"]` ||
+		m.Input.Bounds == nil || m.Input.Bounds.MinX != -1 || m.Input.Bounds.MaxZ != 7 {
+		t.Errorf("Unexpected input %s", b)
+	}
+	if m.Output == nil || m.Output.Points == nil || *m.Output.Points != 40 || m.Output.Size != 375 ||
+		m.Output.Bounds == nil || *m.Output.Bounds != (functions.Bounds{0, 1, 2, 3, 4, 5}) {
+		t.Errorf("Unexpected output %s", b)
+	}
+	if len(m.Stages) != 3 || m.Stages["filters.crop"] == nil {
+		t.Errorf("Expected the metadata of each stage, got %s", b)
+	}
+
+	// Readers of the same type are listed together, and their input summed.
+	mm, err := functions.ParseMetadata([]byte(`{"readers.las": [
+		{"count": 10, "minx": 0, "miny": 0, "minz": 0, "maxx": 1, "maxy": 1, "maxz": 1, "srs": {"wkt": "GEOGCS[]"}},
+		{"count": 5, "minx": -1, "miny": 2, "minz": 0, "maxx": 0, "maxy": 3, "maxz": 1}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := functions.Bounds{MinX: -1, MinY: 0, MinZ: 0, MaxX: 1, MaxY: 3, MaxZ: 1}
+	if mm.Input == nil || *mm.Input.Points != 15 || *mm.Input.Bounds != want || mm.Input.SRS != "GEOGCS[]" {
+		t.Errorf("Unexpected input %+v", mm.Input)
+	}
+
+	// Outputs other than LAS have only their size.
+	tif := filepath.Join(dir, "out.tif")
+	ioutil.WriteFile(tif, []byte("II*\x00"), 0644)
+	if s, err := functions.SummarizeOutput(tif); err != nil || s.Size != 4 || s.Points != nil {
+		t.Errorf("Unexpected summary %+v, %v", s, err)
+	}
+}
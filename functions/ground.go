@@ -16,12 +16,7 @@ limitations under the License.
 
 package functions
 
-import (
-	"encoding/json"
-	"fmt"
-	"os/exec"
-	"strconv"
-)
+import "encoding/json"
 
 // GroundOptions defines options for the Ground function.
 type GroundOptions struct {
@@ -43,8 +38,44 @@ func NewGroundOptions() *GroundOptions {
 	}
 }
 
-// Ground implements pdal ground.
-func Ground(i, o string, options *json.RawMessage) ([]byte, error) {
+// JSONSchema describes GroundOptions.
+func (o *GroundOptions) JSONSchema() *Schema {
+	return newObjectSchema("ground", "Options for the Ground function", map[string]*Schema{
+		"cell_size":        positive("cell size of the morphological filter", unitsDistance, o.CellSize),
+		"initial_distance": nonNegative("initial elevation difference threshold", unitsDistance, o.InitialDistance),
+		"max_distance":     positive("maximum elevation difference threshold", unitsDistance, o.MaxDistance),
+		"max_window_size":  positive("maximum size of the morphological filter window", unitsDistance, o.MaxWindowSize),
+		"slope":            nonNegative("terrain slope, as rise over run", "", o.Slope),
+	})
+}
+
+func init() {
+	Register(Function{
+		Name:        "ground",
+		Description: "Extract ground returns using a progressive morphological filter",
+		Output:      OutputFile,
+		NewOptions:  func() interface{} { return NewGroundOptions() },
+		Pipeline:    Ground,
+		Weight:      2,
+	})
+}
+
+// groundFilter returns the ground filter, extracting the ground returns.
+func groundFilter(opts *GroundOptions) Stage {
+	return Filter("ground", map[string]interface{}{
+		"extract":          true,
+		"classify":         false,
+		"cell_size":        opts.CellSize,
+		"initial_distance": opts.InitialDistance,
+		"max_distance":     opts.MaxDistance,
+		"max_window_size":  opts.MaxWindowSize,
+		"slope":            opts.Slope,
+	})
+}
+
+// Ground builds a pipeline with a ground filter, extracting the ground
+// returns.
+func Ground(i, o string, options *json.RawMessage) (*Pipeline, error) {
 	opts := NewGroundOptions()
 	if options != nil {
 		if err := json.Unmarshal(*options, &opts); err != nil {
@@ -52,31 +83,5 @@ func Ground(i, o string, options *json.RawMessage) ([]byte, error) {
 		}
 	}
 
-	var args []string
-	args = append(args, "translate")
-	args = append(args, i)
-	args = append(args, o)
-	args = append(args, "ground")
-	args = append(args, "--filters.ground.extract=true")
-	args = append(args, "--filters.ground.classify=false")
-	args = append(args, "--filters.ground.cell_size="+
-		strconv.FormatFloat(opts.CellSize, 'f', -1, 64))
-	args = append(args, "--filters.ground.initial_distance="+
-		strconv.FormatFloat(opts.InitialDistance, 'f', -1, 64))
-	args = append(args, "--filters.ground.max_distance="+
-		strconv.FormatFloat(opts.MaxDistance, 'f', -1, 64))
-	args = append(args, "--filters.ground.max_window_size="+
-		strconv.FormatFloat(opts.MaxWindowSize, 'f', -1, 64))
-	args = append(args, "--filters.ground.slope="+
-		strconv.FormatFloat(opts.Slope, 'f', -1, 64))
-	args = append(args, "-v", "10", "--debug")
-
-	out, err := exec.Command("pdal", args...).CombinedOutput()
-
-	fmt.Println(string(out))
-	if err != nil {
-		return nil, err
-	}
-
-	return nil, nil
+	return NewPipeline(i, o, groundFilter(opts)), nil
 }
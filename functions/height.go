@@ -16,22 +16,24 @@ limitations under the License.
 
 package functions
 
-import (
-	"encoding/json"
-	"fmt"
-	"os/exec"
-)
-
-// Height implements pdal height.
-func Height(i, o string, options *json.RawMessage) ([]byte, error) {
-	out, err := exec.Command("pdal", "translate", i, o,
-		"ground", "height", "ferry",
-		"--filters.ferry.dimensions=HeightAboveGround=Z", "-v", "10", "--debug").CombinedOutput()
-
-	fmt.Println(string(out))
-	if err != nil {
-		return nil, err
-	}
+import "encoding/json"
+
+func init() {
+	Register(Function{
+		Name:        "height",
+		Description: "Replace Z with height above ground",
+		Output:      OutputFile,
+		Pipeline:    Height,
+		Weight:      2,
+	})
+}
 
-	return nil, nil
+// Height builds a pipeline that classifies ground returns, computes the
+// height of each point above them, and replaces Z with that height.
+func Height(i, o string, options *json.RawMessage) (*Pipeline, error) {
+	return NewPipeline(i, o,
+		Filter("ground", nil),
+		Filter("height", nil),
+		Filter("ferry", map[string]interface{}{"dimensions": "HeightAboveGround=Z"}),
+	), nil
 }
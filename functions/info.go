@@ -18,9 +18,10 @@ package functions
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"os/exec"
+	"time"
 )
 
 // InfoOptions defines options for the Info function.
@@ -42,8 +43,28 @@ func NewInfoOptions() *InfoOptions {
 	}
 }
 
+// JSONSchema describes InfoOptions.
+func (o *InfoOptions) JSONSchema() *Schema {
+	return newObjectSchema("info", "Options for the Info function", map[string]*Schema{
+		"boundary": flag("compute hexagonal boundary that contains all points", o.Boundary),
+		"metadata": flag("dump metadata associated with the input file", o.Metadata),
+		"schema":   flag("dump the schema of the internal point storage", o.Schema),
+	})
+}
+
+func init() {
+	Register(Function{
+		Name:        "info",
+		Description: "Report information about a point cloud",
+		Output:      OutputJSON,
+		NewOptions:  func() interface{} { return NewInfoOptions() },
+		Run:         Info,
+		Timeout:     2 * time.Minute,
+	})
+}
+
 // Info implements pdal info.
-func Info(i, o string, options *json.RawMessage) ([]byte, error) {
+func Info(ctx context.Context, i, o string, options *json.RawMessage) ([]byte, error) {
 	opts := NewInfoOptions()
 	if options != nil {
 		if err := json.Unmarshal(*options, &opts); err != nil {
@@ -64,9 +85,9 @@ func Info(i, o string, options *json.RawMessage) ([]byte, error) {
 		args = append(args, "--schema")
 	}
 
-	out, err := exec.Command("pdal", args...).CombinedOutput()
+	out, err := PDAL.Run(ctx, args...)
 	if err != nil {
-		return nil, errors.New("Error with exec.Command() " + err.Error())
+		return nil, err
 	}
 
 	// Trim whitespace
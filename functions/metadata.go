@@ -0,0 +1,257 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Bounds are the extents of a point cloud.
+type Bounds struct {
+	MinX float64 `json:"minx"`
+	MinY float64 `json:"miny"`
+	MinZ float64 `json:"minz"`
+	MaxX float64 `json:"maxx"`
+	MaxY float64 `json:"maxy"`
+	MaxZ float64 `json:"maxz"`
+}
+
+// union returns the bounds covering both b and o, either of which may be nil.
+func (b *Bounds) union(o *Bounds) *Bounds {
+	if b == nil {
+		return o
+	}
+	if o == nil {
+		return b
+	}
+	return &Bounds{
+		MinX: min(b.MinX, o.MinX), MinY: min(b.MinY, o.MinY), MinZ: min(b.MinZ, o.MinZ),
+		MaxX: max(b.MaxX, o.MaxX), MaxY: max(b.MaxY, o.MaxY), MaxZ: max(b.MaxZ, o.MaxZ),
+	}
+}
+
+// Summary describes the input or output of a run. Anything not known is
+// left out.
+type Summary struct {
+	Points *uint64 `json:"points,omitempty"`
+	Bounds *Bounds `json:"bounds,omitempty"`
+	// SRS is the spatial reference system, in WKT.
+	SRS string `json:"srs,omitempty"`
+	// Size is the size of the output file, in bytes.
+	Size int64 `json:"size,omitempty"`
+}
+
+/*
+Metadata is what is known about a run of a pipeline.
+
+The input is summarized from the metadata of the readers, which PDAL writes
+when given --metadata, and the output from the file written, whose point
+count and bounds are read from its header if it is LAS or LAZ. A pipeline
+with several writers has each of their outputs summarized in Outputs, in
+order, with Output the last. Stages holds PDAL's metadata for each stage, by
+type (with an array for a type used more than once).
+*/
+type Metadata struct {
+	Input   *Summary                   `json:"input,omitempty"`
+	Output  *Summary                   `json:"output,omitempty"`
+	Outputs []*Summary                 `json:"outputs,omitempty"`
+	Stages  map[string]json.RawMessage `json:"stages,omitempty"`
+}
+
+// MetadataFile returns the name of the file to which PDAL writes the
+// metadata of the pipeline saved as name.
+func MetadataFile(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".metadata.json"
+}
+
+// readerMetadata is the part of a reader's metadata that we summarize.
+type readerMetadata struct {
+	Count *uint64  `json:"count"`
+	MinX  *float64 `json:"minx"`
+	MinY  *float64 `json:"miny"`
+	MinZ  *float64 `json:"minz"`
+	MaxX  *float64 `json:"maxx"`
+	MaxY  *float64 `json:"maxy"`
+	MaxZ  *float64 `json:"maxz"`
+	// Older versions of PDAL give the SRS as comp_spatialreference, newer
+	// ones as srs.wkt too.
+	CompSpatialReference string          `json:"comp_spatialreference"`
+	SRS                  json.RawMessage `json:"srs"`
+}
+
+// bounds returns the reader's bounds, if it reported them all.
+func (r readerMetadata) bounds() *Bounds {
+	for _, v := range []*float64{r.MinX, r.MinY, r.MinZ, r.MaxX, r.MaxY, r.MaxZ} {
+		if v == nil {
+			return nil
+		}
+	}
+	return &Bounds{*r.MinX, *r.MinY, *r.MinZ, *r.MaxX, *r.MaxY, *r.MaxZ}
+}
+
+// srs returns the reader's SRS as WKT, if it reported one.
+func (r readerMetadata) srs() string {
+	if r.CompSpatialReference != "" {
+		return r.CompSpatialReference
+	}
+	var srs struct {
+		WKT string `json:"wkt"`
+	}
+	json.Unmarshal(r.SRS, &srs)
+	return srs.WKT
+}
+
+// ParseMetadata reads the metadata that PDAL wrote for a pipeline, with or
+// without its enclosing "stages" object, summarizing its input.
+func ParseMetadata(b []byte) (*Metadata, error) {
+	var stages map[string]json.RawMessage
+	if err := json.Unmarshal(b, &stages); err != nil {
+		return nil, err
+	}
+	if s, ok := stages["stages"]; ok {
+		stages = nil
+		if err := json.Unmarshal(s, &stages); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &Metadata{Stages: stages}
+	var input Summary
+	var points uint64
+	counted := false
+	for name, raw := range stages {
+		if !strings.HasPrefix(name, "readers.") {
+			continue
+		}
+		// Stages of the same type are listed together.
+		var readers []readerMetadata
+		if err := json.Unmarshal(raw, &readers); err != nil {
+			var r readerMetadata
+			if err := json.Unmarshal(raw, &r); err != nil {
+				return nil, err
+			}
+			readers = []readerMetadata{r}
+		}
+		for _, r := range readers {
+			if r.Count != nil {
+				points += *r.Count
+				counted = true
+			}
+			input.Bounds = input.Bounds.union(r.bounds())
+			if input.SRS == "" {
+				input.SRS = r.srs()
+			}
+		}
+	}
+	if counted {
+		input.Points = &points
+	}
+	if input != (Summary{}) {
+		m.Input = &input
+	}
+	return m, nil
+}
+
+// errNotLAS indicates that a file is not LAS or LAZ.
+var errNotLAS = errors.New("not a LAS file")
+
+/*
+readLASHeader summarizes a LAS or LAZ file from its public header block, which
+LAZ leaves uncompressed: the number of points (from the 64-bit count, for LAS
+1.4) and the bounds.
+*/
+func readLASHeader(r io.Reader) (*Summary, error) {
+	// The header of LAS 1.4, the largest, is 375 bytes.
+	h := make([]byte, 375)
+	n, err := io.ReadFull(r, h)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n < 227 || string(h[:4]) != "LASF" {
+		return nil, errNotLAS
+	}
+
+	le := binary.LittleEndian
+	points := uint64(le.Uint32(h[107:]))
+	major, minor, size := h[24], h[25], le.Uint16(h[94:])
+	if (major > 1 || minor >= 4) && size >= 375 && n >= 375 {
+		points = le.Uint64(h[247:])
+	}
+	f := func(off int) float64 {
+		return math.Float64frombits(le.Uint64(h[off:]))
+	}
+	return &Summary{
+		Points: &points,
+		Bounds: &Bounds{
+			MaxX: f(179), MinX: f(187),
+			MaxY: f(195), MinY: f(203),
+			MaxZ: f(211), MinZ: f(219),
+		},
+	}, nil
+}
+
+// SummarizeOutput describes the output file o: its size and, if it is LAS or
+// LAZ, its point count and bounds.
+func SummarizeOutput(o string) (*Summary, error) {
+	f, err := os.Open(o)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := readLASHeader(f)
+	if err != nil {
+		s = &Summary{}
+	}
+	s.Size = fi.Size()
+	return s, nil
+}
+
+// CollectMetadata returns what is known about the run of the pipeline saved
+// as name, which wrote o (if given, else the output is left out). Metadata is
+// a courtesy, so anything that cannot be read is logged and left out.
+func CollectMetadata(name, o string) *Metadata {
+	m := &Metadata{}
+	if b, err := ioutil.ReadFile(MetadataFile(name)); err != nil {
+		log.Println("No pipeline metadata:", err)
+	} else if m, err = ParseMetadata(b); err != nil {
+		log.Println("Error reading pipeline metadata:", err)
+		m = &Metadata{}
+	}
+
+	if o != "" {
+		s, err := SummarizeOutput(o)
+		if err != nil {
+			log.Println("Error summarizing output:", err)
+		}
+		m.Output = s
+	}
+	return m
+}
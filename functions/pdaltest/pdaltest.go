@@ -0,0 +1,201 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package pdaltest provides a fake PDAL executor for use in tests.
+
+For example,
+
+	rec := &pdaltest.Recorder{
+		Files: map[string][]byte{"ground.laz": []byte("fake point cloud")},
+	}
+	defer pdaltest.Install(rec)()
+
+	// ... exercise code that calls functions.PDAL ...
+
+	if got := rec.Last(); got[0] != "translate" {
+		t.Errorf("expected translate, got %v", got)
+	}
+*/
+package pdaltest
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+)
+
+/*
+Recorder is a functions.Executor that records the arguments of each invocation
+rather than running PDAL.
+
+Each invocation returns Output and Err. A non-zero ExitCode simulates a PDAL
+failure, returning the *functions.PdalError that the given Stderr would produce.
+A non-zero Delay simulates a slow PDAL, which is stopped early (returning the
+error that functions.ContextError gives) if the context is done.
+Unless the invocation fails, the canned Files are also written, as PDAL would
+have written them. Because inputs and outputs typically live in a per-job
+workspace whose name is not known in advance, each file is written to the
+directory of the first argument that names an existing file (usually the
+input), under the given name. The pipeline run by each "pdal pipeline"
+invocation is recorded too, as it would be removed with the job's workspace,
+and any canned Metadata is written to the file named by --metadata.
+*/
+type Recorder struct {
+	Output   []byte
+	Err      error
+	ExitCode int
+	Stderr   []byte
+	Delay    time.Duration
+	Files    map[string][]byte
+	Metadata []byte
+
+	mu        sync.Mutex
+	calls     [][]string
+	pipelines [][]byte
+}
+
+// Run implements functions.Executor.
+func (r *Recorder) Run(ctx context.Context, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, append([]string(nil), args...))
+	if len(args) > 1 && args[0] == "pipeline" {
+		b, _ := ioutil.ReadFile(args[1])
+		r.pipelines = append(r.pipelines, b)
+	}
+	r.mu.Unlock()
+
+	if r.Delay > 0 {
+		select {
+		case <-time.After(r.Delay):
+		case <-ctx.Done():
+			return nil, functions.ContextError(ctx)
+		}
+	}
+
+	if r.Err != nil {
+		return r.Output, r.Err
+	}
+	if r.ExitCode != 0 {
+		return r.Output, functions.NewPdalError(r.ExitCode, r.Stderr)
+	}
+
+	if r.Metadata != nil {
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == "--metadata" {
+				if err := ioutil.WriteFile(args[i+1], r.Metadata, 0644); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if len(r.Files) > 0 {
+		dir, ok := workspaceDir(args)
+		if !ok {
+			dir = "."
+		}
+		for name, data := range r.Files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return r.Output, nil
+}
+
+// Calls returns the arguments of every invocation so far.
+func (r *Recorder) Calls() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.calls...)
+}
+
+// Last returns the arguments of the most recent invocation, or nil if there
+// have been none.
+func (r *Recorder) Last() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.calls) == 0 {
+		return nil
+	}
+	return r.calls[len(r.calls)-1]
+}
+
+// Pipelines returns the JSON of every pipeline run so far.
+func (r *Recorder) Pipelines() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.pipelines...)
+}
+
+// LastPipeline returns the JSON of the most recent pipeline run, or nil if
+// there has been none.
+func (r *Recorder) LastPipeline() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pipelines) == 0 {
+		return nil
+	}
+	return r.pipelines[len(r.pipelines)-1]
+}
+
+// Install replaces functions.PDAL with e, returning a function that restores
+// the original executor.
+func Install(e functions.Executor) func() {
+	orig := functions.PDAL
+	functions.PDAL = e
+	return func() { functions.PDAL = orig }
+}
+
+// workspaceDir returns the directory of the first argument naming an existing
+// file.
+func workspaceDir(args []string) (string, bool) {
+	for _, a := range args {
+		if fi, err := os.Stat(a); err == nil && !fi.IsDir() {
+			return filepath.Dir(a), true
+		}
+	}
+	return "", false
+}
+
+// LASHeader returns the public header block of a LAS 1.4 file holding the
+// given number of points, within the given bounds (minx, miny, minz, maxx,
+// maxy, maxz), for use as the contents of a canned file.
+func LASHeader(points uint64, bounds [6]float64) []byte {
+	h := make([]byte, 375)
+	le := binary.LittleEndian
+	copy(h, "LASF")
+	h[24], h[25] = 1, 4
+	le.PutUint16(h[94:], 375)
+	le.PutUint32(h[96:], 375)
+	if points <= math.MaxUint32 {
+		le.PutUint32(h[107:], uint32(points))
+	}
+	for i, v := range []float64{bounds[3], bounds[0], bounds[4], bounds[1], bounds[5], bounds[2]} {
+		le.PutUint64(h[179+8*i:], math.Float64bits(v))
+	}
+	le.PutUint64(h[247:], points)
+	return h
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+)
+
+// Stage is a reader, filter or writer of a PDAL pipeline.
+type Stage struct {
+	// Type is the stage's driver, e.g., "filters.crop". Readers and writers
+	// may leave it empty, for PDAL to infer from the filename.
+	Type     string
+	Filename string
+	Options  map[string]interface{}
+}
+
+// MarshalJSON encodes the stage as PDAL expects: a single object holding its
+// type, filename and options. The type and filename given by the service
+// take precedence over any options of the same name.
+func (s Stage) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(s.Options)+2)
+	for k, v := range s.Options {
+		m[k] = v
+	}
+	if s.Type != "" {
+		m["type"] = s.Type
+	}
+	if s.Filename != "" {
+		m["filename"] = s.Filename
+	}
+	return json.Marshal(m)
+}
+
+// Reader returns a stage reading the file i, with the reader inferred from
+// its extension.
+func Reader(i string) Stage {
+	return Stage{Filename: i}
+}
+
+// Writer returns a stage writing the file o, with the writer inferred from
+// its extension.
+func Writer(o string) Stage {
+	return Stage{Filename: o}
+}
+
+// Filter returns a stage running the named filter, e.g., "crop" for
+// filters.crop, with the given options.
+func Filter(name string, options map[string]interface{}) Stage {
+	return Stage{Type: "filters." + name, Options: options}
+}
+
+// Pipeline is a PDAL pipeline, run with "pdal pipeline".
+type Pipeline struct {
+	Stages []Stage `json:"pipeline"`
+}
+
+// NewPipeline returns a pipeline reading i, running the given filters in
+// order, and writing o.
+func NewPipeline(i, o string, filters ...Stage) *Pipeline {
+	stages := make([]Stage, 0, len(filters)+2)
+	stages = append(stages, Reader(i))
+	stages = append(stages, filters...)
+	stages = append(stages, Writer(o))
+	return &Pipeline{Stages: stages}
+}
+
+// Writer returns the last stage of the pipeline, i.e., its writer, so that
+// its type and options can be set.
+func (p *Pipeline) Writer() *Stage {
+	return &p.Stages[len(p.Stages)-1]
+}
+
+// Run writes the pipeline to the file name, as JSON, and runs it, returning
+// PDAL's output. PDAL writes the metadata of the run alongside, for
+// CollectMetadata.
+func (p *Pipeline) Run(ctx context.Context, name string) ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		return nil, err
+	}
+	log.Println("Running pipeline:", string(b))
+
+	out, err := PDAL.Run(ctx, "pipeline", name, "--metadata", MetadataFile(name), "-v", "10", "--debug")
+	if len(bytes.TrimSpace(out)) > 0 {
+		log.Println(string(out))
+	}
+	return out, err
+}
+
+// PipelineFunc builds the pipeline that reads the input file i and writes the
+// output file o, as the options ask.
+type PipelineFunc func(i, o string, options *json.RawMessage) (*Pipeline, error)
+
+// pipelineFile returns the name of the file to which the pipeline writing o
+// is saved.
+func pipelineFile(o string) string {
+	return o + ".pipeline.json"
+}
+
+// RunPipeline returns a RunFunc that builds the pipeline and runs it,
+// returning the Metadata of the run.
+func RunPipeline(build PipelineFunc) RunFunc {
+	return func(ctx context.Context, i, o string, options *json.RawMessage) ([]byte, error) {
+		p, err := build(i, o, options)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.Run(ctx, pipelineFile(o)); err != nil {
+			return nil, err
+		}
+		return json.Marshal(CollectMetadata(pipelineFile(o), o))
+	}
+}
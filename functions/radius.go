@@ -16,12 +16,7 @@ limitations under the License.
 
 package functions
 
-import (
-	"encoding/json"
-	"fmt"
-	"os/exec"
-	"strconv"
-)
+import "encoding/json"
 
 // RadiusOptions defines options for the Radius function.
 type RadiusOptions struct {
@@ -35,8 +30,27 @@ func NewRadiusOptions() *RadiusOptions {
 	return &RadiusOptions{Neighbors: 2, Radius: 1.0}
 }
 
-// Radius implements pdal height.
-func Radius(i, o string, options *json.RawMessage) ([]byte, error) {
+// JSONSchema describes RadiusOptions.
+func (o *RadiusOptions) JSONSchema() *Schema {
+	return newObjectSchema("radius", "Options for the Radius function", map[string]*Schema{
+		"neighbors": count("minimum number of neighbors in radius", o.Neighbors, 1),
+		"radius":    positive("radius within which to count neighbors", unitsDistance, o.Radius),
+	})
+}
+
+func init() {
+	Register(Function{
+		Name:        "radius",
+		Description: "Remove outliers using a radius neighbor count",
+		Output:      OutputFile,
+		NewOptions:  func() interface{} { return NewRadiusOptions() },
+		Pipeline:    Radius,
+	})
+}
+
+// Radius builds a pipeline with a radiusoutlier filter, extracting the
+// inliers.
+func Radius(i, o string, options *json.RawMessage) (*Pipeline, error) {
 	opts := NewRadiusOptions()
 	if options != nil {
 		if err := json.Unmarshal(*options, &opts); err != nil {
@@ -44,22 +58,11 @@ func Radius(i, o string, options *json.RawMessage) ([]byte, error) {
 		}
 	}
 
-	var args []string
-	args = append(args, "translate", i, o, "radiusoutlier")
-	args = append(args, "--filters.radiusoutlier.min_neighbors="+
-		strconv.Itoa(opts.Neighbors))
-	args = append(args, "--filters.radiusoutlier.radius="+
-		strconv.FormatFloat(opts.Radius, 'f', -1, 64))
-	// we can make this optional later
-	args = append(args, "--filters.radiusoutlier.extract=true")
-	args = append(args, "--filters.radiusoutlier.classify=false")
-	args = append(args, "-v", "10", "--debug")
-	out, err := exec.Command("pdal", args...).CombinedOutput()
-
-	fmt.Println(string(out))
-	if err != nil {
-		return nil, err
-	}
-
-	return nil, nil
+	return NewPipeline(i, o, Filter("radiusoutlier", map[string]interface{}{
+		"min_neighbors": opts.Neighbors,
+		"radius":        opts.Radius,
+		// we can make this optional later
+		"extract":  true,
+		"classify": false,
+	})), nil
 }
@@ -0,0 +1,132 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OutputKind describes what a function produces.
+type OutputKind string
+
+const (
+	// OutputFile functions write a point cloud to the output file.
+	OutputFile OutputKind = "file"
+	// OutputJSON functions return JSON to be included in the response.
+	OutputJSON OutputKind = "json"
+	// OutputRaster functions write a raster to the output file.
+	OutputRaster OutputKind = "raster"
+)
+
+// RunFunc is the signature shared by all functions. It reads from the input
+// file i, writes to the output file o (if any), and returns any JSON output or,
+// for functions that produce a file, the Metadata of the run. PDAL is killed
+// if ctx is cancelled or its deadline passes.
+type RunFunc func(ctx context.Context, i, o string, options *json.RawMessage) ([]byte, error)
+
+// DefaultTimeout bounds the run time of functions that do not set a Timeout.
+var DefaultTimeout = 10 * time.Minute
+
+// Function describes a function that can be requested by name.
+type Function struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Output      OutputKind `json:"output"`
+
+	// NewOptions constructs the function's options with default values. It is
+	// nil for functions that take no options.
+	NewOptions func() interface{} `json:"-"`
+	Run        RunFunc            `json:"-"`
+
+	// Pipeline builds the PDAL pipeline that the function runs. It is nil for
+	// functions, such as info, that run a PDAL command instead. If Run is nil,
+	// the function simply runs the pipeline.
+	Pipeline PipelineFunc `json:"-"`
+
+	// Timeout is the default limit on the time taken to run the function,
+	// including transfers. If zero, DefaultTimeout is used.
+	Timeout time.Duration `json:"-"`
+
+	// Weight is the function's cost relative to others, in workers, when
+	// limiting the work that runs at once. If zero, the function counts as
+	// one.
+	Weight int `json:"-"`
+}
+
+// TimeLimit returns the function's Timeout, or DefaultTimeout if unset.
+func (f *Function) TimeLimit() time.Duration {
+	if f.Timeout > 0 {
+		return f.Timeout
+	}
+	return DefaultTimeout
+}
+
+// DefaultOptions returns the function's options with default values, or an
+// empty object if the function takes no options.
+func (f *Function) DefaultOptions() interface{} {
+	if f.NewOptions == nil {
+		return struct{}{}
+	}
+	return f.NewOptions()
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*Function)
+)
+
+// Register makes a function available by name. It panics if the name is empty,
+// the function has neither a Run method nor a Pipeline, or the name is already
+// registered.
+func Register(f Function) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if f.Name == "" || (f.Run == nil && f.Pipeline == nil) {
+		panic("functions: Register requires a name and a Run method or Pipeline")
+	}
+	if f.Run == nil {
+		f.Run = RunPipeline(f.Pipeline)
+	}
+	if _, dup := registry[f.Name]; dup {
+		panic("functions: Register called twice for " + f.Name)
+	}
+	registry[f.Name] = &f
+}
+
+// Lookup returns the function registered under name.
+func Lookup(name string) (*Function, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	f, ok := registry[name]
+	return f, ok
+}
+
+// Names returns the sorted names of all registered functions.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+// SchemaVersion identifies the JSON Schema draft our schemas conform to.
+const SchemaVersion = "http://json-schema.org/draft-04/schema#"
+
+/*
+Schema is a JSON Schema document describing a function's options.
+
+Only the subset of JSON Schema needed to describe our options is supported.
+Units is not a standard keyword, but is included so that clients can label
+their inputs.
+*/
+type Schema struct {
+	Schema               string              `json:"$schema,omitempty"`
+	Title                string              `json:"title,omitempty"`
+	Description          string              `json:"description,omitempty"`
+	Type                 string              `json:"type,omitempty"`
+	Properties           map[string]*Schema  `json:"properties,omitempty"`
+	Required             []string            `json:"required,omitempty"`
+	AdditionalProperties *bool               `json:"additionalProperties,omitempty"`
+	Dependencies         map[string][]string `json:"dependencies,omitempty"`
+	OneOf                []*Schema           `json:"oneOf,omitempty"`
+	Items                *Schema             `json:"items,omitempty"`
+	Default              interface{}         `json:"default,omitempty"`
+	Minimum              *float64            `json:"minimum,omitempty"`
+	ExclusiveMinimum     bool                `json:"exclusiveMinimum,omitempty"`
+	Maximum              *float64            `json:"maximum,omitempty"`
+	Pattern              string              `json:"pattern,omitempty"`
+	Units                string              `json:"units,omitempty"`
+}
+
+// Schemer is implemented by options types that can describe themselves.
+type Schemer interface {
+	JSONSchema() *Schema
+}
+
+// Units used throughout our schemas. Distances are measured in the units of
+// the input's spatial reference system, typically meters.
+const (
+	unitsDistance = "coordinate system units"
+	unitsPoints   = "points"
+)
+
+// Patterns for the bounds and polygon strings accepted by PDAL. These are
+// served to clients, so must use the ECMA 262 dialect (i.e., no flags).
+const (
+	number         = `-?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?`
+	boundsPattern  = `^\(\[` + number + `,` + number + `\],\[` + number + `,` + number + `\](,\[` + number + `,` + number + `\])?\)$`
+	polygonPattern = `^\s*([Mm][Uu][Ll][Tt][Ii])?[Pp][Oo][Ll][Yy][Gg][Oo][Nn]\s*([Zz]\s*)?\(.*\)\s*$`
+)
+
+// newObjectSchema constructs a schema for an options object, disallowing any
+// properties that are not described.
+func newObjectSchema(title, description string, properties map[string]*Schema) *Schema {
+	return &Schema{
+		Schema:               SchemaVersion,
+		Title:                title,
+		Description:          description,
+		Type:                 "object",
+		Properties:           properties,
+		AdditionalProperties: new(bool),
+	}
+}
+
+// atLeast returns an inclusive lower bound.
+func atLeast(v float64) *float64 {
+	return &v
+}
+
+// positive returns a schema for a number that must be strictly greater than
+// zero.
+func positive(description, units string, def float64) *Schema {
+	return &Schema{
+		Description:      description,
+		Type:             "number",
+		Default:          def,
+		Minimum:          atLeast(0),
+		ExclusiveMinimum: true,
+		Units:            units,
+	}
+}
+
+// nonNegative returns a schema for a number that must not be negative.
+func nonNegative(description, units string, def float64) *Schema {
+	return &Schema{
+		Description: description,
+		Type:        "number",
+		Default:     def,
+		Minimum:     atLeast(0),
+		Units:       units,
+	}
+}
+
+// count returns a schema for an integer that must be at least min.
+func count(description string, def int, min float64) *Schema {
+	return &Schema{
+		Description: description,
+		Type:        "integer",
+		Default:     def,
+		Minimum:     atLeast(min),
+		Units:       unitsPoints,
+	}
+}
+
+// flag returns a schema for a boolean.
+func flag(description string, def bool) *Schema {
+	return &Schema{Description: description, Type: "boolean", Default: def}
+}
+
+// OptionsSchema returns the schema for the function's options. Functions that
+// take no options are described by an empty object.
+func (f *Function) OptionsSchema() *Schema {
+	if s, ok := f.DefaultOptions().(Schemer); ok {
+		return s.JSONSchema()
+	}
+	return newObjectSchema(f.Name, f.Description, nil)
+}
@@ -16,12 +16,7 @@ limitations under the License.
 
 package functions
 
-import (
-	"encoding/json"
-	"fmt"
-	"os/exec"
-	"strconv"
-)
+import "encoding/json"
 
 // StatisticalOptions defines options for the Statical function.
 type StatisticalOptions struct {
@@ -36,8 +31,27 @@ func NewStatisticalOptions() *StatisticalOptions {
 	return &StatisticalOptions{Neighbors: 2, Thresh: 1.5}
 }
 
-// Statistical implements pdal height.
-func Statistical(i, o string, options *json.RawMessage) ([]byte, error) {
+// JSONSchema describes StatisticalOptions.
+func (o *StatisticalOptions) JSONSchema() *Schema {
+	return newObjectSchema("statistical", "Options for the Statistical function", map[string]*Schema{
+		"neighbors": count("mean number of neighbors to compute mean and standard deviation", o.Neighbors, 1),
+		"thresh":    positive("standard deviation multiplier for thresholding outliers", "", o.Thresh),
+	})
+}
+
+func init() {
+	Register(Function{
+		Name:        "statistical",
+		Description: "Remove outliers using statistical neighbor distances",
+		Output:      OutputFile,
+		NewOptions:  func() interface{} { return NewStatisticalOptions() },
+		Pipeline:    Statistical,
+	})
+}
+
+// Statistical builds a pipeline with a statisticaloutlier filter, extracting
+// the inliers.
+func Statistical(i, o string, options *json.RawMessage) (*Pipeline, error) {
 	opts := NewStatisticalOptions()
 	if options != nil {
 		if err := json.Unmarshal(*options, &opts); err != nil {
@@ -45,22 +59,11 @@ func Statistical(i, o string, options *json.RawMessage) ([]byte, error) {
 		}
 	}
 
-	var args []string
-	args = append(args, "translate", i, o, "statisticaloutlier")
-	args = append(args, "--filters.statisticaloutlier.k-neighbors="+
-		strconv.Itoa(opts.Neighbors))
-	args = append(args, "--filters.statisticaloutlier.thresh="+
-		strconv.FormatFloat(opts.Thresh, 'f', -1, 64))
-	// we can make this optional later
-	args = append(args, "--filters.statisticaloutlier.extract=true")
-	args = append(args, "--filters.statisticaloutlier.classify=false")
-	args = append(args, "-v", "10", "--debug")
-	out, err := exec.Command("pdal", args...).CombinedOutput()
-
-	fmt.Println(string(out))
-	if err != nil {
-		return nil, err
-	}
-
-	return nil, nil
+	return NewPipeline(i, o, Filter("statisticaloutlier", map[string]interface{}{
+		"k-neighbors": opts.Neighbors,
+		"thresh":      opts.Thresh,
+		// we can make this optional later
+		"extract":  true,
+		"classify": false,
+	})), nil
 }
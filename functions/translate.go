@@ -18,55 +18,368 @@ package functions
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 /*
 TranslateOptions defines options for the Translate function.
 
-Assume the following command:
+The filters to run are given as a list, in order, each with its options:
+
+	{
+	  "filters": [
+	    {"type": "range", "options": {"limits": "Z[0:100]"}},
+	    {"type": "crop", "options": {"polygon": "POLYGON((0 0, 1 0, 1 1, 0 0))"}}
+	  ]
+	}
+
+Only the filters and options listed in TranslateFilters are allowed. The
+input is always read, and the output written, by the service, with the reader
+and writer inferred from their extensions.
+
+If TranslateArgs is set, the legacy "args" option may be given instead. Assume
+the following command:
 
 	$ pdal translate <input> <output> [args]
 
-The Translate function takes a single option "args" - a string that completes the command-line invocation of the PDAL CLI.
+The "args" option is a string that completes the command-line invocation of the PDAL CLI. The arguments are run as the equivalent pipeline: filters are named as they would be on the command line, with their options given as --filters.<name>.<option>=<value>, quoting values that contain spaces. Its filters and options are checked against TranslateFilters too, and any reader or writer named with -r and -w, or given options, against TranslateDrivers.
 
 See http://www.pdal.io/apps.html#translate-command for more on the PDAL translate command.
 */
 type TranslateOptions struct {
-	Args string `json:"args"`
+	Args    string            `json:"args"`
+	Filters []TranslateFilter `json:"filters,omitempty"`
+}
+
+// TranslateFilter is a filter run by the Translate function.
+type TranslateFilter struct {
+	// Type names the filter, e.g., "range" or "filters.range".
+	Type    string                 `json:"type"`
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+/*
+TranslateFilters lists the filters that the Translate function may run, by
+name, with the options that each may be given. Filters that read or write
+files, or run code, are deliberately absent. It may be replaced, e.g., from
+configuration, before any requests are served.
+*/
+var TranslateFilters = map[string][]string{
+	"crop":               {"bounds", "polygon", "outside"},
+	"dartsample":         {"radius"},
+	"decimation":         {"step", "offset", "limit"},
+	"ferry":              {"dimensions"},
+	"ground":             {"cell_size", "initial_distance", "max_distance", "max_window_size", "slope", "extract", "classify"},
+	"height":             nil,
+	"radiusoutlier":      {"min_neighbors", "radius", "extract", "classify"},
+	"range":              {"limits"},
+	"reprojection":       {"in_srs", "out_srs"},
+	"statisticaloutlier": {"k-neighbors", "thresh", "extract", "classify"},
+}
+
+/*
+TranslateDrivers lists the readers and writers that the legacy "args" option
+of the Translate function may name, with the options that each may be given.
+They are among those that pipelines may use, less any that write elsewhere
+than a file. The filename is always set by the service. It may be replaced,
+e.g., from configuration, before any requests are served.
+*/
+var TranslateDrivers = map[string][]string{
+	"readers.bpf":  nil,
+	"readers.las":  {"spatialreference"},
+	"readers.ply":  nil,
+	"readers.text": {"header", "separator", "skip"},
+	"writers.bpf":  {"compression", "format"},
+	"writers.gdal": {"resolution", "radius", "output_type", "data_type", "window_size", "dimension"},
+	"writers.las":  {"compression", "minor_version", "dataformat_id", "scale_x", "scale_y", "scale_z", "offset_x", "offset_y", "offset_z"},
+	"writers.ply":  {"storage_mode"},
+	"writers.text": {"format", "order", "keep_unspecified", "delimiter", "write_header"},
 }
 
+// TranslateArgs allows the legacy "args" option of the Translate function.
+var TranslateArgs = false
+
 // NewTranslateOptions constructs TranslateOptions with default values.
 func NewTranslateOptions() *TranslateOptions {
 	return &TranslateOptions{Args: ""}
 }
 
-// Translate implements pdal translate.
-func Translate(i, o string, options *json.RawMessage) ([]byte, error) {
+// JSONSchema describes TranslateOptions.
+func (o *TranslateOptions) JSONSchema() *Schema {
+	return newObjectSchema("translate", "Options for the Translate function", map[string]*Schema{
+		"filters": {
+			Description: "filters to run, in order, each with its options",
+			Type:        "array",
+			Items: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"type":    {Description: "the filter, e.g., \"range\"", Type: "string"},
+					"options": {Description: "the filter's options", Type: "object"},
+				},
+				Required:             []string{"type"},
+				AdditionalProperties: new(bool),
+			},
+		},
+		"args": {
+			Description: "arguments completing the command \"pdal translate <input> <output>\", if enabled",
+			Type:        "string",
+			Default:     o.Args,
+		},
+	})
+}
+
+func init() {
+	Register(Function{
+		Name:        "translate",
+		Description: "Run PDAL filters, or PDAL translate with user-supplied arguments",
+		Output:      OutputFile,
+		NewOptions:  func() interface{} { return NewTranslateOptions() },
+		Pipeline:    Translate,
+	})
+}
+
+// Validate checks that the filters and their options are allowed, and that
+// the args, if enabled, can be expressed as a pipeline.
+func (o *TranslateOptions) Validate() ValidationError {
+	if o.Args != "" {
+		switch {
+		case !TranslateArgs:
+			return ValidationError{{"args", "is disabled; give filters instead"}}
+		case o.Filters != nil:
+			return ValidationError{{"args", "must not be given with filters"}}
+		}
+		p, err := translatePipeline("input", "output", o.Args)
+		if err != nil {
+			return ValidationError{{"args", err.Error()}}
+		}
+		var errs ValidationError
+		last := len(p.Stages) - 1
+		for k, s := range p.Stages {
+			check := checkFilter
+			if k == 0 || k == last {
+				check = checkDriver
+			}
+			for _, fe := range check(s) {
+				errs = append(errs, FieldError{"args", fe.Message})
+			}
+		}
+		return errs
+	}
+
+	var errs ValidationError
+	for i, f := range o.Filters {
+		field := "filters[" + strconv.Itoa(i) + "]"
+		if f.Type == "" {
+			errs = append(errs, FieldError{field + ".type", "is required"})
+			continue
+		}
+		for _, fe := range checkFilter(f.stage()) {
+			errs = append(errs, FieldError{field + "." + fe.Field, fe.Message})
+		}
+	}
+	return errs
+}
+
+// stage returns the pipeline stage running the filter.
+func (f TranslateFilter) stage() Stage {
+	name := strings.TrimPrefix(f.Type, "filters.")
+	return Filter(name, f.Options)
+}
+
+// checkFilter reports any filter or option of s that TranslateFilters does
+// not allow, as problems with its "type" or "options.<name>".
+func checkFilter(s Stage) ValidationError {
+	name := strings.TrimPrefix(s.Type, "filters.")
+	allowed, ok := TranslateFilters[name]
+	if !ok {
+		return ValidationError{{"type", "filter " + name + " is not allowed"}}
+	}
+	return checkOptions(s, "filter "+name, allowed)
+}
+
+// checkDriver reports any reader or writer, or option of one, of s that
+// TranslateDrivers does not allow. A stage without a type, whose driver PDAL
+// infers from the filename, has no options.
+func checkDriver(s Stage) ValidationError {
+	if s.Type == "" {
+		return nil
+	}
+	allowed, ok := TranslateDrivers[s.Type]
+	if !ok {
+		return ValidationError{{"type", "driver " + s.Type + " is not allowed"}}
+	}
+	return checkOptions(s, "driver "+s.Type, allowed)
+}
+
+// checkOptions reports any option of s, described as stage, that is not
+// among those allowed, as problems with its "options.<name>".
+func checkOptions(s Stage, stage string, allowed []string) ValidationError {
+	var errs ValidationError
+	names := make([]string, 0, len(s.Options))
+	for k := range s.Options {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if !contains(allowed, k) {
+			errs = append(errs, FieldError{"options." + k, "option " + k + " of " + stage + " is not allowed"})
+		}
+	}
+	return errs
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Translate builds the pipeline running the filters or, if given, the
+// equivalent of the translate command.
+func Translate(i, o string, options *json.RawMessage) (*Pipeline, error) {
 	opts := NewTranslateOptions()
 	if options != nil {
 		if err := json.Unmarshal(*options, &opts); err != nil {
 			return nil, err
 		}
 	}
+	if opts.Args != "" {
+		return translatePipeline(i, o, opts.Args)
+	}
+	filters := make([]Stage, len(opts.Filters))
+	for k, f := range opts.Filters {
+		filters[k] = f.stage()
+	}
+	return NewPipeline(i, o, filters...), nil
+}
 
-	optArgs := strings.Split(opts.Args, " ")
-
-	var args []string
-	args = append(args, "translate")
-	args = append(args, i)
-	args = append(args, o)
-	args = append(args, optArgs...)
-	args = append(args, "-v", "10", "--debug")
+/*
+translatePipeline builds the pipeline that the command
 
-	out, err := exec.Command("pdal", args...).CombinedOutput()
+	$ pdal translate <i> <o> [args]
 
-	fmt.Println(string(out))
+would run. Each filter named in args becomes a stage, in order, and options of
+the form --<stage>.<option>=<value> are set on the matching reader, writer
+(given by -r and -w, or inferred from the filenames) or filter. Verbosity
+flags are ignored, and the filenames are always i and o.
+*/
+func translatePipeline(i, o, args string) (*Pipeline, error) {
+	words, err := splitArgs(args)
 	if err != nil {
 		return nil, err
 	}
 
-	return nil, nil
+	type option struct{ stage, name, value string }
+	var filters []Stage
+	var options []option
+	reader, writer := Reader(i), Writer(o)
+	for n := 0; n < len(words); n++ {
+		w := words[n]
+		switch {
+		case w == "-r" || w == "--reader" || w == "-w" || w == "--writer" || w == "-v" || w == "--verbose":
+			if n+1 == len(words) {
+				return nil, fmt.Errorf("%s requires a value", w)
+			}
+			n++
+			switch w {
+			case "-r", "--reader":
+				reader.Type = words[n]
+			case "-w", "--writer":
+				writer.Type = words[n]
+			}
+		case w == "--debug":
+		case strings.HasPrefix(w, "--"):
+			name, value, ok := strings.Cut(w[2:], "=")
+			dot := strings.LastIndex(name, ".")
+			if !ok || dot < 0 {
+				return nil, fmt.Errorf("%s is not of the form --<stage>.<option>=<value>", w)
+			}
+			options = append(options, option{name[:dot], name[dot+1:], value})
+		case strings.HasPrefix(w, "-"):
+			return nil, fmt.Errorf("unsupported argument %s", w)
+		default:
+			if !strings.HasPrefix(w, "filters.") {
+				w = "filters." + w
+			}
+			filters = append(filters, Stage{Type: w})
+		}
+	}
+
+	for _, opt := range options {
+		var s *Stage
+		switch {
+		case strings.HasPrefix(opt.stage, "readers."):
+			s = &reader
+		case strings.HasPrefix(opt.stage, "writers."):
+			s = &writer
+		default:
+			for k := range filters {
+				if filters[k].Type == opt.stage {
+					s = &filters[k]
+				}
+			}
+			if s == nil {
+				return nil, fmt.Errorf("option %s.%s is for a filter that is not run", opt.stage, opt.name)
+			}
+		}
+
+		// Options for a reader or writer name its driver, unless it was given.
+		if s.Type == "" {
+			s.Type = opt.stage
+		}
+		if s.Type != opt.stage {
+			return nil, fmt.Errorf("option %s.%s does not apply to %s", opt.stage, opt.name, s.Type)
+		}
+		if s.Options == nil {
+			s.Options = make(map[string]interface{})
+		}
+		s.Options[opt.name] = opt.value
+	}
+
+	stages := append([]Stage{reader}, filters...)
+	return &Pipeline{Stages: append(stages, writer)}, nil
+}
+
+// splitArgs splits s into arguments at spaces, as a shell would, except that
+// single- or double-quoted text is kept together, without its quotes.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
 }
@@ -0,0 +1,247 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a problem with a single option.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found with a set of options. It is
+// encoded as a JSON array of FieldErrors.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return "Invalid options: " + strings.Join(msgs, "; ")
+}
+
+// Validator is implemented by options types with constraints that cannot be
+// expressed by their schema, e.g., well-formed WKT.
+type Validator interface {
+	Validate() ValidationError
+}
+
+/*
+ParseOptions decodes and validates the raw options for the function, returning
+the populated options struct.
+
+Every problem found is reported, not just the first. The options are first
+checked against the function's schema (unknown keys, types, ranges, required
+and mutually exclusive keys), and then by the options' Validate method, if any.
+Any error returned is a ValidationError.
+*/
+func (f *Function) ParseOptions(options *json.RawMessage) (interface{}, error) {
+	opts := f.DefaultOptions()
+
+	var raw map[string]json.RawMessage
+	if options != nil && string(*options) != "null" {
+		if err := json.Unmarshal(*options, &raw); err != nil {
+			return nil, ValidationError{{"options", "must be a JSON object"}}
+		}
+	}
+
+	errs := f.OptionsSchema().Validate(raw)
+
+	if f.NewOptions != nil && options != nil {
+		if err := json.Unmarshal(*options, opts); err != nil {
+			// The schema has already caught the offending field.
+			if len(errs) > 0 {
+				return nil, errs
+			}
+			return nil, ValidationError{{"options", err.Error()}}
+		}
+	}
+
+	if v, ok := opts.(Validator); ok {
+		for _, fe := range v.Validate() {
+			if !errs.has(fe.Field) {
+				errs = append(errs, fe)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return opts, nil
+}
+
+// has reports whether a problem has already been found with field.
+func (e ValidationError) has(field string) bool {
+	for _, fe := range e {
+		if fe.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Validate checks an object's raw properties against the schema.
+
+Only the keywords that we use are checked: additionalProperties, required,
+dependencies, and oneOf on the object (where each alternative lists required
+properties), and type, minimum, maximum, and pattern on each property. The
+items of arrays, and the properties of nested objects, are left to the options'
+Validate method.
+*/
+func (s *Schema) Validate(raw map[string]json.RawMessage) ValidationError {
+	var errs ValidationError
+
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		prop, ok := s.Properties[k]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, FieldError{k, "unknown option"})
+			}
+			continue
+		}
+		if msg := prop.check(raw[k]); msg != "" {
+			errs = append(errs, FieldError{k, msg})
+		}
+	}
+
+	for _, k := range s.Required {
+		if _, ok := raw[k]; !ok {
+			errs = append(errs, FieldError{k, "is required"})
+		}
+	}
+
+	var dependents []string
+	for k := range s.Dependencies {
+		dependents = append(dependents, k)
+	}
+	sort.Strings(dependents)
+	for _, k := range dependents {
+		if _, ok := raw[k]; !ok {
+			continue
+		}
+		for _, d := range s.Dependencies[k] {
+			if _, ok := raw[d]; !ok {
+				errs = append(errs, FieldError{d, "is required when " + k + " is given"})
+			}
+		}
+	}
+
+	if len(s.OneOf) > 0 {
+		var alternatives []string
+		matches := 0
+		for _, alt := range s.OneOf {
+			alternatives = append(alternatives, strings.Join(alt.Required, " and "))
+			present := true
+			for _, k := range alt.Required {
+				if _, ok := raw[k]; !ok {
+					present = false
+				}
+			}
+			if present {
+				matches++
+			}
+		}
+		if matches != 1 {
+			field := strings.Join(alternatives, "|")
+			errs = append(errs, FieldError{field, "must provide exactly one of " +
+				strings.Join(alternatives, " or ")})
+		}
+	}
+
+	return errs
+}
+
+// check validates a single property value against the schema, returning a
+// description of the problem, if any.
+func (s *Schema) check(v json.RawMessage) string {
+	switch s.Type {
+	case "boolean":
+		var b bool
+		if err := json.Unmarshal(v, &b); err != nil {
+			return "must be a boolean"
+		}
+
+	case "string":
+		var str string
+		if err := json.Unmarshal(v, &str); err != nil {
+			return "must be a string"
+		}
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return "cannot be checked against pattern: " + err.Error()
+			}
+			if !re.MatchString(str) {
+				return "is malformed"
+			}
+		}
+
+	case "array":
+		var a []json.RawMessage
+		if err := json.Unmarshal(v, &a); err != nil {
+			return "must be an array"
+		}
+
+	case "object":
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(v, &m); err != nil || m == nil {
+			return "must be an object"
+		}
+
+	case "number", "integer":
+		var f float64
+		if err := json.Unmarshal(v, &f); err != nil {
+			return "must be a number"
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			return "must be an integer"
+		}
+		if s.Minimum != nil {
+			if s.ExclusiveMinimum && f <= *s.Minimum {
+				return "must be greater than " + formatFloat(*s.Minimum)
+			}
+			if f < *s.Minimum {
+				return "must be at least " + formatFloat(*s.Minimum)
+			}
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return "must be at most " + formatFloat(*s.Maximum)
+		}
+	}
+	return ""
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -18,22 +18,38 @@ package functions
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 )
 
-// VO implements pdal vo.
-func VO(i, o string, options *json.RawMessage) ([]byte, error) {
-	out, err := exec.Command("pdal", "translate", i, o, "-w", "writers.vo", "-v",
-		"10", "--debug").CombinedOutput()
+func init() {
+	Register(Function{
+		Name:        "vo",
+		Description: "Extract vector objects (e.g., buildings) as GeoJSON",
+		Output:      OutputJSON,
+		Run:         VO,
+		Pipeline:    VOPipeline,
+	})
+}
+
+// VOPipeline builds a pipeline writing the vector objects with writers.vo.
+func VOPipeline(i, o string, options *json.RawMessage) (*Pipeline, error) {
+	p := NewPipeline(i, o)
+	p.Writer().Type = "writers.vo"
+	return p, nil
+}
 
-	fmt.Println(string(out))
+// VO runs the VOPipeline, returning the GeoJSON it writes.
+func VO(ctx context.Context, i, o string, options *json.RawMessage) ([]byte, error) {
+	p, err := VOPipeline(i, o, options)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := p.Run(ctx, pipelineFile(o)); err != nil {
+		return nil, err
+	}
 
 	fileOut, err := os.Open(o)
 	if err != nil {
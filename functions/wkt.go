@@ -0,0 +1,187 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package functions
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+parseBounds parses a PDAL bounds string of the form
+
+	([xmin,xmax],[ymin,ymax])
+
+or
+
+	([xmin,xmax],[ymin,ymax],[zmin,zmax])
+
+returning the [min,max] pair for each dimension.
+*/
+func parseBounds(s string) ([][2]float64, error) {
+	s = strings.Replace(s, " ", "", -1)
+	if !strings.HasPrefix(s, "([") || !strings.HasSuffix(s, "])") {
+		return nil, errors.New(`must be of the form "([xmin,xmax],[ymin,ymax])"`)
+	}
+
+	dims := strings.Split(s[2:len(s)-2], "],[")
+	if len(dims) < 2 || len(dims) > 3 {
+		return nil, errors.New("must give ranges for either two or three dimensions")
+	}
+
+	ranges := make([][2]float64, len(dims))
+	for i, r := range dims {
+		dim := string("xyz"[i])
+		parts := strings.Split(r, ",")
+		if len(parts) != 2 {
+			return nil, errors.New("each range must be of the form [" + dim + "min," + dim + "max]")
+		}
+		for j, p := range parts {
+			v, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", p)
+			}
+			ranges[i][j] = v
+		}
+		if ranges[i][0] > ranges[i][1] {
+			return nil, errors.New(dim + "min must not exceed " + dim + "max")
+		}
+	}
+	return ranges, nil
+}
+
+/*
+parsePolygon checks that s is a well-formed POLYGON or MULTIPOLYGON in
+well-known text, e.g.,
+
+	POLYGON((30 10, 40 40, 20 40, 10 20, 30 10))
+
+Each ring must have at least four positions and be closed.
+*/
+func parsePolygon(s string) error {
+	s = strings.TrimSpace(s)
+	upper := strings.ToUpper(s)
+
+	var depth int
+	switch {
+	case strings.HasPrefix(upper, "MULTIPOLYGON"):
+		s, depth = s[len("MULTIPOLYGON"):], 3
+	case strings.HasPrefix(upper, "POLYGON"):
+		s, depth = s[len("POLYGON"):], 2
+	default:
+		return errors.New("must be a POLYGON or MULTIPOLYGON")
+	}
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(strings.ToUpper(s), "Z") {
+		s = strings.TrimSpace(s[1:])
+	}
+
+	p := &wktParser{s: s}
+	if err := p.list(depth); err != nil {
+		return err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return fmt.Errorf("unexpected %q after polygon", p.s[p.pos:])
+	}
+	return nil
+}
+
+// wktParser is a minimal recursive descent parser for nested WKT coordinate
+// lists.
+type wktParser struct {
+	s   string
+	pos int
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *wktParser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.s) || p.s[p.pos] != c {
+		return fmt.Errorf("expected %q at position %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+// list parses a parenthesized, comma-separated list. At depth one, the
+// elements are positions, forming a ring.
+func (p *wktParser) list(depth int) error {
+	if err := p.expect('('); err != nil {
+		return err
+	}
+	var ring []string
+	for {
+		if depth == 1 {
+			pos, err := p.position()
+			if err != nil {
+				return err
+			}
+			ring = append(ring, pos)
+		} else if err := p.list(depth - 1); err != nil {
+			return err
+		}
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	if err := p.expect(')'); err != nil {
+		return err
+	}
+	if depth == 1 {
+		if len(ring) < 4 {
+			return errors.New("each ring must have at least four positions")
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return errors.New("each ring must be closed")
+		}
+	}
+	return nil
+}
+
+// position parses two or three space-separated numbers, returning them in a
+// normalized form suitable for comparison.
+func (p *wktParser) position() (string, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ',' && p.s[p.pos] != ')' {
+		p.pos++
+	}
+	fields := strings.Fields(p.s[start:p.pos])
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", fmt.Errorf("position %q must have two or three coordinates",
+			strings.TrimSpace(p.s[start:p.pos]))
+	}
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a number", f)
+		}
+		fields[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(fields, " "), nil
+}
@@ -0,0 +1,415 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/venicegeo/pzsvc-pdal/storage"
+)
+
+// MaxBatchSize is the largest number of sources a batch may have.
+var MaxBatchSize = 1000
+
+// BatchRetryDelay is how long a batch waits to submit its next job when the
+// worker pool's queue is full.
+var BatchRetryDelay = time.Second
+
+/*
+BatchMsg defines the expected input JSON structure for a batch, which runs the
+same function over many sources.
+
+The sources are either listed, or are every object beneath a prefix, i.e., a
+URL such as "s3://bucket/pointcloud/" or, if the bucket is given, a key prefix
+within it, optionally limited to those whose names match a glob, e.g.,
+"*.laz".
+
+The destination is a template, expanded for each source. {basename} is the
+name of the source without its extension, {filename} the name with it, {ext}
+the extension (e.g., ".laz"), and {index} the position of the source in the
+batch. If the template is a key rather than a URL, it names an object in the
+bucket.
+*/
+type BatchMsg struct {
+	Sources     []storage.Ref    `json:"sources,omitempty"`
+	Bucket      string           `json:"bucket,omitempty"`
+	Prefix      string           `json:"prefix,omitempty"`
+	Glob        string           `json:"glob,omitempty"`
+	Function    *string          `json:"function,omitempty"`
+	Options     *json.RawMessage `json:"options,omitempty"`
+	Steps       []Step           `json:"steps,omitempty"`
+	Destination string           `json:"destination,omitempty"`
+	Timeout     *float64         `json:"timeout,omitempty"`
+	NoCache     bool             `json:"no_cache,omitempty"`
+}
+
+// BatchItem is the job run for one source of a batch.
+type BatchItem struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination,omitempty"`
+	Job         Job    `json:"job"`
+}
+
+// BatchProgress counts the jobs of a batch by status.
+type BatchProgress struct {
+	Total     int `json:"total"`
+	Queued    int `json:"queued"`
+	Running   int `json:"running"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// Batch tracks the progress of a batch. It is running until every job has
+// finished, and then has succeeded if they all did, and otherwise failed.
+type Batch struct {
+	ID         string        `json:"id"`
+	Status     JobStatus     `json:"status"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	Progress   BatchProgress `json:"progress"`
+	Items      []BatchItem   `json:"items"`
+}
+
+// BatchStore is an in-memory, concurrency-safe collection of batches. The
+// jobs of each batch live in Jobs until they finish, after which the batch
+// keeps its own copy.
+type BatchStore struct {
+	mu      sync.Mutex
+	batches map[string]*Batch
+}
+
+// NewBatchStore constructs an empty BatchStore.
+func NewBatchStore() *BatchStore {
+	return &BatchStore{batches: make(map[string]*Batch)}
+}
+
+// Batches is the store backing the /api/v1/batch endpoint.
+var Batches = NewBatchStore()
+
+// Create adds a new batch of the given items, whose jobs have already been
+// created, to the store and returns a copy of it.
+func (s *BatchStore) Create(items []BatchItem) (Batch, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Batch{}, err
+	}
+	b := &Batch{ID: id, Status: StatusQueued, StartedAt: time.Now(), Items: items}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(b.StartedAt)
+	s.batches[id] = b
+	return s.snapshot(b), nil
+}
+
+// Get returns a copy of the batch with the given ID, with its progress
+// brought up to date.
+func (s *BatchStore) Get(id string) (Batch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[id]
+	if !ok {
+		return Batch{}, false
+	}
+	return s.snapshot(b), true
+}
+
+// finish records the final state of the i'th job of the batch.
+func (s *BatchStore) finish(id string, i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[id]
+	if !ok {
+		return
+	}
+	if j, ok := Jobs.Get(b.Items[i].Job.ID); ok {
+		b.Items[i].Job = j
+	}
+
+	for _, item := range b.Items {
+		if !item.Job.Finished() {
+			return
+		}
+	}
+	now := time.Now()
+	b.FinishedAt = &now
+}
+
+// snapshot copies b, bringing the jobs that have not yet finished up to date
+// and counting them. The caller must hold s.mu.
+func (s *BatchStore) snapshot(b *Batch) Batch {
+	out := *b
+	out.Items = make([]BatchItem, len(b.Items))
+	out.Progress = BatchProgress{Total: len(b.Items)}
+	for i, item := range b.Items {
+		if !item.Job.Finished() {
+			if j, ok := Jobs.Get(item.Job.ID); ok {
+				item.Job = j
+			}
+		}
+		switch item.Job.Status {
+		case StatusQueued:
+			out.Progress.Queued++
+		case StatusRunning:
+			out.Progress.Running++
+		case StatusSucceeded:
+			out.Progress.Succeeded++
+		case StatusFailed:
+			out.Progress.Failed++
+		}
+		out.Items[i] = item
+	}
+
+	switch p := out.Progress; {
+	case p.Queued == p.Total:
+		out.Status = StatusQueued
+	case p.Succeeded == p.Total:
+		out.Status = StatusSucceeded
+	case p.Succeeded+p.Failed == p.Total:
+		out.Status = StatusFailed
+	default:
+		out.Status = StatusRunning
+	}
+	return out
+}
+
+// prune drops finished batches older than JobRetention. The caller must hold
+// s.mu.
+func (s *BatchStore) prune(now time.Time) {
+	for id, b := range s.batches {
+		if b.FinishedAt != nil && now.Sub(*b.FinishedAt) > JobRetention {
+			delete(s.batches, id)
+		}
+	}
+}
+
+// batchSources returns the sources of the batch, listing the prefix if need
+// be.
+func batchSources(ctx context.Context, msg BatchMsg) ([]storage.Ref, error) {
+	if len(msg.Sources) > 0 {
+		if msg.Prefix != "" || msg.Bucket != "" {
+			return nil, errors.New("Must provide either sources or a prefix, not both")
+		}
+		return msg.Sources, nil
+	}
+
+	prefix := msg.Prefix
+	if msg.Bucket != "" {
+		prefix = storage.S3Ref(msg.Bucket, msg.Prefix).URL
+	}
+	if prefix == "" {
+		return nil, errors.New("Must provide sources or a prefix")
+	}
+	if msg.Glob != "" {
+		if _, err := path.Match(msg.Glob, ""); err != nil {
+			return nil, errors.New("Invalid glob " + msg.Glob)
+		}
+	}
+	infos, err := storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var refs []storage.Ref
+	for _, info := range infos {
+		if msg.Glob != "" {
+			if ok, _ := path.Match(msg.Glob, storage.Base(info.URL)); !ok {
+				continue
+			}
+		}
+		refs = append(refs, storage.URLRef(info.URL))
+	}
+	return refs, nil
+}
+
+// expandDestination expands the destination template for the i'th source.
+func expandDestination(msg BatchMsg, i int, source storage.Ref) (storage.Ref, error) {
+	base := source.Base()
+	ext := path.Ext(base)
+	dest := strings.NewReplacer(
+		"{basename}", strings.TrimSuffix(base, ext),
+		"{filename}", base,
+		"{ext}", ext,
+		"{index}", strconv.Itoa(i),
+	).Replace(msg.Destination)
+
+	if !strings.Contains(dest, "://") {
+		if msg.Bucket == "" {
+			return storage.Ref{}, errors.New("Destination " + dest + " must be a URL, or a bucket must be provided")
+		}
+		return storage.S3Ref(msg.Bucket, dest), nil
+	}
+	return storage.URLRef(dest), nil
+}
+
+/*
+BatchHandler runs the same function over many sources, as given by a BatchMsg.
+
+One job is created per source, and the jobs are fed through the worker pool in
+the background, taking at most one place in its queue at a time, so that other
+work is not turned away. The handler responds immediately with 202 Accepted and
+the batch, whose progress can be polled at /api/v1/batch/:id (also given in the
+Location header). Each job may also be polled at /api/v1/jobs/:id.
+*/
+func BatchHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	if r.Body == nil {
+		return &AppError{nil, "No JSON", http.StatusBadRequest}
+	}
+	limitBody(w, r)
+
+	// Throw 500 if we cannot read the body, or 413 if it is too large.
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	var msg BatchMsg
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+
+	c, err := InputMsg{Function: msg.Function, Options: msg.Options, Steps: msg.Steps}.chain()
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+
+	sources, err := batchSources(r.Context(), msg)
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+	if len(sources) == 0 {
+		return &AppError{nil, "No sources found", http.StatusBadRequest}
+	}
+	if len(sources) > MaxBatchSize {
+		msg := "Batch of " + strconv.Itoa(len(sources)) + " sources exceeds the limit of " + strconv.Itoa(MaxBatchSize)
+		return &AppError{nil, msg, http.StatusBadRequest}
+	}
+
+	// Each source becomes an InputMsg, validated as PdalHandler would.
+	msgs := make([]InputMsg, len(sources))
+	seen := make(map[string]bool)
+	for i, source := range sources {
+		if err := source.Check(); err != nil {
+			return &AppError{err, err.Error(), http.StatusBadRequest}
+		}
+		in := InputMsg{
+			Source:   source,
+			Function: msg.Function,
+			Options:  msg.Options,
+			Steps:    msg.Steps,
+			Timeout:  msg.Timeout,
+			NoCache:  msg.NoCache,
+		}
+		if msg.Destination != "" {
+			if in.Destination, err = expandDestination(msg, i, source); err != nil {
+				return &AppError{err, err.Error(), http.StatusBadRequest}
+			}
+			if err := in.Destination.Check(); err != nil {
+				return &AppError{err, err.Error(), http.StatusBadRequest}
+			}
+			if seen[in.Destination.URL] {
+				err := errors.New("Destination " + in.Destination.URL + " is used by more than one source")
+				return &AppError{err, err.Error(), http.StatusBadRequest}
+			}
+			seen[in.Destination.URL] = true
+		}
+		msgs[i] = in
+	}
+	limit, err := timeLimit(c, msgs[0])
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+
+	items := make([]BatchItem, len(msgs))
+	for i, in := range msgs {
+		j, err := Jobs.Create()
+		if err != nil {
+			return &AppError{err, err.Error(), http.StatusInternalServerError}
+		}
+		items[i] = BatchItem{Source: in.Source.URL, Destination: in.Destination.URL, Job: j}
+	}
+	batch, err := Batches.Create(items)
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	go runBatch(batch, msgs, c.weight(), limit)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Location", "/api/v1/batch/"+batch.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(batch); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// runBatch feeds the jobs of the batch through the worker pool, one at a
+// time, waiting for each to start before queueing the next.
+func runBatch(batch Batch, msgs []InputMsg, weight int, limit time.Duration) {
+	for i, msg := range msgs {
+		id := batch.Items[i].Job.ID
+		t, err := Workers.Reserve(weight)
+		for err == ErrPoolFull {
+			time.Sleep(BatchRetryDelay)
+			t, err = Workers.Reserve(weight)
+		}
+		t.Wait(context.Background())
+
+		ws, err := NewWorkspace()
+		if err != nil {
+			t.Release()
+			log.Println("Job", id, "failed:", err)
+			Jobs.Update(id, func(j *Job) {
+				j.Status = StatusFailed
+				j.FinishedAt = time.Now()
+				j.Code = http.StatusInternalServerError
+				j.Message = err.Error()
+			})
+			Batches.finish(batch.ID, i)
+			continue
+		}
+		go func(i int, msg InputMsg) {
+			runJob(id, ws, msg, limit, t)
+			Batches.finish(batch.ID, i)
+		}(i, msg)
+	}
+}
+
+// BatchStatusHandler reports the progress of a batch, with the result of each
+// of its jobs.
+func BatchStatusHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *AppError {
+	b, ok := Batches.Get(ps.ByName("id"))
+	if !ok {
+		return &AppError{nil, "Unknown batch " + ps.ByName("id"), http.StatusNotFound}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(b); err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	return nil
+}
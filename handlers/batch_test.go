@@ -0,0 +1,152 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+)
+
+// waitForBatch polls the batch with the given ID until it finishes.
+func waitForBatch(t *testing.T, id string) Batch {
+	var b Batch
+	for i := 0; i < 200; i++ {
+		b, _ = Batches.Get(id)
+		if b.FinishedAt != nil {
+			return b
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Batch did not finish: %+v", b)
+	return b
+}
+
+func TestBatchPrefix(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{
+		"samp71-utm_ground.laz": []byte("ground"),
+		"a_ground.laz":          []byte("ground"),
+	}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+	store.Put("s3://venicegeo-sample-data/pointcloud/a.laz", []byte("fake laz"))
+	store.Put("s3://venicegeo-sample-data/pointcloud/b.las", []byte("fake las"))
+
+	// With no room in the queue, the batch must wait for each job to start.
+	origWorkers, origDelay := Workers, BatchRetryDelay
+	Workers, BatchRetryDelay = NewPool(1, 0), time.Millisecond
+	defer func() { Workers, BatchRetryDelay = origWorkers, origDelay }()
+
+	userJSON := `{
+		"bucket": "venicegeo-sample-data",
+		"prefix": "pointcloud/",
+		"glob": "*.laz",
+		"function": "ground",
+		"destination": "temp/{basename}_ground{ext}"
+	}`
+	w := post(BatchHandler, "/api/v1/batch", userJSON)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("StatusAccepted expected: %d %s", w.Code, w.Body)
+	}
+	var accepted Batch
+	json.Unmarshal(w.Body.Bytes(), &accepted)
+	if w.Header().Get("Location") != "/api/v1/batch/"+accepted.ID || accepted.Progress.Total != 2 {
+		t.Errorf("Unexpected batch %s", w.Body)
+	}
+
+	b := waitForBatch(t, accepted.ID)
+	if b.Status != StatusSucceeded || b.Progress.Succeeded != 2 {
+		t.Errorf("Expected batch to succeed, got %+v", b)
+	}
+	for _, key := range []string{"temp/a_ground.laz", "temp/samp71-utm_ground.laz"} {
+		if _, ok := store.Get("s3://venicegeo-sample-data/" + key); !ok {
+			t.Errorf("Expected %s to be uploaded", key)
+		}
+	}
+	if _, ok := store.Get("s3://venicegeo-sample-data/temp/b_ground.las"); ok {
+		t.Error("Expected b.las not to match the glob")
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestBatchFailures(t *testing.T) {
+	rec := &pdaltest.Recorder{Output: []byte(`{"filename": "samp71-utm.laz"}`)}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"sources": [
+			"s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+			{"bucket": "venicegeo-sample-data", "key": "pointcloud/missing.laz"}
+		],
+		"function": "info"
+	}`
+	w := post(BatchHandler, "/api/v1/batch", userJSON)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("StatusAccepted expected: %d %s", w.Code, w.Body)
+	}
+	var accepted Batch
+	json.Unmarshal(w.Body.Bytes(), &accepted)
+
+	waitForBatch(t, accepted.ID)
+	req, _ := http.NewRequest("GET", "/api/v1/batch/"+accepted.ID, nil)
+	w = httptest.NewRecorder()
+	if e := BatchStatusHandler(w, req, httprouter.Params{{Key: "id", Value: accepted.ID}}); e != nil {
+		t.Fatal(e)
+	}
+	var b Batch
+	if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Status != StatusFailed || b.Progress.Succeeded != 1 || b.Progress.Failed != 1 {
+		t.Errorf("Expected one success and one failure, got %s", w.Body)
+	}
+	if item := b.Items[1]; item.Job.Status != StatusFailed || item.Job.Message == "" {
+		t.Errorf("Expected the failure to be explained, got %+v", item)
+	}
+	if item := b.Items[0]; item.Job.Response["filename"] == nil {
+		t.Errorf("Expected the info output, got %+v", item)
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	for _, userJSON := range []string{
+		`{"function": "info"}`,
+		`{"function": "bogus", "sources": ["s3://venicegeo-sample-data/pointcloud/samp71-utm.laz"]}`,
+		`{"function": "info", "sources": ["s3://a/b.laz"], "prefix": "s3://a/"}`,
+		`{"function": "info", "bucket": "venicegeo-sample-data", "prefix": "nothing/"}`,
+		`{"function": "ground", "sources": ["s3://a/b.laz", "s3://a/c.laz"], "destination": "s3://a/out.laz"}`,
+		`{"function": "ground", "sources": ["s3://a/b.laz"], "destination": "out/{basename}.laz"}`,
+		`{"function": "ground", "sources": ["ftp://a/b.laz"]}`,
+	} {
+		if w := post(BatchHandler, "/api/v1/batch", userJSON); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: StatusBadRequest expected: %d %s", userJSON, w.Code, w.Body)
+		}
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("Expected PDAL not to run")
+	}
+}
@@ -19,22 +19,39 @@ Package handlers provides support for various handlers within the PDAL microserv
 
 The primary handler is for calls to the /pdal endpoint. Currently, this parses the S3 bucket/key from the incoming JSON message, downloads the data, and executes the PDAL application with the given function name (e.g., info, translate).
 
-The /pdal resource can be extended by adding additional functions. To add a new function, simply add a case statement such as:
+The /pdal resource can be extended by adding additional functions. Functions are looked up by name in the registry of the github.com/venicegeo/pzsvc-pdal/functions package, so to add a new function, simply register it from an init function in that package:
 
-  case "foo":
-    utils.MakeFunction(functions.Foo)(w, r, &res, msg)
+  func init() {
+    Register(Function{
+      Name:        "foo",
+      Description: "Do foo to a point cloud",
+      Output:      OutputFile,
+      NewOptions:  func() interface{} { return NewFooOptions() },
+      Pipeline:    Foo,
+    })
+  }
 
-This will call the MakeFunction routine within the github.com/venicegeo/pzsvc-sdk-go/utils package, downloading source data, processing the data using your custome Foo function, and uploading the result, as needed.
+The /pdal handler, and the /functions listing endpoints, are driven entirely from the registry. The handler downloads the source data, processes it with your custom Foo function, and uploads the result, as needed.
 
-Your custom function should have the following signature.
+Most functions simply build a PDAL pipeline, which is run with "pdal pipeline". Your custom function should then have the following signature.
 
-  type FunctionFunc func(http.ResponseWriter, *http.Request, *job.OutputMsg, job.InputMsg)
+  type PipelineFunc func(i, o string, options *json.RawMessage) (*Pipeline, error)
 
-The http.ResponseWriter is required so that we can properly communicate errors back. The http.Request was originally included so that we would have access to the original Request - not exactly sure it will be needed. The input and output job messages are required so that we can understand the job that has been dispatched to us and so that we can return the proper response.
+For example,
+
+  func Foo(i, o string, options *json.RawMessage) (*Pipeline, error) {
+    return NewPipeline(i, o, Filter("foo", map[string]interface{}{"bar": 1.0})), nil
+  }
+
+Requests with "dry_run": true return the pipelines that would be run, without running them. Functions that must do more than run a pipeline (e.g., read back what it wrote) also set Run, which has the following signature.
+
+  type RunFunc func(ctx context.Context, i, o string, options *json.RawMessage) ([]byte, error)
+
+The input and output filenames are created within the job's workspace. The options are the raw JSON "options" object from the job's input message. Functions with an Output of OutputJSON return their JSON output, which is included in the job's response. Pass ctx along to Pipeline.Run or functions.PDAL.Run, so that PDAL is killed when the job times out (after the function's Timeout, DefaultTimeout, or the request's "timeout" field) or, for synchronous jobs, when the client goes away.
 
-We need to add more documentation to the github.com/venicegeo/pzsvc-pdal/functions package, but this is where the magic actually happens. Everything here, in the end, is just a call to PDAL. You should be able to do anything that PDAL can do (depending of course on how you've build PDAL). That includes running kernels (info, translate, merge) and creating pipelines from the CLI. We tend to do more of the latter. Our function options correspond to PDAL CLI arguments. We assume that we always have one input file and one output file (though that's not even a hard requirement). The remainder of the options are parsed and passed. Close examination of any of the existing functions should give you a pretty good sense of what is going on.
+We need to add more documentation to the github.com/venicegeo/pzsvc-pdal/functions package, but this is where the magic actually happens. Everything here, in the end, is just a call to PDAL. You should be able to do anything that PDAL can do (depending of course on how you've build PDAL). That includes running kernels (info, translate, merge) and running pipelines. We tend to do more of the latter: only info runs a kernel. Our function options correspond to the options of PDAL stages. We assume that we always have one input file and one output file (though that's not even a hard requirement). The remainder of the options are parsed and set on the stages of the pipeline, so values never need quoting. Close examination of any of the existing functions should give you a pretty good sense of what is going on.
 
-The translate function is the all-powerful function (many of the other functions are themselves just translate calls with a little sugar on top). Translate takes a single string as a parameter, which is passed to PDAL. As long as this is something you could run locally with the PDAL CLI, it will run here.
+The translate function is the all-powerful function (many of the other functions are themselves just translate calls with a little sugar on top). Translate takes a list of filters, each with its options, checked against an allowlist (functions.TranslateFilters), and runs them in a pipeline between the input and output. Where enabled (functions.TranslateArgs), it may instead take a single string, giving the filters and their options as you would to the PDAL CLI, and runs the equivalent pipeline. Values containing spaces are quoted as they would be in a shell.
 
   $ pdal translate <input> <output> [everything else]
 
@@ -0,0 +1,82 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-sdk-go/job"
+)
+
+// PlannedStep is a function that a dry run would have run, with the PDAL
+// pipeline it would have run. Functions, such as info, that run a PDAL
+// command rather than a pipeline have none.
+type PlannedStep struct {
+	Function string              `json:"function"`
+	Pipeline *functions.Pipeline `json:"pipeline,omitempty"`
+}
+
+// plan returns the pipelines that running c on behalf of msg would run, with
+// files named as they would be within the job's workspace.
+func (c chain) plan(msg InputMsg) ([]PlannedStep, error) {
+	if msg.input != "" {
+		msg.input = filepath.Base(msg.input)
+	}
+	input, output := msg.paths(&Workspace{}, c.output())
+	inputs, outputs := c.files(input, output, filepath.Base)
+
+	steps := make([]PlannedStep, len(c))
+	for i, l := range c {
+		steps[i].Function = l.fn.Name
+		if l.fn.Pipeline == nil {
+			continue
+		}
+		p, err := l.fn.Pipeline(inputs[i], outputs[i], l.options)
+		if err != nil {
+			return nil, err
+		}
+		steps[i].Pipeline = p
+	}
+	return steps, nil
+}
+
+// dryRun responds with the pipelines that running c on behalf of msg would
+// run, under the "pipelines" key of the response, without downloading or
+// running anything.
+func dryRun(w http.ResponseWriter, c chain, msg InputMsg, res *job.OutputMsg) *AppError {
+	steps, err := c.plan(msg)
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+	if err := setResponse(res, "pipelines", steps); err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	res.FinishedAt = time.Now()
+	res.Code = http.StatusOK
+	res.Message = "Dry run"
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+	"github.com/venicegeo/pzsvc-sdk-go/job"
+)
+
+func TestDryRun(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"steps": [
+			{"function": "crop", "options": {"polygon": "POLYGON((0 0, 1 0, 1 1, 0 0))"}},
+			{"function": "info"},
+			{"function": "ground", "options": {"slope": 0.5}}
+		],
+		"destination": "s3://venicegeo-sample-data/temp/ground.laz",
+		"dry_run": true
+	}`
+	w := post(PdalHandler, "/api/v1/pdal", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	if len(rec.Calls()) != 0 || store.Opens("s3://venicegeo-sample-data/pointcloud/samp71-utm.laz") != 0 {
+		t.Error("Expected nothing to be downloaded or run")
+	}
+	if _, ok := store.Get("s3://venicegeo-sample-data/temp/ground.laz"); ok {
+		t.Error("Expected nothing to be uploaded")
+	}
+
+	var res job.OutputMsg
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	var steps []struct {
+		Function string          `json:"function"`
+		Pipeline json.RawMessage `json:"pipeline"`
+	}
+	if raw := res.Response["pipelines"]; raw != nil {
+		json.Unmarshal(*raw, &steps)
+	}
+	if len(steps) != 3 || steps[1].Function != "info" || steps[1].Pipeline != nil {
+		t.Fatalf("Unexpected response %s", w.Body)
+	}
+	if in, out := pipelineFiles(t, steps[0].Pipeline); in != "samp71-utm.laz" || out != "step-1.laz" {
+		t.Errorf("Unexpected crop pipeline %s", steps[0].Pipeline)
+	}
+	if !strings.Contains(string(steps[0].Pipeline), `"polygon":"POLYGON((0 0, 1 0, 1 1, 0 0))"`) {
+		t.Errorf("Expected the polygon to be passed intact, got %s", steps[0].Pipeline)
+	}
+	if in, out := pipelineFiles(t, steps[2].Pipeline); in != "step-1.laz" || out != "ground.laz" {
+		t.Errorf("Unexpected ground pipeline %s", steps[2].Pipeline)
+	}
+	if strings.Contains(w.Body.String(), WorkspaceRoot) {
+		t.Errorf("Expected files to be named within the workspace, got %s", w.Body)
+	}
+	assertWorkspacesRemoved(t)
+
+	w = post(PdalHandler, "/api/v1/pdal", `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"function": "translate",
+		"options": {"filters": [{"type": "python"}]},
+		"dry_run": true
+	}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected for a disallowed filter: %d %s", w.Code, w.Body)
+	}
+}
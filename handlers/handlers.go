@@ -16,8 +16,74 @@ limitations under the License.
 
 package handlers
 
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+)
+
+// AppError is returned by handlers that fail. Structured errors, such as
+// functions.PdalError and functions.ValidationError, are encoded in full as the
+// Error field.
 type AppError struct {
 	Error   error
 	Message string
 	Code    int
 }
+
+// errorStatus returns the HTTP status code appropriate to err.
+func errorStatus(err error) int {
+	switch e := err.(type) {
+	case functions.ValidationError:
+		return http.StatusBadRequest
+	case *functions.PdalError:
+		return e.HTTPStatus()
+	case *functions.TimeoutError:
+		return e.HTTPStatus()
+	}
+	return http.StatusInternalServerError
+}
+
+// contextError returns the reason ctx is done, if it is, in place of err. A
+// transfer that was interrupted by a timeout is then reported as such.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return functions.ContextError(ctx)
+	}
+	return err
+}
+
+// errorDetails returns the JSON encoding of structured errors, or nil for
+// errors that carry nothing beyond their message.
+func errorDetails(err error) *json.RawMessage {
+	switch err.(type) {
+	case functions.ValidationError, *functions.PdalError, *functions.TimeoutError:
+		b, jsonErr := json.Marshal(err)
+		if jsonErr != nil {
+			return nil
+		}
+		details := json.RawMessage(b)
+		return &details
+	}
+	return nil
+}
+
+// storageSchema describes a storage.Ref.
+func storageSchema(description string) *functions.Schema {
+	return &functions.Schema{
+		Description: description + `, as a URL (s3://, http://, https://, or file://) or an S3 object`,
+		OneOf: []*functions.Schema{
+			{Type: "string"},
+			{
+				Type: "object",
+				Properties: map[string]*functions.Schema{
+					"bucket": {Type: "string"},
+					"key":    {Type: "string"},
+				},
+				Required: []string{"bucket", "key"},
+			},
+		},
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+)
+
+// MaxUploadSize is the largest request body, in bytes, that is accepted,
+// including any point cloud uploaded with the request. Zero means no limit.
+var MaxUploadSize int64 = 1 << 30
+
+// MaxResultSize is the largest file, in bytes, that is returned in the
+// response. Larger results must be sent to a destination. Zero means no limit.
+var MaxResultSize int64 = 1 << 30
+
+// defaultUploadName names uploaded point clouds that come without a filename.
+const defaultUploadName = "upload.laz"
+
+// limitBody makes reads of the request body fail once MaxUploadSize is
+// exceeded, so that the limit is enforced while streaming.
+func limitBody(w http.ResponseWriter, r *http.Request) {
+	if MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+	}
+}
+
+// bodyError describes a failure to read the request body, throwing 413 if it
+// was too large.
+func bodyError(err error) *AppError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		msg := "Request is larger than the limit of " + strconv.FormatInt(tooLarge.Limit, 10) + " bytes"
+		return &AppError{err, msg, http.StatusRequestEntityTooLarge}
+	}
+	return &AppError{err, err.Error(), http.StatusInternalServerError}
+}
+
+// isMultipart reports whether the request is multipart/form-data.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// readMultipart reads the job message from the "job" part of the request into
+// msg, and streams the point cloud in the "file" part into ws.
+func readMultipart(r *http.Request, ws *Workspace, msg *InputMsg) *AppError {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+
+	var input string
+	var gotJob bool
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return multipartError(err)
+		}
+
+		switch part.FormName() {
+		case "job":
+			b, err := ioutil.ReadAll(part)
+			if err != nil {
+				return multipartError(err)
+			}
+			if err := json.Unmarshal(b, msg); err != nil {
+				return &AppError{err, err.Error(), http.StatusBadRequest}
+			}
+			gotJob = true
+		case "file":
+			if input != "" {
+				return &AppError{nil, "Must provide at most one file", http.StatusBadRequest}
+			}
+			input = ws.Path(uploadName(part.FileName()))
+			n, err := saveFile(input, part)
+			if err != nil {
+				return multipartError(err)
+			}
+			log.Println("Received", n, "bytes as", filepath.Base(input))
+		default:
+			return &AppError{nil, "Unexpected part " + part.FormName(), http.StatusBadRequest}
+		}
+		part.Close()
+	}
+
+	if !gotJob {
+		return &AppError{nil, "Must provide a job part", http.StatusBadRequest}
+	}
+	msg.input = input
+	return nil
+}
+
+// multipartError describes a failure to read a multipart request, which is
+// either too large or malformed.
+func multipartError(err error) *AppError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return bodyError(err)
+	}
+	if _, ok := err.(*os.PathError); ok {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	return &AppError{err, err.Error(), http.StatusBadRequest}
+}
+
+// uploadName returns a safe local filename for an uploaded point cloud,
+// keeping the extension so that PDAL can infer the reader.
+func uploadName(filename string) string {
+	name := filepath.Base(strings.Replace(filename, "\\", "/", -1))
+	if name == "." || name == "/" || name == ".." {
+		return defaultUploadName
+	}
+	return name
+}
+
+// saveFile copies r to the named file.
+func saveFile(name string, r io.Reader) (int64, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// contentTypes are the media types of the files that functions produce.
+var contentTypes = map[string]string{
+	".laz":     "application/vnd.laszip",
+	".las":     "application/vnd.las",
+	".tif":     "image/tiff",
+	".tiff":    "image/tiff",
+	".json":    "application/geo+json",
+	".geojson": "application/geo+json",
+}
+
+// contentType returns the media type of the named file.
+func contentType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// serveResult streams the file produced by running fn on behalf of msg as the
+// response, throwing 413 if it is larger than MaxResultSize.
+func serveResult(w http.ResponseWriter, ws *Workspace, fn *functions.Function, msg InputMsg) *AppError {
+	_, name := msg.paths(ws, fn)
+	f, err := os.Open(name)
+	if err != nil {
+		return &AppError{err, "No output was produced", http.StatusInternalServerError}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	if MaxResultSize > 0 && info.Size() > MaxResultSize {
+		msg := "Result of " + strconv.FormatInt(info.Size(), 10) + " bytes is larger than the limit of " +
+			strconv.FormatInt(MaxResultSize, 10) + " bytes; provide a destination instead"
+		return &AppError{nil, msg, http.StatusRequestEntityTooLarge}
+	}
+
+	filename := fn.Name + filepath.Ext(name)
+	w.Header().Set("Content-Type", contentType(name))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.CopyN(w, f, info.Size()); err != nil {
+		log.Println("Error returning", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+)
+
+// postMultipart posts the job message and, if filename is given, the point
+// cloud as multipart/form-data.
+func postMultipart(target, userJSON, filename, data string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("job", userJSON)
+	if filename != "" {
+		part, _ := mw.CreateFormFile("file", filename)
+		part.Write([]byte(data))
+	}
+	mw.Close()
+	req, _ := http.NewRequest("POST", target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestMultipartUpload(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"output.las": []byte("ground points")}}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	req := postMultipart("/api/v1/pdal?sync=true", `{"function": "ground"}`, "../in.las", "fake las")
+	w := serve(PdalHandler, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	if in, out := pipelineFiles(t, rec.LastPipeline()); in != "in.las" || out != "output.las" {
+		t.Errorf("Unexpected pipeline %s", rec.LastPipeline())
+	}
+	if w.Body.String() != "ground points" {
+		t.Errorf("Expected the result in the response, got %q", w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.las" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != "attachment; filename=ground.las" {
+		t.Errorf("Unexpected Content-Disposition %q", cd)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestMultipartAsync(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"ground.laz": []byte("ground points")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{"function": "ground", "destination": "s3://venicegeo-sample-data/temp/ground.laz"}`
+	w := serve(PdalHandler, postMultipart("/api/v1/pdal", userJSON, "in.laz", "fake laz"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("StatusAccepted expected: %d %s", w.Code, w.Body)
+	}
+	var accepted Job
+	json.Unmarshal(w.Body.Bytes(), &accepted)
+
+	var j Job
+	for i := 0; i < 100; i++ {
+		j, _ = Jobs.Get(accepted.ID)
+		if j.Finished() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if j.Status != StatusSucceeded {
+		t.Fatalf("Expected job to succeed, got %+v", j)
+	}
+	if b, ok := store.Get("s3://venicegeo-sample-data/temp/ground.laz"); !ok || string(b) != "ground points" {
+		t.Errorf("Expected output to be uploaded, got %q", b)
+	}
+}
+
+func TestMultipartAsyncNoDestination(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	w := serve(PdalHandler, postMultipart("/api/v1/pdal", `{"function": "ground"}`, "in.laz", "fake laz"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected: %d %s", w.Code, w.Body)
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("Expected PDAL not to run")
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestMultipartErrors(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	tests := []struct {
+		userJSON string
+		filename string
+		status   int
+	}{
+		{`{"function": "ground"}`, "", http.StatusBadRequest},
+		{`{"function": "ground", "source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz"}`,
+			"in.laz", http.StatusBadRequest},
+		{`{"function": "bogus"}`, "in.laz", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := serve(PdalHandler, postMultipart("/api/v1/pdal?sync=true", tt.userJSON, tt.filename, "fake laz"))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d %s", tt.userJSON, tt.status, w.Code, w.Body)
+		}
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("Expected PDAL not to run")
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestSizeLimits(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"output.laz": []byte("too many points")}}
+	_, teardown := setup(t, rec)
+	defer teardown()
+	origUpload, origResult := MaxUploadSize, MaxResultSize
+	defer func() { MaxUploadSize, MaxResultSize = origUpload, origResult }()
+
+	MaxUploadSize = 1024
+	req := postMultipart("/api/v1/pdal?sync=true", `{"function": "ground"}`, "in.laz", strings.Repeat("x", 2048))
+	if w := serve(PdalHandler, req); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("StatusRequestEntityTooLarge expected for upload: %d %s", w.Code, w.Body)
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("Expected PDAL not to run")
+	}
+
+	// JSON bodies are limited too.
+	large := `{"pipeline": ["` + strings.Repeat("x", 2048) + `"]}`
+	for _, h := range []func(http.ResponseWriter, *http.Request) *AppError{PipelineHandler, ValidatePipelineHandler, BatchHandler} {
+		if w := post(h, "/api/v1/pipeline", large); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("StatusRequestEntityTooLarge expected: %d %s", w.Code, w.Body)
+		}
+	}
+
+	MaxResultSize = 4
+	req = postMultipart("/api/v1/pdal?sync=true", `{"function": "ground"}`, "in.laz", "fake laz")
+	if w := serve(PdalHandler, req); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("StatusRequestEntityTooLarge expected for result: %d %s", w.Code, w.Body)
+	}
+	assertWorkspacesRemoved(t)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/venicegeo/pzsvc-sdk-go/job"
+)
+
+// JobStatus describes where a job is in its lifecycle.
+type JobStatus string
+
+// Jobs move from queued to running, and finish as either succeeded or failed.
+const (
+	StatusQueued    JobStatus = "queued"
+	StatusRunning   JobStatus = "running"
+	StatusSucceeded JobStatus = "succeeded"
+	StatusFailed    JobStatus = "failed"
+)
+
+// JobRetention is how long finished jobs remain available for polling.
+var JobRetention = time.Hour
+
+// Job tracks the progress of an asynchronous PDAL job. The embedded OutputMsg
+// is filled in as the job evolves.
+type Job struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	job.OutputMsg
+}
+
+// MarshalJSON omits finished_at until the job has actually finished.
+func (j Job) MarshalJSON() ([]byte, error) {
+	type jobJSON struct {
+		ID         string                      `json:"id"`
+		Status     JobStatus                   `json:"status"`
+		StartedAt  time.Time                   `json:"started_at"`
+		FinishedAt *time.Time                  `json:"finished_at,omitempty"`
+		Code       int                         `json:"code,omitempty"`
+		Message    string                      `json:"message,omitempty"`
+		Response   map[string]*json.RawMessage `json:"response,omitempty"`
+	}
+	out := jobJSON{
+		ID:        j.ID,
+		Status:    j.Status,
+		StartedAt: j.StartedAt,
+		Code:      j.Code,
+		Message:   j.Message,
+		Response:  j.Response,
+	}
+	if !j.FinishedAt.IsZero() {
+		out.FinishedAt = &j.FinishedAt
+	}
+	return json.Marshal(out)
+}
+
+// Finished reports whether the job has either succeeded or failed.
+func (j Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
+
+// JobStore is an in-memory, concurrency-safe collection of jobs.
+type JobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+// NewJobStore constructs an empty JobStore.
+func NewJobStore() *JobStore {
+	return &JobStore{jobs: make(map[string]*Job)}
+}
+
+// Jobs is the store backing the /api/v1/jobs endpoint.
+var Jobs = NewJobStore()
+
+// Create adds a new queued job to the store and returns a copy of it.
+func (s *JobStore) Create() (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	j := &Job{ID: id, Status: StatusQueued}
+	j.StartedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(j.StartedAt)
+	s.jobs[id] = j
+	return *j, nil
+}
+
+// Get returns a copy of the job with the given ID.
+func (s *JobStore) Get(id string) (Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// Update applies fn to the job with the given ID while holding the store lock.
+func (s *JobStore) Update(id string, fn func(*Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		fn(j)
+	}
+}
+
+// prune drops finished jobs older than JobRetention. The caller must hold the
+// write lock.
+func (s *JobStore) prune(now time.Time) {
+	for id, j := range s.jobs {
+		if j.Finished() && now.Sub(j.FinishedAt) > JobRetention {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// newJobID returns a random, RFC 4122 version 4 UUID.
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// JobHandler reports the current state of a job.
+func JobHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *AppError {
+	j, ok := Jobs.Get(ps.ByName("id"))
+	if !ok {
+		return &AppError{nil, "Unknown job " + ps.ByName("id"), http.StatusNotFound}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(j); err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/venicegeo/pzsvc-pdal/storage"
+)
+
+// Metrics describes the state of the service.
+type Metrics struct {
+	Workers     PoolStats           `json:"workers"`
+	InputCache  *storage.CacheStats `json:"input_cache,omitempty"`
+	ResultCache *storage.CacheStats `json:"result_cache,omitempty"`
+}
+
+// MetricsHandler reports the state of the worker pool and, if enabled, the
+// input and result caches.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	m := Metrics{Workers: Workers.Stats()}
+	if c := storage.InputCache; c != nil {
+		stats := c.Stats()
+		m.InputCache = &stats
+	}
+	if c := Results; c != nil {
+		stats := c.Stats()
+		m.ResultCache = &stats
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	return nil
+}
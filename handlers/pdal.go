@@ -17,138 +17,239 @@ limitations under the License.
 package handlers
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"path"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-pdal/storage"
 	"github.com/venicegeo/pzsvc-sdk-go/job"
-	"github.com/venicegeo/pzsvc-sdk-go/s3"
 )
 
 // InputMsg defines the expected input JSON structure.
-// We currently support S3 input (bucket/key), though provider-specific (e.g.,
-// GRiD) may be legitimate.
+// The source and destination may be given as any storage.Ref, i.e., as a URL
+// or as an S3 bucket/key. Either a function, with its options, or a list of
+// steps is given.
 type InputMsg struct {
-	Source      interface{}      `json:"source,omitempty"`
+	Source      storage.Ref      `json:"source,omitempty"`
 	Function    *string          `json:"function,omitempty"`
 	Options     *json.RawMessage `json:"options,omitempty"`
-	Destination s3.Bucket        `json:"destination,omitempty"`
+	Steps       []Step           `json:"steps,omitempty"`
+	Destination storage.Ref      `json:"destination,omitempty"`
+	// Timeout, in seconds, overrides the default time limit, i.e., the total
+	// of the functions' time limits.
+	Timeout *float64 `json:"timeout,omitempty"`
+	// DryRun asks for the PDAL pipelines that the job would run, rather than
+	// running it.
+	DryRun bool `json:"dry_run,omitempty"`
+	// NoCache runs the job even if its result has been cached.
+	NoCache bool `json:"no_cache,omitempty"`
+
+	// input is the local copy of a source uploaded with the request, if any.
+	input string
 }
 
-// FunctionFunc defines the signature of our function creator.
-type FunctionFunc func(InputMsg) ([]byte, error)
-
-// MakeFunction wraps the individual PDAL functions.
-// Parse the input and output filenames, creating files as needed. Download the
-// input data and upload the output data.
-func MakeFunction(fn func(string, string, *json.RawMessage) ([]byte, error)) FunctionFunc {
-	return func(msg InputMsg) ([]byte, error) {
-		var inputName, outputName string
-		var fileOut *os.File
-		log.Printf("%+v\n", msg.Source)
-		switch u := msg.Source.(type) {
-		case string:
-			client := &http.Client{}
-
-			req, err := http.NewRequest("GET", u, nil)
-			_, inputName = path.Split(u)
-
-			resp, err := client.Do(req)
-			log.Println(resp.Header)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer resp.Body.Close()
-			log.Println(resp.Status)
+// paths returns the input and output filenames for running fn on behalf of
+// msg within ws. The output is named after the destination, if any, taking
+// care not to overwrite the input. Otherwise, it keeps the extension of the
+// input (or, for rasters, is a GeoTIFF), so that PDAL can infer the writer.
+func (msg InputMsg) paths(ws *Workspace, fn *functions.Function) (input, output string) {
+	input = msg.input
+	if input == "" {
+		input = ws.Path(msg.Source.Base())
+	}
 
-			fileIn, err := os.Create(inputName)
-			if err != nil {
-				return nil, err
-			}
-			defer fileIn.Close()
+	switch {
+	case !msg.Destination.IsZero():
+		output = ws.Path(msg.Destination.Base())
+	case fn.Output == functions.OutputRaster:
+		output = ws.Path("output.tif")
+	default:
+		output = ws.Path("output" + filepath.Ext(input))
+	}
+	if output == input {
+		output = ws.Path("output-" + filepath.Base(input))
+	}
+	return input, output
+}
 
-			numBytes, err := io.Copy(fileIn, resp.Body)
-			if err != nil {
-				return nil, err
-			}
+// MaxTimeout is the longest time limit a request may ask for.
+var MaxTimeout = 2 * time.Hour
 
-			log.Println("Downloaded", numBytes, "bytes")
-		default:
-			log.Println("unknown - try as s3 bucket")
+// timeLimit returns the time limit for running c on behalf of msg.
+func timeLimit(c chain, msg InputMsg) (time.Duration, error) {
+	if msg.Timeout == nil {
+		return c.timeLimit(), nil
+	}
+	if *msg.Timeout <= 0 || *msg.Timeout > MaxTimeout.Seconds() {
+		return 0, functions.ValidationError{{
+			Field:   "timeout",
+			Message: "must be greater than 0 and at most " + strconv.FormatFloat(MaxTimeout.Seconds(), 'f', -1, 64),
+		}}
+	}
+	return time.Duration(*msg.Timeout * float64(time.Second)), nil
+}
 
-			// TODO(chambbj): we know there is a more idiomatic way of achieving this,
-			// but it works
-			fmt.Printf("%+v\n", msg.Source)
-			src := new(s3.Bucket)
-			b, err := json.Marshal(msg.Source)
-			if err != nil {
-				log.Println("error marshaling")
-			}
-			err = json.Unmarshal(b, &src)
-			if err != nil {
-				log.Println("must not be an s3 bucket")
-			}
+// runFunction executes the function or steps requested in msg, recording the
+// outcome in res. Functions that produce JSON (e.g., info, vo) have their
+// output returned in res.Response, as do the metadata of the output file (see
+// functions.Metadata) and the timings of any steps.
+//
+// The work, including transfers, is abandoned if ctx is cancelled or the limit
+// passes, in which case a *functions.TimeoutError is returned. The caller owns
+// ws, and must remove it once any output has been returned.
+func runFunction(ctx context.Context, ws *Workspace, msg InputMsg, limit time.Duration, res *job.OutputMsg) error {
+	c, err := msg.chain()
+	if err != nil {
+		return err
+	}
 
-			fmt.Println(src.Bucket)
-			fmt.Println(src.Key)
-			// Split the source S3 key string, interpreting the last element as the
-			// input filename. Create the input file, throwing 500 on error.
-			inputName = s3.ParseFilenameFromKey(src.Key)
-			fileIn, err := os.Create(inputName)
-			if err != nil {
-				return nil, err
-			}
-			defer fileIn.Close()
+	ctx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
 
-			// Download the source data from S3, throwing 500 on error.
-			err = s3.Download(fileIn, src.Bucket, src.Key)
+	// Answer from the result cache if the same job has been run before.
+	var key string
+	cached := Results != nil && !msg.NoCache
+	_, output := msg.paths(ws, c.output())
+	if cached {
+		key, cached = Results.resultKey(ctx, c, msg, output)
+	}
+	if cached {
+		if e, ok := Results.get(key, output); ok {
+			response, err := replay(ctx, e, msg, output)
 			if err != nil {
-				return nil, errors.New("Error with s3.Download() " + err.Error())
+				if ctx.Err() == context.DeadlineExceeded {
+					return functions.NewTimeoutError(limit)
+				}
+				return err
 			}
+			res.Response = response
+			res.FinishedAt = time.Now()
+			res.Code = http.StatusOK
+			res.Message = "Success (cached)"
+			return nil
 		}
+	}
 
-		// If provided, split the destination S3 key string, interpreting the last
-		// element as the output filename. Create the output file, throwing 500 on
-		// error.
-		if len(msg.Destination.Key) > 0 {
-			outputName = s3.ParseFilenameFromKey(msg.Destination.Key)
-
-			os.Remove(outputName)
+	result, err := c.run(ctx, ws, msg)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return functions.NewTimeoutError(limit)
+		}
+		return err
+	}
+	if result.output != nil {
+		if err := json.Unmarshal(result.output, &res.Response); err != nil {
+			return err
 		}
+	}
 
-		// Run the PDAL function.
-		retval, err := fn(inputName, outputName, msg.Options)
-		if err != nil {
-			return nil, errors.New("Error with Info function " + err.Error())
+	// Report where the output ended up, e.g., the URL an HTTP upload was
+	// redirected to, what PDAL made of it, and how long each step took.
+	if result.metadata != nil {
+		raw := json.RawMessage(result.metadata)
+		if err := setResponse(res, "metadata", &raw); err != nil {
+			return err
 		}
+	}
+	if result.uploaded != nil {
+		if err := setResponse(res, "destination", result.uploaded); err != nil {
+			return err
+		}
+	}
+	if len(msg.Steps) > 0 {
+		if err := setResponse(res, "steps", result.steps); err != nil {
+			return err
+		}
+	}
 
-		// If an output has been created, upload the destination data to S3,
-		// throwing 500 on error.
-		if len(msg.Destination.Key) > 0 {
-			fileOut, err = os.Open(outputName)
-			if err != nil {
-				return nil, err
+	if cached {
+		Results.put(key, c, msg, res.Response, output)
+	}
+
+	res.FinishedAt = time.Now()
+	res.Code = http.StatusOK
+	res.Message = "Success"
+
+	return nil
+}
+
+// setResponse sets the given key of the response to the JSON encoding of v.
+func setResponse(res *job.OutputMsg, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if res.Response == nil {
+		res.Response = make(map[string]*json.RawMessage)
+	}
+	raw := json.RawMessage(b)
+	res.Response[key] = &raw
+	return nil
+}
+
+// runJob executes msg on behalf of the job with the given ID once the ticket
+// allows, moving it from running to either succeeded or failed. The workspace
+// is removed when done.
+func runJob(id string, ws *Workspace, msg InputMsg, limit time.Duration, t *Ticket) {
+	defer ws.Remove()
+	defer t.Release()
+	t.Wait(context.Background())
+	Jobs.Update(id, func(j *Job) { j.Status = StatusRunning })
+
+	var res job.OutputMsg
+	var err error
+	func() {
+		// Jobs run outside of net/http, so a panic would otherwise bring down
+		// the entire service.
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
 			}
-			defer fileOut.Close()
-			err = s3.Upload(fileOut, msg.Destination.Bucket, msg.Destination.Key)
-			if err != nil {
-				return nil, err
+		}()
+		err = runFunction(context.Background(), ws, msg, limit, &res)
+	}()
+
+	Jobs.Update(id, func(j *Job) {
+		j.FinishedAt = time.Now()
+		if err != nil {
+			log.Println("Job", id, "failed:", err)
+			j.Status = StatusFailed
+			j.Code = errorStatus(err)
+			j.Message = err.Error()
+			if details := errorDetails(err); details != nil {
+				j.Response = map[string]*json.RawMessage{"error": details}
 			}
+			return
 		}
-
-		return retval, nil
-	}
+		j.Status = StatusSucceeded
+		j.Code = res.Code
+		j.Message = res.Message
+		j.Response = res.Response
+	})
 }
 
-// PdalHandler handles PDAL jobs.
+/*
+PdalHandler handles PDAL jobs.
+
+By default, the job is queued and run in the background. The handler responds
+immediately with 202 Accepted and the job, whose progress can be polled at
+/api/v1/jobs/:id (also given in the Location header). Adding sync=true to the
+query string runs the job within the request, as was done previously.
+
+The body is either the JSON job message or, to upload the point cloud with the
+request, multipart/form-data with the message as its "job" part and the point
+cloud as its "file" part. Synchronous jobs that produce a file but have no
+destination return the file itself; an uploaded point cloud whose result is a
+file must therefore be given either a destination or sync=true. Jobs with
+"dry_run": true return the PDAL pipelines they would run, without running them.
+*/
 func PdalHandler(w http.ResponseWriter, r *http.Request) *AppError {
 	// Create the job output message. No matter what happens, we should always be
 	// able to populate the StartedAt field.
@@ -162,194 +263,120 @@ func PdalHandler(w http.ResponseWriter, r *http.Request) *AppError {
 	if r.Body == nil {
 		return &AppError{nil, "No JSON", http.StatusBadRequest}
 	}
+	limitBody(w, r)
 
-	// Throw 500 if we cannot read the body.
-	b, err := ioutil.ReadAll(r.Body)
+	// The workspace is handed over to the job if it is queued, and otherwise
+	// removed once we have responded.
+	ws, err := NewWorkspace()
 	if err != nil {
 		return &AppError{err, err.Error(), http.StatusInternalServerError}
 	}
-
-	// Throw 400 if we cannot unmarshal the body as a valid InputMsg.
-	if err := json.Unmarshal(b, &msg); err != nil {
-		return &AppError{err, err.Error(), http.StatusBadRequest}
-	}
-
-	// Throw 400 if the JobInput does not specify a function.
-	if msg.Function == nil {
-		return &AppError{nil, "Must provide a function", http.StatusBadRequest}
-	}
-
-	// Make/execute the requested function.
-	switch *msg.Function {
-	case "crop":
-		_, err := MakeFunction(functions.Crop)(msg)
-		if err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
-		}
-
-		res.FinishedAt = time.Now()
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
-
-		if err := json.NewEncoder(w).Encode(res); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-
-	case "dart":
-		_, err := MakeFunction(functions.Dart)(msg)
-		if err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
-		}
-
-		res.FinishedAt = time.Now()
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
-
-		if err := json.NewEncoder(w).Encode(res); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-
-	case "dtm":
-		_, err := MakeFunction(functions.Dtm)(msg)
-		if err != nil {
-			return &AppError{err, "DTM error", http.StatusInternalServerError}
+	queued := false
+	defer func() {
+		if !queued {
+			ws.Remove()
 		}
+	}()
 
-		res.FinishedAt = time.Now()
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
-
-		if err := json.NewEncoder(w).Encode(res); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if isMultipart(r) {
+		if aerr := readMultipart(r, ws, &msg); aerr != nil {
+			return aerr
 		}
-
-	case "ground":
-		_, err := MakeFunction(functions.Ground)(msg)
+	} else {
+		// Throw 500 if we cannot read the body, or 413 if it is too large.
+		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
-		}
-
-		res.FinishedAt = time.Now()
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
-
-		if err := json.NewEncoder(w).Encode(res); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return bodyError(err)
 		}
 
-	case "height":
-		_, err := MakeFunction(functions.Height)(msg)
-		if err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
+		// Throw 400 if we cannot unmarshal the body as a valid InputMsg.
+		if err := json.Unmarshal(b, &msg); err != nil {
+			return &AppError{err, err.Error(), http.StatusBadRequest}
 		}
+	}
 
-		res.FinishedAt = time.Now()
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
-
-		if err := json.NewEncoder(w).Encode(res); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	// Throw 400 if the JobInput does not specify a recognized function, or
+	// valid steps.
+	c, err := msg.chain()
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
 
-	case "info":
-		bytes, err := MakeFunction(functions.Info)(msg)
-		if err != nil {
-			return &AppError{err, "Info error: MakeFunction", http.StatusInternalServerError}
-		}
-		if err := json.Unmarshal(bytes, &res.Response); err != nil {
-			return &AppError{err, "Info error: Unmarshal", http.StatusInternalServerError}
+	// Throw 400 if the source or destination is not somewhere we can reach.
+	switch {
+	case msg.Source.IsZero() && msg.input == "":
+		return &AppError{nil, "Must provide a source", http.StatusBadRequest}
+	case msg.input != "" && !msg.Source.IsZero():
+		return &AppError{nil, "Must provide either a source or a file, not both", http.StatusBadRequest}
+	case msg.input == "":
+		if err := msg.Source.Check(); err != nil {
+			return &AppError{err, err.Error(), http.StatusBadRequest}
 		}
-
-		res.FinishedAt = time.Now()
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
-
-		if err := json.NewEncoder(w).Encode(res); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	if !msg.Destination.IsZero() {
+		if err := msg.Destination.Check(); err != nil {
+			return &AppError{err, err.Error(), http.StatusBadRequest}
 		}
+	}
 
-	case "radius":
-		_, err := MakeFunction(functions.Radius)(msg)
-		if err != nil {
-			return &AppError{err, "Radius error", http.StatusInternalServerError}
-		}
+	limit, err := timeLimit(c, msg)
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
 
-		res.FinishedAt = time.Now()
+	// A dry run answers at once, whether or not the job is synchronous.
+	if msg.DryRun {
+		return dryRun(w, c, msg, &res)
+	}
 
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
+	// Throw 400 if a queued job would have nowhere to put its output: an
+	// uploaded file cannot be fetched again, so the result would be lost.
+	sync := r.URL.Query().Get("sync") == "true"
+	if !sync && msg.input != "" && msg.Destination.IsZero() && c.endsWithFile() {
+		return &AppError{nil, "Must provide a destination, or sync=true, for an uploaded file", http.StatusBadRequest}
+	}
 
-		if err := json.NewEncoder(w).Encode(res); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	// Turn the job away with 429 if too many are already waiting to run.
+	t, err := Workers.Reserve(c.weight())
+	if err != nil {
+		return poolFullError(w)
+	}
 
-	case "statistical":
-		_, err := MakeFunction(functions.Statistical)(msg)
-		if err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
+	// Synchronous jobs are abandoned if the client goes away, whether they are
+	// waiting or running.
+	if sync {
+		defer t.Release()
+		if err := t.Wait(r.Context()); err != nil {
+			return &AppError{err, err.Error(), http.StatusServiceUnavailable}
 		}
-
-		res.FinishedAt = time.Now()
-
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
-
-		if err := json.NewEncoder(w).Encode(res); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := runFunction(r.Context(), ws, msg, limit, &res); err != nil {
+			return &AppError{err, err.Error(), errorStatus(err)}
 		}
-
-	case "translate":
-		_, err := MakeFunction(functions.Translate)(msg)
-		if err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
+		if msg.Destination.IsZero() && c.endsWithFile() {
+			return serveResult(w, ws, c.output(), msg)
 		}
 
-		res.FinishedAt = time.Now()
-
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
-		res.Code = http.StatusOK
-		res.Message = "Success"
-
 		if err := json.NewEncoder(w).Encode(res); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
+		return nil
+	}
 
-	case "vo":
-		bytes, err := MakeFunction(functions.VO)(msg)
-		if err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
-		}
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, string(bytes))
-
-	// An unrecognized function will result in 400 error, with message explaining
-	// how to list available functions.
-	default:
-		return &AppError{nil, "Unrecognized function", http.StatusBadRequest}
+	j, err := Jobs.Create()
+	if err != nil {
+		t.Release()
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	queued = true
+	go runJob(j.ID, ws, msg, limit, t)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Location", "/api/v1/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(j); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
 	return nil
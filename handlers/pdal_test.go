@@ -16,200 +16,570 @@ limitations under the License.
 
 package handlers
 
-// these require PDAL - not appropriate for Jenkins
-// func TestBasicInfo(t *testing.T) {
-// 	userJSON := `{
-// 		"source":
-// 		{
-// 			"bucket": "venicegeo-sample-data",
-// 			"key": "pointcloud/samp71-utm.laz"
-// 		},
-// 		"function": "info"
-// 	}`
-// 	reader := strings.NewReader(userJSON)
-// 	router := httprouter.New()
-// 	router.POST("/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/pdal", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusOK {
-// 		t.Errorf("StatusOK expected: %d", w.Code)
-// 	}
-// }
-//
-// func TestBasicGround(t *testing.T) {
-// 	userJSON := `{
-// 		"source":
-// 		{
-// 			"bucket": "venicegeo-sample-data",
-// 			"key": "pointcloud/samp71-utm.laz"
-// 		},
-// 		"function": "ground",
-// 		"destination":
-// 		{
-// 			"bucket": "venicegeo-sample-data",
-// 			"key": "temp/ground.laz"
-// 		}
-// 	}`
-// 	reader := strings.NewReader(userJSON)
-// 	router := httprouter.New()
-// 	router.POST("/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/pdal", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusOK {
-// 		t.Errorf("StatusOK expected: %d", w.Code)
-// 	}
-// }
-//
-// func TestBasicHeight(t *testing.T) {
-// 	userJSON := `{
-// 		"source":
-// 		{
-// 			"bucket": "venicegeo-sample-data",
-// 			"key": "pointcloud/samp71-utm.laz"
-// 		},
-// 		"function": "height",
-// 		"destination": {
-// 			"bucket": "venicegeo-sample-data",
-// 			"key": "temp/height.laz"
-// 		}
-// 	}`
-// 	reader := strings.NewReader(userJSON)
-// 	router := httprouter.New()
-// 	router.POST("/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/pdal", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusOK {
-// 		t.Errorf("StatusOK expected: %d", w.Code)
-// 	}
-// }
-
-// // this is specific to our service, it stays
-// func TestNoFunctionField(t *testing.T) {
-// 	userJSON := `{
-// 		"source":
-// 		{
-// 			"bucket": "venicegeo-sample-data",
-// 			"key": "pointcloud/samp71-utm.laz"
-// 		},
-// 		"fail": "info"
-// 	}`
-// 	reader := strings.NewReader(userJSON)
-// 	router := httprouter.New()
-// 	router.POST("/api/v1/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/api/v1/pdal", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusBadRequest {
-// 		t.Errorf("StatusBadRequest expected: %d", w.Code)
-// 	}
-// }
-//
-// // also specific to our service, it too stays
-// func TestBadFunction(t *testing.T) {
-// 	userJSON := `{
-// 		"source":
-// 		{
-// 			"bucket": "venicegeo-sample-data",
-// 			"key": "pointcloud/samp71-utm.laz"
-// 		},
-// 		"function": "fail"
-// 	}`
-// 	reader := strings.NewReader(userJSON)
-// 	router := httprouter.New()
-// 	router.POST("/api/v1/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/api/v1/pdal", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusBadRequest {
-// 		t.Errorf("StatusBadRequest expected: %d", w.Code)
-// 	}
-// }
-
-// these really test elements of pzsvc-sdk-go
-// func TestBadBucket(t *testing.T) {
-// 	userJSON := `{
-// 		"source":
-// 		{
-// 			"bucket": "bad-bucket",
-// 			"key": "pointcloud/samp71-utm.laz"
-// 		},
-// 		"function": "info"
-// 	}`
-// 	reader := strings.NewReader(userJSON)
-// 	router := httprouter.New()
-// 	router.POST("/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/pdal", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusInternalServerError {
-// 		t.Errorf("StatusInternalServerError expected: %d", w.Code)
-// 	}
-// }
-//
-// func TestBadKey(t *testing.T) {
-// 	userJSON := `{
-// 		"source":
-// 		{
-// 			"bucket": "venicegeo-sample-data",
-// 			"key": "bad-folder/bad-file"
-// 		},
-// 		"function": "info"
-// 	}`
-// 	reader := strings.NewReader(userJSON)
-// 	router := httprouter.New()
-// 	router.POST("/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/pdal", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusInternalServerError {
-// 		t.Errorf("StatusInternalServerError expected: %d", w.Code)
-// 	}
-// }
-//
-// func TestEmptyJSON(t *testing.T) {
-// 	userJSON := `{}`
-// 	reader := strings.NewReader(userJSON)
-// 	router := httprouter.New()
-// 	router.POST("/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/pdal", reader)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusBadRequest {
-// 		t.Errorf("StatusBadRequest expected: %d", w.Code)
-// 	}
-// }
-//
-// func TestNoJSON(t *testing.T) {
-// 	router := httprouter.New()
-// 	router.POST("/pdal", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/pdal", nil)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusBadRequest {
-// 		t.Errorf("StatusBadRequest expected: %d", w.Code)
-// 	}
-// }
-//
-// func TestBadEndpoint(t *testing.T) {
-// 	router := httprouter.New()
-// 	router.POST("/ladp", PdalHandler)
-// 	req, _ := http.NewRequest("POST", "/ladp", nil)
-// 	w := httptest.NewRecorder()
-// 	router.ServeHTTP(w, req)
-// 	fmt.Println(w.Body)
-// 	if w.Code != http.StatusBadRequest {
-// 		t.Errorf("StatusBadRequest expected: %d", w.Code)
-// 	}
-// }
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+	"github.com/venicegeo/pzsvc-pdal/storage"
+	"github.com/venicegeo/pzsvc-pdal/storage/storagetest"
+	"github.com/venicegeo/pzsvc-sdk-go/job"
+)
+
+// setup installs a fake PDAL, an in-memory S3 holding our sample data, and a
+// temporary workspace root. The returned function restores everything.
+func setup(t *testing.T, rec *pdaltest.Recorder) (*storagetest.Memory, func()) {
+	root, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origRoot := WorkspaceRoot
+	WorkspaceRoot = root
+
+	mem := storagetest.NewMemory()
+	mem.Put("s3://venicegeo-sample-data/pointcloud/samp71-utm.laz", []byte("fake laz"))
+	restoreStorage := storagetest.Install("s3", mem)
+
+	restore := pdaltest.Install(rec)
+	return mem, func() {
+		restore()
+		restoreStorage()
+		WorkspaceRoot = origRoot
+		os.RemoveAll(root)
+	}
+}
+
+// serve calls the handler as our appHandler would, returning the response.
+func serve(h func(http.ResponseWriter, *http.Request) *AppError, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	if e := h(w, req); e != nil {
+		w.WriteHeader(e.Code)
+		json.NewEncoder(w).Encode(e)
+	}
+	return w
+}
+
+func post(h func(http.ResponseWriter, *http.Request) *AppError, target, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", target, strings.NewReader(body))
+	return serve(h, req)
+}
+
+// assertWorkspacesRemoved checks that no job has left files behind.
+func assertWorkspacesRemoved(t *testing.T) {
+	entries, _ := ioutil.ReadDir(WorkspaceRoot)
+	if len(entries) != 0 {
+		t.Errorf("Expected workspaces to be removed, found %d", len(entries))
+	}
+}
+
+// pipelineFiles returns the names of the files read and written by a recorded
+// pipeline.
+func pipelineFiles(t *testing.T, b []byte) (input, output string) {
+	var p struct {
+		Pipeline []map[string]interface{} `json:"pipeline"`
+	}
+	if err := json.Unmarshal(b, &p); err != nil || len(p.Pipeline) < 2 {
+		t.Fatalf("Unexpected pipeline %s", b)
+	}
+	input, _ = p.Pipeline[0]["filename"].(string)
+	output, _ = p.Pipeline[len(p.Pipeline)-1]["filename"].(string)
+	return filepath.Base(input), filepath.Base(output)
+}
+
+func TestBasicInfo(t *testing.T) {
+	rec := &pdaltest.Recorder{Output: []byte(`{ "filename": "samp71-utm.laz", "pdal_version": "1.1.0" }`)}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source":
+		{
+			"bucket": "venicegeo-sample-data",
+			"key": "pointcloud/samp71-utm.laz"
+		},
+		"function": "info"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"pdal_version":"1.1.0"`) {
+		t.Errorf("Expected info output in response, got %s", w.Body)
+	}
+
+	args := rec.Last()
+	if len(args) != 2 || args[0] != "info" || filepath.Base(args[1]) != "samp71-utm.laz" {
+		t.Errorf("Unexpected PDAL arguments %v", args)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestBasicGround(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"ground.laz": []byte("ground")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source":
+		{
+			"bucket": "venicegeo-sample-data",
+			"key": "pointcloud/samp71-utm.laz"
+		},
+		"function": "ground",
+		"options": {"slope": 0.5},
+		"destination":
+		{
+			"bucket": "venicegeo-sample-data",
+			"key": "temp/ground.laz"
+		}
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+
+	p := string(rec.LastPipeline())
+	for _, want := range []string{`"type":"filters.ground"`, `"slope":0.5`, `"filename":"` + WorkspaceRoot} {
+		if !strings.Contains(p, want) {
+			t.Errorf("Expected %s in pipeline %s", want, p)
+		}
+	}
+	if b, ok := store.Get("s3://venicegeo-sample-data/temp/ground.laz"); !ok || string(b) != "ground" {
+		t.Errorf("Expected output to be uploaded, got %q", b)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestBasicHeight(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"height.laz": []byte("height")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source":
+		{
+			"bucket": "venicegeo-sample-data",
+			"key": "pointcloud/samp71-utm.laz"
+		},
+		"function": "height",
+		"destination": {
+			"bucket": "venicegeo-sample-data",
+			"key": "temp/height.laz"
+		}
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	if _, ok := store.Get("s3://venicegeo-sample-data/temp/height.laz"); !ok {
+		t.Error("Expected output to be uploaded")
+	}
+}
+
+func TestFunctionMetadata(t *testing.T) {
+	rec := &pdaltest.Recorder{
+		Files:    map[string][]byte{"cropped.laz": pdaltest.LASHeader(12, [6]float64{0, 0, 0, 1, 1, 1})},
+		Metadata: []byte(`{"stages": {"readers.las": {"count": 100}, "filters.crop": {}, "writers.las": {}}}`),
+	}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"function": "crop",
+		"options": {"bounds": "([0,1],[0,1])"},
+		"destination": "s3://venicegeo-sample-data/temp/cropped.laz"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	var res struct {
+		Response struct {
+			Metadata functions.Metadata `json:"metadata"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	m := res.Response.Metadata
+	if m.Input == nil || *m.Input.Points != 100 || m.Output == nil || *m.Output.Points != 12 ||
+		m.Output.Size != 375 || m.Stages["filters.crop"] == nil {
+		t.Errorf("Expected the metadata of the run in the response, got %s", w.Body)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestSourceForms(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"ground.laz": []byte("ground")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fake laz"))
+	}))
+	defer ts.Close()
+
+	for _, source := range []string{
+		`"s3://venicegeo-sample-data/pointcloud/samp71-utm.laz"`,
+		`"` + ts.URL + `/pointcloud/samp71-utm.laz"`,
+	} {
+		userJSON := `{
+			"source": ` + source + `,
+			"function": "ground",
+			"destination": "s3://venicegeo-sample-data/temp/ground.laz"
+		}`
+		w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: StatusOK expected: %d %s", source, w.Code, w.Body)
+		}
+		if in, _ := pipelineFiles(t, rec.LastPipeline()); in != "samp71-utm.laz" {
+			t.Errorf("%s: unexpected pipeline %s", source, rec.LastPipeline())
+		}
+	}
+	if _, ok := store.Get("s3://venicegeo-sample-data/temp/ground.laz"); !ok {
+		t.Error("Expected output to be uploaded")
+	}
+
+	w := post(PdalHandler, "/api/v1/pdal", `{"source": "ftp://host/in.laz", "function": "info"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected for unsupported source: %d", w.Code)
+	}
+}
+
+func TestHTTPDestination(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"ground.laz": []byte("ground")}}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	var put, auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		put, auth = r.Method+" "+string(b), r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	userJSON := `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"function": "ground",
+		"destination": {"url": "` + ts.URL + `/out/ground.laz", "headers": {"Authorization": "Bearer xyz"}}
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	if put != "PUT ground" || auth != "Bearer xyz" {
+		t.Errorf("Unexpected upload %q with %q", put, auth)
+	}
+	var res job.OutputMsg
+	json.Unmarshal(w.Body.Bytes(), &res)
+	var dest storage.UploadResult
+	if raw := res.Response["destination"]; raw != nil {
+		json.Unmarshal(*raw, &dest)
+	}
+	if dest.URL != ts.URL+"/out/ground.laz" || dest.Status != http.StatusCreated {
+		t.Errorf("Unexpected destination in response %s", w.Body)
+	}
+	if strings.Contains(w.Body.String(), "Bearer") {
+		t.Errorf("Expected headers not to be echoed, got %s", w.Body)
+	}
+}
+
+func TestInputCache(t *testing.T) {
+	rec := &pdaltest.Recorder{Output: []byte(`{"filename": "samp71-utm.laz"}`)}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := storage.NewCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.InputCache = cache
+	defer func() { storage.InputCache = nil }()
+
+	userJSON := `{
+		"source": {"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+		"function": "info"
+	}`
+	for i := 0; i < 2; i++ {
+		if w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON); w.Code != http.StatusOK {
+			t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+		}
+	}
+	if n := store.Opens("s3://venicegeo-sample-data/pointcloud/samp71-utm.laz"); n != 1 {
+		t.Errorf("Expected a single download, got %d", n)
+	}
+	assertWorkspacesRemoved(t)
+
+	req, _ := http.NewRequest("GET", "/api/v1/metrics", nil)
+	w := serve(MetricsHandler, req)
+	var m Metrics
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.InputCache == nil || m.InputCache.Hits != 1 || m.InputCache.Misses != 1 {
+		t.Errorf("Unexpected metrics %s", w.Body)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"upload_file-0.laz": []byte("cropped")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"pipeline": [
+			{"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+			{"type": "filters.crop", "bounds": "([0,1],[0,1])"},
+			"s3://venicegeo-sample-data/temp/cropped.laz"
+		]
+	}`
+	w := post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"location":"s3://venicegeo-sample-data/temp/cropped.laz"`) {
+		t.Errorf("Unexpected response %s", w.Body)
+	}
+	if b, ok := store.Get("s3://venicegeo-sample-data/temp/cropped.laz"); !ok || string(b) != "cropped" {
+		t.Errorf("Expected output to be uploaded, got %q", b)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestAsyncJob(t *testing.T) {
+	rec := &pdaltest.Recorder{Output: []byte(`{"filename": "samp71-utm.laz"}`)}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source": {"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+		"function": "info"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal", userJSON)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("StatusAccepted expected: %d %s", w.Code, w.Body)
+	}
+	var accepted Job
+	if err := json.Unmarshal(w.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	if accepted.Status != StatusQueued {
+		t.Errorf("Expected queued job, got %s", accepted.Status)
+	}
+	if loc := w.Header().Get("Location"); loc != "/api/v1/jobs/"+accepted.ID {
+		t.Errorf("Unexpected Location %q", loc)
+	}
+
+	var j Job
+	for i := 0; i < 100; i++ {
+		j, _ = Jobs.Get(accepted.ID)
+		if j.Finished() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if j.Status != StatusSucceeded || j.Code != http.StatusOK {
+		t.Errorf("Expected job to succeed, got %+v", j)
+	}
+	if j.Response == nil || j.Response["filename"] == nil {
+		t.Errorf("Expected info output in job response, got %v", j.Response)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source": {"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+		"function": "radius",
+		"options": {"radius": -1, "neighbours": 2}
+	}`
+	w := post(PdalHandler, "/api/v1/pdal", userJSON)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("StatusBadRequest expected: %d", w.Code)
+	}
+	for _, want := range []string{`"field":"radius"`, `"field":"neighbours"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in %s", want, w.Body)
+		}
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("PDAL should not be called with invalid options")
+	}
+}
+
+func TestPdalFailure(t *testing.T) {
+	rec := &pdaltest.Recorder{
+		ExitCode: 1,
+		Stderr:   []byte("(pdal info Debug) Debugging...\nPDAL: readers.las: Invalid file signature.\n"),
+	}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source": {"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+		"function": "info"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("StatusBadRequest expected: %d", w.Code)
+	}
+
+	var out struct {
+		Error functions.PdalError
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Error.Code != functions.ErrInvalidInput || out.Error.Stage != "readers.las" ||
+		out.Error.ExitCode != 1 || len(out.Error.Stderr) != 1 {
+		t.Errorf("Unexpected error %+v", out.Error)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	rec := &pdaltest.Recorder{Delay: time.Minute}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source": {"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+		"function": "info",
+		"timeout": 0.05
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("StatusGatewayTimeout expected: %d %s", w.Code, w.Body)
+	}
+	var out struct {
+		Error functions.TimeoutError
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Error.Code != functions.ErrTimeout || out.Error.Timeout != 0.05 {
+		t.Errorf("Unexpected error %+v", out.Error)
+	}
+	assertWorkspacesRemoved(t)
+
+	for _, timeout := range []string{"0", "-1", "1e9"} {
+		userJSON := `{
+			"source": {"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+			"function": "info",
+			"timeout": ` + timeout + `
+		}`
+		w := post(PdalHandler, "/api/v1/pdal", userJSON)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("timeout %s: StatusBadRequest expected: %d", timeout, w.Code)
+		}
+	}
+}
+
+// this is specific to our service, it stays
+func TestNoFunctionField(t *testing.T) {
+	userJSON := `{
+		"source":
+		{
+			"bucket": "venicegeo-sample-data",
+			"key": "pointcloud/samp71-utm.laz"
+		},
+		"fail": "info"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal", userJSON)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected: %d", w.Code)
+	}
+}
+
+// also specific to our service, it too stays
+func TestBadFunction(t *testing.T) {
+	userJSON := `{
+		"source":
+		{
+			"bucket": "venicegeo-sample-data",
+			"key": "pointcloud/samp71-utm.laz"
+		},
+		"function": "fail"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal", userJSON)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected: %d", w.Code)
+	}
+}
+
+func TestBadBucket(t *testing.T) {
+	_, teardown := setup(t, &pdaltest.Recorder{})
+	defer teardown()
+
+	userJSON := `{
+		"source":
+		{
+			"bucket": "bad-bucket",
+			"key": "pointcloud/samp71-utm.laz"
+		},
+		"function": "info"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("StatusInternalServerError expected: %d", w.Code)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestBadKey(t *testing.T) {
+	_, teardown := setup(t, &pdaltest.Recorder{})
+	defer teardown()
+
+	userJSON := `{
+		"source":
+		{
+			"bucket": "venicegeo-sample-data",
+			"key": "bad-folder/bad-file"
+		},
+		"function": "info"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("StatusInternalServerError expected: %d", w.Code)
+	}
+}
+
+func TestEmptyJSON(t *testing.T) {
+	w := post(PdalHandler, "/api/v1/pdal", `{}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected: %d", w.Code)
+	}
+}
+
+func TestNoJSON(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/api/v1/pdal", nil)
+	w := serve(PdalHandler, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected: %d", w.Code)
+	}
+}
+
+func TestUnknownJob(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/v1/jobs/nope", nil)
+	w := httptest.NewRecorder()
+	if e := JobHandler(w, req, nil); e == nil || e.Code != http.StatusNotFound {
+		t.Errorf("StatusNotFound expected: %v", e)
+	}
+}
@@ -18,249 +18,447 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-pdal/storage"
 )
 
-var readerNum int
+// pipelineWeight is the weight of a pipeline in the worker pool.
+const pipelineWeight = 2
 
-func inferAndDownload(rawurl *url.URL) (name string, size int64, err error) {
-	switch rawurl.Scheme {
-	case "s3":
-		bucket := rawurl.Host
-		key := strings.TrimLeft(rawurl.Path, "/")
-		ext := filepath.Ext(key)
+/*
+PipelineStages lists the types of stage that pipelines may use. An entry
+ending in ".*", e.g., "filters.*", allows every stage of that kind. Stages
+that reach beyond the job's workspace (e.g., databases) or run code (e.g.,
+filters.python) are deliberately absent. It may be replaced, e.g., from
+configuration, before any requests are served.
+*/
+var PipelineStages = []string{
+	"readers.bpf", "readers.las", "readers.ply", "readers.qfit", "readers.sbet",
+	"readers.terrasolid", "readers.text",
+	"filters.assign", "filters.chipper", "filters.crop", "filters.dartsample",
+	"filters.decimation", "filters.divider", "filters.elm", "filters.ferry",
+	"filters.ground", "filters.height", "filters.hexbin", "filters.merge",
+	"filters.outlier", "filters.pmf", "filters.radiusoutlier", "filters.range",
+	"filters.reprojection", "filters.sample", "filters.smrf", "filters.sort",
+	"filters.splitter", "filters.statisticaloutlier", "filters.stats",
+	"filters.transformation", "filters.voxelgrid",
+	"writers.bpf", "writers.gdal", "writers.las", "writers.null", "writers.p2g",
+	"writers.ply", "writers.text", "writers.vo",
+}
 
-		fname := "download_file-" + strconv.Itoa(readerNum) + ext
-		readerNum++
-		file, err := os.Create(fname)
-		if err != nil {
-			return "", 0, err
+// stageAllowed reports whether PipelineStages allows stages of type t.
+func stageAllowed(t string) bool {
+	for _, s := range PipelineStages {
+		if s == t || (strings.HasSuffix(s, ".*") && strings.HasPrefix(t, strings.TrimSuffix(s, "*"))) {
+			return true
 		}
-		defer file.Close()
+	}
+	return false
+}
 
-		downloader := s3manager.NewDownloader(session.New(&aws.Config{Region: aws.String("us-east-1")}))
-		numBytes, err := downloader.Download(file, &s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		})
-		if err != nil {
-			return "", 0, err
-		}
-		return file.Name(), numBytes, nil
-	case "http", "https":
-		client := &http.Client{}
+// Kinds of pipeline stage.
+const (
+	stageReader = "reader"
+	stageFilter = "filter"
+	stageWriter = "writer"
+)
 
-		req, err := http.NewRequest("GET", rawurl.String(), nil)
+/*
+pipelineStage is a stage of a submitted pipeline.
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return "", 0, err
-		}
-		defer resp.Body.Close()
-		ext := filepath.Ext(rawurl.String())
+Stages given as storage locations, i.e., as URLs or as objects with "bucket"
+and "key" or "url", are read from a download in the job's workspace or, if
+last, written there and uploaded. Any other stage is a PDAL stage object,
+whose filename is either a file in the workspace or, for readers and writers,
+a storage location to download from or upload to.
+*/
+type pipelineStage struct {
+	kind   string
+	ref    storage.Ref
+	object map[string]interface{}
+}
 
-		fname := "download_file-" + strconv.Itoa(readerNum) + ext
-		readerNum++
-		file, err := os.Create(fname)
-		if err != nil {
-			return "", 0, err
+// stageKind returns the kind of stage of type t (which may be empty). As in
+// PDAL, a stage without a type is a writer if it is the last, and a reader
+// otherwise.
+func stageKind(t string, last bool) string {
+	switch {
+	case strings.HasPrefix(t, "readers."):
+		return stageReader
+	case strings.HasPrefix(t, "writers."):
+		return stageWriter
+	case t != "":
+		return stageFilter
+	case last:
+		return stageWriter
+	}
+	return stageReader
+}
+
+// parsePipeline decodes a submitted pipeline and checks every stage, before
+// anything is downloaded. Every problem found, e.g., each stage that is not
+// allowed, is reported in a ValidationError, along with the stages.
+func parsePipeline(b []byte) ([]pipelineStage, error) {
+	var p struct {
+		Pipeline []json.RawMessage `json:"pipeline"`
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if p.Pipeline == nil {
+		return nil, errors.New("No pipeline key")
+	}
+
+	numStages := len(p.Pipeline)
+	stages := make([]pipelineStage, numStages)
+	var errs functions.ValidationError
+	for k, v := range p.Pipeline {
+		var compactStage bytes.Buffer
+		if err := json.Compact(&compactStage, v); err != nil {
+			return nil, err
+		}
+		field := "pipeline[" + strconv.Itoa(k) + "]"
+		log.Println(field, "of", numStages, "stages parsed as:", compactStage.String())
+
+		last := k == numStages-1
+		var ref storage.Ref
+		if err := json.Unmarshal(v, &ref); err == nil {
+			if err := ref.Check(); err != nil {
+				errs = append(errs, functions.FieldError{Field: field, Message: err.Error()})
+			}
+			stages[k] = pipelineStage{kind: stageKind("", last), ref: ref}
+			continue
 		}
-		defer file.Close()
 
-		numBytes, err := io.Copy(file, resp.Body)
-		if err != nil {
-			return "", 0, err
+		var object map[string]interface{}
+		if err := json.Unmarshal(v, &object); err != nil || object == nil {
+			errs = append(errs, functions.FieldError{Field: field, Message: "must be a storage location or a stage object"})
+			continue
+		}
+		t, ok := object["type"].(string)
+		if _, given := object["type"]; given && (!ok || !stageAllowed(t)) {
+			errs = append(errs, functions.FieldError{Field: field + ".type", Message: fmt.Sprintf("stage %v is not allowed", object["type"])})
 		}
-		return file.Name(), numBytes, nil
-	default:
-		log.Println("other")
-		_, err := os.Stat(rawurl.String())
-		if err == nil {
-			log.Println("File exists")
-		} else if os.IsNotExist(err) {
-			log.Println("File does not exist")
-		} else {
-			return "", 0, err
+		stage := pipelineStage{kind: stageKind(t, last), object: object}
+		if f, ok := object["filename"]; ok {
+			var msg string
+			stage.ref, msg = stageFilename(stage.kind, f)
+			if msg != "" {
+				errs = append(errs, functions.FieldError{Field: field + ".filename", Message: msg})
+			}
 		}
+		stages[k] = stage
+	}
+	if len(errs) > 0 {
+		return stages, errs
 	}
-	return "", 0, nil
+	return stages, nil
 }
 
-func inferAndUpload(file *os.File, rawurl *url.URL) (location string, err error) {
-	switch rawurl.Scheme {
-	case "s3":
-		bucket := rawurl.Host
-		key := strings.TrimLeft(rawurl.Path, "/")
-
-		uploader := s3manager.NewUploader(session.New(&aws.Config{Region: aws.String("us-east-1")}))
-		result, err := uploader.Upload(&s3manager.UploadInput{
-			Body:   file,
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		})
-		if err != nil {
-			return "", err
+// stageFilename checks the filename f of a stage object of the given kind. It
+// returns the storage location that a reader's input is downloaded from, or a
+// writer's output uploaded to, if the filename is one, or else describes what
+// is wrong with the filename, if anything. Otherwise, only files within the
+// job's workspace may be named, so that stages can neither read nor write
+// anything else on the host.
+func stageFilename(kind string, f interface{}) (storage.Ref, string) {
+	name, _ := f.(string)
+	if !strings.Contains(name, "://") {
+		if _, isObject := f.(map[string]interface{}); !isObject {
+			if kind != stageReader && reservedFilename(name) {
+				return storage.Ref{}, "is reserved for the job's own files"
+			}
+			return storage.Ref{}, checkFilename(name)
+		}
+	}
+
+	if kind == stageFilter {
+		return storage.Ref{}, "must name a file in the workspace; only readers and writers may name storage locations"
+	}
+	var ref storage.Ref
+	b, _ := json.Marshal(f)
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return ref, err.Error()
+	}
+	if err := ref.Check(); err != nil {
+		return ref, err.Error()
+	}
+	return ref, ""
+}
+
+// checkFilename describes what is wrong with the name of a file in the
+// workspace, if anything.
+func checkFilename(name string) string {
+	switch {
+	case name == "":
+		return "must be a file name"
+	case name != filepath.Base(name) || name == "." || name == "..":
+		return "must name a file in the workspace, without a directory"
+	}
+	return ""
+}
+
+// reservedFilename reports whether name is that of a file the job itself
+// writes in the workspace (see rewrittenPipeline), which stages must not
+// overwrite.
+func reservedFilename(name string) bool {
+	return strings.HasPrefix(name, "download_file-") || strings.HasPrefix(name, "upload_file-") ||
+		name == "pipeline.json" || name == functions.MetadataFile("pipeline.json")
+}
+
+// writerExts gives the extension of the files written by writers whose
+// destination has none.
+var writerExts = map[string]string{
+	"writers.bpf":  ".bpf",
+	"writers.gdal": ".tif",
+	"writers.las":  ".las",
+	"writers.ply":  ".ply",
+	"writers.text": ".txt",
+}
+
+// transfer is a download to, or upload from, a file in the workspace.
+type transfer struct {
+	ref    storage.Ref
+	name   string
+	writer string
+}
+
+// rewrittenPipeline is a submitted pipeline, ready to run in a workspace.
+type rewrittenPipeline struct {
+	// stages are the stages to run, in which every storage location has been
+	// replaced by a file in the workspace.
+	stages    []interface{}
+	downloads []transfer
+	uploads   []transfer
+}
+
+// MarshalJSON encodes the pipeline as PDAL expects.
+func (p rewrittenPipeline) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"pipeline": p.stages})
+}
+
+// write writes the pipeline to pipeline.json in ws, returning its name.
+func (p rewrittenPipeline) write(ws *Workspace) (string, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	log.Println("Modified pipeline to:", string(b))
+
+	name := ws.Path("pipeline.json")
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		return "", err
+	}
+	log.Println("Wrote", len(b), "bytes to", name)
+	return name, nil
+}
+
+// rewritePipeline replaces every storage location in stages with a file in ws,
+// and names the files in the workspace that stage objects refer to, returning
+// the pipeline along with the downloads and uploads it needs. Inputs and
+// outputs keep the extension of their source or destination, so that PDAL
+// infers the same driver, and an input read by several readers, e.g., to be
+// merged with itself, is downloaded once.
+func rewritePipeline(ws *Workspace, stages []pipelineStage) rewrittenPipeline {
+	var p rewrittenPipeline
+	inputs := make(map[string]string)
+	for _, s := range stages {
+		var name string
+		switch {
+		case !s.ref.IsZero() && s.kind == stageReader:
+			var ok bool
+			if name, ok = inputs[s.ref.String()]; ok {
+				break
+			}
+			name = ws.DownloadPath(path.Ext(s.ref.Base()))
+			inputs[s.ref.String()] = name
+			p.downloads = append(p.downloads, transfer{ref: s.ref, name: name})
+		case !s.ref.IsZero():
+			writer, _ := s.object["type"].(string)
+			ext := path.Ext(s.ref.Base())
+			if ext == "" {
+				ext = writerExts[writer]
+			}
+			if ext == "" {
+				ext = ".laz"
+			}
+			name = ws.UploadPath(ext)
+			p.uploads = append(p.uploads, transfer{ref: s.ref, name: name, writer: writer})
+		case s.object != nil:
+			if f, ok := s.object["filename"].(string); ok {
+				name = ws.Path(f)
+			}
 		}
-		return result.Location, nil
-	case "http", "https":
-		log.Println("Not handled yet")
-	default:
-		log.Println("other")
-		_, err := os.Stat(rawurl.String())
-		if err == nil {
-			log.Println("File exists")
-		} else if os.IsNotExist(err) {
-			log.Println("File does not exist")
-		} else {
-			return "", err
+
+		if s.object == nil {
+			p.stages = append(p.stages, name)
+			continue
+		}
+		object := make(map[string]interface{}, len(s.object))
+		for k, v := range s.object {
+			object[k] = v
 		}
+		if name != "" {
+			object["filename"] = name
+		}
+		p.stages = append(p.stages, object)
 	}
-	return "", nil
+	return p
 }
 
-// PipelineHandler handles PDAL jobs.
-func PipelineHandler(w http.ResponseWriter, r *http.Request) *AppError {
-	readerNum = 0
+// PipelineOutput is a file written by a pipeline and uploaded.
+type PipelineOutput struct {
+	Location string `json:"location"`
+	Status   int    `json:"status,omitempty"`
+	Size     int64  `json:"size"`
+	// Writer is the type of the writer, if given.
+	Writer string `json:"writer,omitempty"`
+	// Points and Bounds are read from the header of LAS and LAZ outputs.
+	Points *uint64           `json:"points,omitempty"`
+	Bounds *functions.Bounds `json:"bounds,omitempty"`
+}
 
+// readPipeline reads the pipeline in the body of r, and logs it.
+func readPipeline(w http.ResponseWriter, r *http.Request) ([]byte, *AppError) {
 	// There should always be a body, else how are we to know what to do? Throw
 	// 400 if missing.
 	if r.Body == nil {
-		return &AppError{nil, "No JSON", http.StatusBadRequest}
+		return nil, &AppError{nil, "No JSON", http.StatusBadRequest}
 	}
+	limitBody(w, r)
 
-	// Throw 500 if we cannot read the body.
+	// Throw 500 if we cannot read the body, or 413 if it is too large.
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+		return nil, bodyError(err)
 	}
 
-	var uploadurl *url.URL
-
 	var compactInput bytes.Buffer
 	err = json.Compact(&compactInput, b)
 	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+		return nil, &AppError{err, err.Error(), http.StatusBadRequest}
 	}
 	log.Println("Received input pipeline of:", compactInput.String())
+	return b, nil
+}
 
-	type pipeline struct {
-		Pipeline []json.RawMessage `json:"pipeline"`
+/*
+PipelineHandler handles PDAL jobs given as pipelines.
+
+Every reader with a storage location for its filename, whether given as a
+string or an object, reads a download of it, and every writer's output that
+has a storage location for its filename, anywhere in the pipeline, is uploaded
+there. The response lists the uploads as "outputs", and gives the last as
+"location", with its "status". It also gives the "pipeline" that was run, with
+the files in the workspace that replaced storage locations, and its
+"metadata", as functions.Metadata describes, whose output is the last upload.
+*/
+func PipelineHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	b, e := readPipeline(w, r)
+	if e != nil {
+		return e
 	}
+	return runPipeline(w, r, b)
+}
 
-	var p pipeline
-	err = json.Unmarshal(b, &p)
+// runPipeline checks and runs the pipeline b, as PipelineHandler describes,
+// for the request r.
+func runPipeline(w http.ResponseWriter, r *http.Request, b []byte) *AppError {
+	// Throw 400, listing every problem, if any stage is not allowed.
+	stages, err := parsePipeline(b)
 	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+		return &AppError{err, err.Error(), http.StatusBadRequest}
 	}
-	if p.Pipeline == nil {
-		return &AppError{err, "No pipeline key", http.StatusInternalServerError}
-	}
-
-	var q pipeline
-
-	numStages := len(p.Pipeline)
-
-	for k, v := range p.Pipeline {
-		var compactStage bytes.Buffer
-		err := json.Compact(&compactStage, v)
-		if err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
-		}
-		log.Println("Stage", k+1, "of", numStages, "parsed as:", compactStage.String())
 
-		var vv string
-		err = json.Unmarshal(v, &vv)
-		if err != nil {
-			q.Pipeline = append(q.Pipeline, v)
-		} else {
-			if k < numStages-1 {
-				s3url, err := url.Parse(vv)
-				if err != nil {
-					return &AppError{err, err.Error(), http.StatusInternalServerError}
-				}
-
-				name, numBytes, err := inferAndDownload(s3url)
-				if err != nil {
-					return &AppError{err, err.Error(), http.StatusInternalServerError}
-				}
-				log.Println("Downloaded", name, numBytes, "bytes")
-				q.Pipeline = append(q.Pipeline, json.RawMessage("\""+name+"\""))
-			} else {
-				uploadurl, err = url.Parse(vv)
-				if err != nil {
-					return &AppError{err, err.Error(), http.StatusInternalServerError}
-				}
-
-				q.Pipeline = append(q.Pipeline, json.RawMessage("\"upload_file.laz\""))
-			}
-		}
-	}
-	b, err = json.Marshal(q)
+	// Pipelines may do anything, so they count as a heavy function.
+	t, err := Workers.Reserve(pipelineWeight)
 	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+		return poolFullError(w)
 	}
-
-	var compactModified bytes.Buffer
-	err = json.Compact(&compactModified, b)
-	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	defer t.Release()
+	if err := t.Wait(r.Context()); err != nil {
+		return &AppError{err, err.Error(), http.StatusServiceUnavailable}
 	}
-	log.Println("Modified pipeline to:", compactModified.String())
 
-	pipe, err := os.Create("pipeline.json")
+	ws, err := NewWorkspace()
 	if err != nil {
 		return &AppError{err, err.Error(), http.StatusInternalServerError}
 	}
-	defer pipe.Close()
-	n, err := compactModified.WriteTo(pipe)
-	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
-	}
-	log.Println("Wrote", n, "bytes to", pipe.Name())
-
-	var args []string
-	args = append(args, "pipeline")
-	args = append(args, pipe.Name())
-	args = append(args, "-v", "10", "--debug")
+	defer ws.Remove()
 
-	outcmd, err := exec.Command("pdal", args...).CombinedOutput()
+	// Downloads and PDAL are abandoned if the client goes away, or if they
+	// take too long.
+	ctx, cancel := context.WithTimeout(r.Context(), functions.DefaultTimeout)
+	defer cancel()
 
-	log.Println(string(outcmd))
-	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	p := rewritePipeline(ws, stages)
+	for _, d := range p.downloads {
+		numBytes, err := storage.Download(ctx, d.ref, d.name)
+		if err != nil {
+			err = contextError(ctx, err)
+			return &AppError{err, err.Error(), errorStatus(err)}
+		}
+		log.Println("Downloaded", numBytes, "bytes from", d.ref)
 	}
 
-	file, err := os.Open("upload_file.laz")
+	name, err := p.write(ws)
 	if err != nil {
 		return &AppError{err, err.Error(), http.StatusInternalServerError}
 	}
-	defer file.Close()
 
-	location, err := inferAndUpload(file, uploadurl)
+	outcmd, err := functions.PDAL.Run(ctx, "pipeline", name, "--metadata", functions.MetadataFile(name), "-v", "10", "--debug")
+
+	log.Println(string(outcmd))
 	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+		return &AppError{err, err.Error(), errorStatus(err)}
 	}
-	log.Println("Uploaded to", location)
 
 	type locationResult struct {
-		Location string `json:"location"`
+		Location string              `json:"location"`
+		Status   int                 `json:"status,omitempty"`
+		Outputs  []PipelineOutput    `json:"outputs,omitempty"`
+		Pipeline []interface{}       `json:"pipeline"`
+		Metadata *functions.Metadata `json:"metadata"`
+	}
+	result := locationResult{Pipeline: p.stages, Metadata: functions.CollectMetadata(name, "")}
+	for _, u := range p.uploads {
+		// The summary is a courtesy, so failing to make one fails nothing.
+		summary, err := functions.SummarizeOutput(u.name)
+		if err != nil {
+			log.Println("Error summarizing", u.name, err)
+			summary = &functions.Summary{}
+		}
+		result.Metadata.Output = summary
+		result.Metadata.Outputs = append(result.Metadata.Outputs, summary)
+
+		uploaded, err := storage.Upload(ctx, u.name, u.ref)
+		if err != nil {
+			err = contextError(ctx, err)
+			return &AppError{err, err.Error(), errorStatus(err)}
+		}
+		log.Println("Uploaded", uploaded.Size, "bytes to", uploaded.URL)
+		result.Location, result.Status = uploaded.URL, uploaded.Status
+		result.Outputs = append(result.Outputs, PipelineOutput{
+			Location: uploaded.URL,
+			Status:   uploaded.Status,
+			Size:     uploaded.Size,
+			Writer:   u.writer,
+			Points:   summary.Points,
+			Bounds:   summary.Bounds,
+		})
 	}
-	result := locationResult{Location: location}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,279 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+)
+
+func TestPipelineSandbox(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"pipeline": [
+			{"type": "readers.las", "filename": "/etc/passwd"},
+			{"type": "filters.python", "script": "evil.py"},
+			{"type": "filters.crop", "bounds": "([0,1],[0,1])"},
+			{"type": "readers.pgpointcloud"},
+			{"type": "writers.las", "filename": "../../app.go"},
+			"ftp://host/out.laz"
+		]
+	}`
+	w := post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("StatusBadRequest expected: %d %s", w.Code, w.Body)
+	}
+	for _, want := range []string{"pipeline[0].filename", "pipeline[1].type", "filters.python",
+		"pipeline[3].type", "pipeline[4].filename", "pipeline[5]"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in response %s", want, w.Body)
+		}
+	}
+	if strings.Contains(w.Body.String(), "pipeline[2]") {
+		t.Errorf("Expected filters.crop to be allowed, got %s", w.Body)
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("Expected PDAL not to be run")
+	}
+
+	// Nor may stages overwrite the job's own files, e.g., a cached download.
+	userJSON = `{
+		"pipeline": [
+			"s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+			{"type": "writers.las", "filename": "download_file-0.laz"},
+			{"type": "writers.text", "filename": "pipeline.json"}
+		]
+	}`
+	w = post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("StatusBadRequest expected: %d %s", w.Code, w.Body)
+	}
+	for _, want := range []string{"pipeline[1].filename", "pipeline[2].filename"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in response %s", want, w.Body)
+		}
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("Expected PDAL not to be run")
+	}
+
+	// Files named by stage objects are found in the workspace.
+	userJSON = `{
+		"pipeline": [
+			{"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+			{"type": "filters.range", "limits": "Classification[2:2]"},
+			{"type": "writers.las", "filename": "ground.laz"}
+		]
+	}`
+	w = post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	p := string(rec.LastPipeline())
+	if !strings.Contains(p, `"filename":"`+filepath.Join(WorkspaceRoot, "job-")) {
+		t.Errorf("Expected the writer to be rewritten into the workspace, got %s", p)
+	}
+	assertWorkspacesRemoved(t)
+
+	orig := PipelineStages
+	PipelineStages = []string{"readers.*", "filters.*"}
+	defer func() { PipelineStages = orig }()
+	w = post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "pipeline[2].type") {
+		t.Errorf("StatusBadRequest for writers.las expected: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPipelineWriters(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{
+		"upload_file-0.tif": []byte("dem"),
+		"upload_file-1.las": []byte("ground"),
+		"upload_file-2.laz": []byte("other"),
+	}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"pipeline": [
+			{"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+			{"type": "writers.gdal", "resolution": 1, "filename": "s3://venicegeo-sample-data/temp/dem"},
+			{"type": "filters.range", "limits": "Classification[2:2]"},
+			{"type": "writers.las", "filename": {"bucket": "venicegeo-sample-data", "key": "temp/ground.las"}},
+			{"type": "filters.range", "limits": "Classification![2:2]"},
+			"s3://venicegeo-sample-data/temp/other.laz"
+		]
+	}`
+	w := post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	var res struct {
+		Location string
+		Outputs  []PipelineOutput
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Location != "s3://venicegeo-sample-data/temp/other.laz" || len(res.Outputs) != 3 {
+		t.Fatalf("Unexpected response %s", w.Body)
+	}
+	want := []PipelineOutput{
+		{Location: "s3://venicegeo-sample-data/temp/dem", Size: 3, Writer: "writers.gdal"},
+		{Location: "s3://venicegeo-sample-data/temp/ground.las", Size: 6, Writer: "writers.las"},
+		{Location: "s3://venicegeo-sample-data/temp/other.laz", Size: 5},
+	}
+	contents := []string{"dem", "ground", "other"}
+	for i, o := range res.Outputs {
+		if o.Location != want[i].Location || o.Size != want[i].Size || o.Writer != want[i].Writer {
+			t.Errorf("Expected output %d to be %+v, got %+v", i, want[i], o)
+		}
+		if b, ok := store.Get(o.Location); !ok || string(b) != contents[i] {
+			t.Errorf("Expected %s to be uploaded, got %q", o.Location, b)
+		}
+	}
+	p := string(rec.LastPipeline())
+	for _, name := range []string{"upload_file-0.tif", "upload_file-1.las", "upload_file-2.laz"} {
+		if !strings.Contains(p, name) {
+			t.Errorf("Expected %s in pipeline %s", name, p)
+		}
+	}
+	assertWorkspacesRemoved(t)
+
+	// Only readers and writers may name storage locations.
+	userJSON = `{
+		"pipeline": [
+			{"type": "readers.las", "filename": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz"},
+			{"type": "filters.crop", "filename": "https://example.com/x"},
+			"out.laz"
+		]
+	}`
+	w = post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "pipeline[1].filename") {
+		t.Errorf("StatusBadRequest for filters.crop expected: %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "pipeline[0]") {
+		t.Errorf("Expected readers.las to be allowed, got %s", w.Body)
+	}
+}
+
+func TestPipelineReaders(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"upload_file-0.laz": []byte("merged")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+	store.Put("s3://venicegeo-sample-data/pointcloud/samp11-utm.las", []byte("fake las"))
+
+	userJSON := `{
+		"pipeline": [
+			{"type": "readers.las", "filename": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz"},
+			{"filename": {"bucket": "venicegeo-sample-data", "key": "pointcloud/samp11-utm.las"}},
+			{"type": "readers.las", "filename": {"url": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz"}},
+			{"type": "filters.merge"},
+			"s3://venicegeo-sample-data/temp/merged.laz"
+		]
+	}`
+	w := post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	var res struct {
+		Location string
+		Pipeline []interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Location != "s3://venicegeo-sample-data/temp/merged.laz" || len(res.Pipeline) != 5 {
+		t.Fatalf("Unexpected response %s", w.Body)
+	}
+
+	// Each input is downloaded once, and read from the workspace.
+	for url, n := range map[string]int{
+		"s3://venicegeo-sample-data/pointcloud/samp71-utm.laz": 1,
+		"s3://venicegeo-sample-data/pointcloud/samp11-utm.las": 1,
+	} {
+		if store.Opens(url) != n {
+			t.Errorf("Expected %s to be downloaded %d times, got %d", url, n, store.Opens(url))
+		}
+	}
+	want := []string{"download_file-0.laz", "download_file-1.las", "download_file-0.laz"}
+	for i, name := range want {
+		stage, _ := res.Pipeline[i].(map[string]interface{})
+		if f, _ := stage["filename"].(string); filepath.Base(f) != name {
+			t.Errorf("Expected reader %d to read %s, got %v", i, name, res.Pipeline[i])
+		}
+	}
+	if !strings.Contains(string(rec.LastPipeline()), "download_file-1.las") {
+		t.Errorf("Expected the rewritten pipeline to be run, got %s", rec.LastPipeline())
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestPipelineMetadata(t *testing.T) {
+	rec := &pdaltest.Recorder{
+		Files: map[string][]byte{
+			"upload_file-0.las": pdaltest.LASHeader(7, [6]float64{0, 0, 0, 1, 1, 1}),
+			"upload_file-1.laz": pdaltest.LASHeader(3, [6]float64{0, 0, 0, 2, 2, 2}),
+		},
+		Metadata: []byte(`{"stages": {"readers.las": {"count": 10}, "filters.range": [{}, {}], "writers.las": [{}, {}]}}`),
+	}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"pipeline": [
+			"s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+			{"type": "filters.range", "limits": "Classification[2:2]"},
+			{"type": "writers.las", "filename": "s3://venicegeo-sample-data/temp/ground.las"},
+			{"type": "filters.range", "limits": "Classification![2:2]"},
+			"s3://venicegeo-sample-data/temp/other.laz"
+		]
+	}`
+	w := post(PipelineHandler, "/api/v1/pipeline", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	var res struct {
+		Outputs  []PipelineOutput
+		Metadata functions.Metadata
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Outputs) != 2 || *res.Outputs[0].Points != 7 || *res.Outputs[1].Points != 3 || res.Outputs[1].Bounds.MaxX != 2 {
+		t.Errorf("Expected the points of each output, got %s", w.Body)
+	}
+	m := res.Metadata
+	if m.Input == nil || *m.Input.Points != 10 || m.Output == nil || *m.Output.Points != 3 || len(m.Stages) != 3 {
+		t.Errorf("Expected the metadata of the run, got %s", w.Body)
+	}
+	if len(m.Outputs) != 2 || *m.Outputs[0].Points != 7 || *m.Outputs[1].Points != 3 || m.Outputs[0].Size == 0 {
+		t.Errorf("Expected every output to be summarized, got %s", w.Body)
+	}
+	if args := strings.Join(rec.Last(), " "); !strings.Contains(args, "--metadata") {
+		t.Errorf("Expected PDAL to write metadata, got %s", args)
+	}
+	assertWorkspacesRemoved(t)
+}
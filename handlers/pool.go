@@ -0,0 +1,199 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrPoolFull is returned when no more work can be queued.
+var ErrPoolFull = errors.New("Too many jobs are queued, try again later")
+
+// RetryAfter is suggested to clients whose work was turned away.
+var RetryAfter = 30 * time.Second
+
+/*
+Pool limits the PDAL work that runs at once.
+
+Work has a weight, so that, e.g., ground counts for more than info. Work runs
+only while the total weight running is within the maximum number of workers,
+and otherwise waits in FIFO order. Once the queue is full, more work is turned
+away.
+*/
+type Pool struct {
+	mu         sync.Mutex
+	maxWorkers int
+	maxQueue   int
+	active     int // total weight running
+	running    int
+	waiting    list.List // of *Ticket
+}
+
+// NewPool constructs a Pool running at most maxWorkers weight of work, with at
+// most maxQueue pieces of work waiting.
+func NewPool(maxWorkers, maxQueue int) *Pool {
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	if maxQueue < 0 {
+		maxQueue = 0
+	}
+	return &Pool{maxWorkers: maxWorkers, maxQueue: maxQueue}
+}
+
+// Workers is the Pool through which all PDAL work is run.
+var Workers = NewPool(runtime.NumCPU(), 100)
+
+// Ticket is a place in the Pool, held from Reserve until Release.
+type Ticket struct {
+	pool    *Pool
+	weight  int
+	ready   chan struct{}
+	elem    *list.Element
+	started bool
+}
+
+/*
+Reserve takes a place in the queue for work of the given weight, returning
+ErrPoolFull if the queue is full. The work may start at once if nothing else
+is waiting.
+
+Weights below 1 count as 1, and weights over the maximum number of workers
+count as that maximum, so that all work can eventually run.
+*/
+func (p *Pool) Reserve(weight int) (*Ticket, error) {
+	if weight < 1 {
+		weight = 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if weight > p.maxWorkers {
+		weight = p.maxWorkers
+	}
+
+	t := &Ticket{pool: p, weight: weight, ready: make(chan struct{})}
+	if p.waiting.Len() == 0 && p.active+weight <= p.maxWorkers {
+		p.start(t)
+		return t, nil
+	}
+	if p.waiting.Len() >= p.maxQueue {
+		return nil, ErrPoolFull
+	}
+	t.elem = p.waiting.PushBack(t)
+	return t, nil
+}
+
+// start runs t. The caller must hold p.mu.
+func (p *Pool) start(t *Ticket) {
+	p.active += t.weight
+	p.running++
+	t.started = true
+	close(t.ready)
+}
+
+// startWaiting runs as much waiting work as now fits, in order. The caller
+// must hold p.mu.
+func (p *Pool) startWaiting() {
+	for e := p.waiting.Front(); e != nil; e = p.waiting.Front() {
+		t := e.Value.(*Ticket)
+		if p.active+t.weight > p.maxWorkers {
+			return
+		}
+		p.waiting.Remove(e)
+		t.elem = nil
+		p.start(t)
+	}
+}
+
+// Wait blocks until the work may start. If ctx is done first, the ticket is
+// released and the reason returned.
+func (t *Ticket) Wait(ctx context.Context) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		t.Release()
+		return ctx.Err()
+	}
+}
+
+// Release gives up the ticket's place, whether or not the work has started.
+// It is safe to call more than once.
+func (t *Ticket) Release() {
+	p := t.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case t.elem != nil:
+		p.waiting.Remove(t.elem)
+		t.elem = nil
+	case t.started:
+		p.active -= t.weight
+		p.running--
+		t.started = false
+	default:
+		return
+	}
+	p.startWaiting()
+}
+
+// PoolStats describes the state of a Pool.
+type PoolStats struct {
+	MaxWorkers int `json:"max_workers"`
+	MaxQueue   int `json:"max_queue"`
+	Active     int `json:"active_workers"`
+	Running    int `json:"running"`
+	Queued     int `json:"queued"`
+}
+
+// Stats returns the current state of the Pool.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		MaxWorkers: p.maxWorkers,
+		MaxQueue:   p.maxQueue,
+		Active:     p.active,
+		Running:    p.running,
+		Queued:     p.waiting.Len(),
+	}
+}
+
+// poolFullError turns work away with 429 Too Many Requests, suggesting when
+// to retry.
+func poolFullError(w http.ResponseWriter) *AppError {
+	w.Header().Set("Retry-After", strconv.Itoa(int(RetryAfter.Seconds())))
+	return &AppError{ErrPoolFull, ErrPoolFull.Error(), http.StatusTooManyRequests}
+}
+
+// QueueHandler reports the state of the worker pool.
+func QueueHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(Workers.Stats()); err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+)
+
+func started(t *Ticket) bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPool(t *testing.T) {
+	p := NewPool(3, 2)
+
+	heavy, _ := p.Reserve(2)
+	light, _ := p.Reserve(1)
+	if !started(heavy) || !started(light) {
+		t.Fatal("Expected work within capacity to start at once")
+	}
+
+	// Work waits in order, even if later work would fit.
+	next, _ := p.Reserve(2)
+	after, _ := p.Reserve(1)
+	if started(next) || started(after) {
+		t.Error("Expected work beyond capacity to wait")
+	}
+	if _, err := p.Reserve(1); err != ErrPoolFull {
+		t.Errorf("Expected ErrPoolFull, got %v", err)
+	}
+	if s := p.Stats(); s.Active != 3 || s.Running != 2 || s.Queued != 2 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	light.Release()
+	if started(next) {
+		t.Error("Expected heavy work to wait for two workers")
+	}
+	heavy.Release()
+	if !started(next) || !started(after) {
+		t.Error("Expected waiting work to start once workers are free")
+	}
+
+	// Cancelled work gives up its place in the queue.
+	waiting, _ := p.Reserve(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waiting.Wait(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	next.Release()
+	after.Release()
+	after.Release()
+	if s := p.Stats(); s.Active != 0 || s.Running != 0 || s.Queued != 0 {
+		t.Errorf("Expected an idle pool, got %+v", s)
+	}
+
+	// Weights are capped at the pool's capacity, so that they can run.
+	huge, _ := p.Reserve(10)
+	if !started(huge) {
+		t.Error("Expected oversized work to start in an idle pool")
+	}
+}
+
+func TestPoolFull(t *testing.T) {
+	rec := &pdaltest.Recorder{Delay: time.Minute}
+	_, teardown := setup(t, rec)
+	defer teardown()
+	origWorkers := Workers
+	Workers = NewPool(1, 0)
+	defer func() { Workers = origWorkers }()
+
+	busy, _ := Workers.Reserve(1)
+	defer busy.Release()
+
+	userJSON := `{
+		"source": {"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+		"function": "info"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal", userJSON)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("StatusTooManyRequests expected: %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+
+	// Validating a pipeline also runs PDAL, so waits for a worker too.
+	w = post(ValidatePipelineHandler, "/api/v1/pipeline/validate", `{"pipeline": ["s3://venicegeo-sample-data/pointcloud/samp71-utm.laz"]}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("StatusTooManyRequests expected: %d %s", w.Code, w.Body)
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("Expected PDAL not to run")
+	}
+}
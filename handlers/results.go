@@ -0,0 +1,317 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/storage"
+)
+
+// Results, if set, remembers the results of jobs, so that identical jobs are
+// answered without running PDAL.
+var Results *ResultCache
+
+/*
+ResultCache remembers the results of jobs on disk.
+
+A job's result is keyed by its source and the version of the source (its ETag
+or, failing that, its size and modification time), its functions and their
+normalized options, the format of its output, and the version of PDAL. Each
+entry holds the job's response and, for functions that produce a file, a copy
+of the file, so that it can be returned again or uploaded to a new
+destination.
+
+Entries survive restarts, but those recorded by another version of PDAL are
+discarded. Once the cache holds more than its maximum size, the least recently
+used entries are evicted.
+*/
+type ResultCache struct {
+	dir         string
+	maxSize     int64
+	pdalVersion string
+
+	mu        sync.Mutex
+	entries   map[string]*resultEntry
+	lru       list.List // of *resultEntry, most recently used first
+	size      int64
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// resultEntry is a remembered result, stored as <key>.json, with any output
+// file stored alongside as <key>.out.
+type resultEntry struct {
+	Key         string `json:"key"`
+	PDALVersion string `json:"pdal_version"`
+	// Response is the response of the job that was run.
+	Response map[string]*json.RawMessage `json:"response,omitempty"`
+	// File records whether the output file was kept.
+	File bool  `json:"file"`
+	Size int64 `json:"size"`
+
+	elem *list.Element
+}
+
+// NewResultCache constructs a ResultCache holding at most maxSize bytes of
+// output in dir, for the given version of PDAL. Entries left in dir by a
+// previous ResultCache are kept, unless they were recorded by another version.
+func NewResultCache(dir string, maxSize int64, pdalVersion string) (*ResultCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &ResultCache{
+		dir:         dir,
+		maxSize:     maxSize,
+		pdalVersion: pdalVersion,
+		entries:     make(map[string]*resultEntry),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Oldest first, so that the most recently used end up at the front.
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		key := strings.TrimSuffix(fi.Name(), ".json")
+		e, err := c.load(key)
+		if err != nil || e.PDALVersion != pdalVersion {
+			c.remove(key)
+			continue
+		}
+		e.elem = c.lru.PushFront(e)
+		c.entries[key] = e
+		c.size += e.Size
+	}
+	c.evict()
+	return c, nil
+}
+
+// load reads the entry for key from disk, checking that its output is there.
+func (c *ResultCache) load(key string) (*resultEntry, error) {
+	b, err := ioutil.ReadFile(c.path(key, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	var e resultEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	if e.File {
+		if _, err := os.Stat(c.path(key, ".out")); err != nil {
+			return nil, err
+		}
+	}
+	e.Key = key
+	return &e, nil
+}
+
+func (c *ResultCache) path(key, ext string) string {
+	return filepath.Join(c.dir, key+ext)
+}
+
+// remove deletes the files of the entry for key.
+func (c *ResultCache) remove(key string) {
+	for _, ext := range []string{".json", ".out"} {
+		if err := os.Remove(c.path(key, ext)); err != nil && !os.IsNotExist(err) {
+			log.Println("Error removing cached result", err)
+		}
+	}
+}
+
+// resultKey returns the key for the result of running ch on behalf of msg,
+// writing output, or false if the result cannot be remembered, e.g., because
+// the version of the source is unknown.
+func (c *ResultCache) resultKey(ctx context.Context, ch chain, msg InputMsg, output string) (string, bool) {
+	if msg.input != "" {
+		return "", false
+	}
+	info, err := storage.StatRef(ctx, msg.Source)
+	if err != nil || info.Version() == "" {
+		return "", false
+	}
+	parts := []string{msg.Source.URL, info.Version(), filepath.Ext(output), c.pdalVersion}
+	for _, l := range ch {
+		opts, err := l.fn.ParseOptions(l.options)
+		if err != nil {
+			return "", false
+		}
+		normalized, err := json.Marshal(opts)
+		if err != nil {
+			return "", false
+		}
+		parts = append(parts, l.fn.Name, string(normalized))
+	}
+	// Chains report their steps, so are not interchangeable with a function.
+	if len(msg.Steps) > 0 {
+		parts = append(parts, "steps")
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// get returns the entry for key, linking any output file it holds to output.
+func (c *ResultCache) get(key, output string) (*resultEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	if e.File {
+		if err := linkOrCopy(c.path(key, ".out"), output); err != nil {
+			log.Println("Error restoring cached result", err)
+			c.misses++
+			return nil, false
+		}
+	}
+	c.hits++
+	c.lru.MoveToFront(e.elem)
+	now := time.Now()
+	os.Chtimes(c.path(key, ".json"), now, now)
+	return e, true
+}
+
+// put remembers the response of running ch, keeping a copy of its output
+// file, if it produces one.
+func (c *ResultCache) put(key string, ch chain, msg InputMsg, response map[string]*json.RawMessage, output string) {
+	e := &resultEntry{
+		Key:         key,
+		PDALVersion: c.pdalVersion,
+		Response:    response,
+	}
+	if ch.producesFile() {
+		fi, err := os.Stat(output)
+		if err != nil || fi.Size() > c.maxSize {
+			return
+		}
+		if err := linkOrCopy(output, c.path(key, ".out")); err != nil {
+			log.Println("Error caching result", err)
+			return
+		}
+		e.File, e.Size = true, fi.Size()
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		err = ioutil.WriteFile(c.path(key, ".json.part"), b, 0644)
+	}
+	if err == nil {
+		err = os.Rename(c.path(key, ".json.part"), c.path(key, ".json"))
+	}
+	if err != nil {
+		log.Println("Error caching result", err)
+		c.remove(key)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		c.lru.Remove(old.elem)
+		c.size -= old.Size
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	c.size += e.Size
+	c.evict()
+}
+
+// evict removes the least recently used entries until the cache is within
+// its maximum size. The caller must hold c.mu.
+func (c *ResultCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		e := c.lru.Remove(c.lru.Back()).(*resultEntry)
+		delete(c.entries, e.Key)
+		c.remove(e.Key)
+		c.size -= e.Size
+		c.evictions++
+	}
+}
+
+// Stats returns the current state of the ResultCache.
+func (c *ResultCache) Stats() storage.CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return storage.CacheStats{
+		MaxSize:   c.maxSize,
+		Size:      c.size,
+		Entries:   c.lru.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// replay answers msg with the remembered result e, whose output, if any, has
+// been restored to output. The output is uploaded to the destination every
+// time, even if it is that of the job that was run, as the object there may
+// since have been changed or removed.
+func replay(ctx context.Context, e *resultEntry, msg InputMsg, output string) (map[string]*json.RawMessage, error) {
+	response := make(map[string]*json.RawMessage, len(e.Response))
+	for k, v := range e.Response {
+		response[k] = v
+	}
+	delete(response, "destination")
+	if msg.Destination.IsZero() || !e.File {
+		return response, nil
+	}
+	uploaded, err := storage.Upload(ctx, output, msg.Destination)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Uploaded", uploaded.Size, "cached bytes to", uploaded.URL)
+	b, err := json.Marshal(uploaded)
+	if err != nil {
+		return nil, err
+	}
+	raw := json.RawMessage(b)
+	response["destination"] = &raw
+	return response, nil
+}
+
+// linkOrCopy makes dst a link to src, or else a copy of it.
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = saveFile(dst, in)
+	return err
+}
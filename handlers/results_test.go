@@ -0,0 +1,136 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+	"github.com/venicegeo/pzsvc-sdk-go/job"
+)
+
+// withResults installs a ResultCache in a temporary directory, returning the
+// directory and a function that removes it.
+func withResults(t *testing.T, version string) (string, func()) {
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewResultCache(dir, 1<<20, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Results = c
+	return dir, func() {
+		Results = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"ground.laz": []byte("ground")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+	_, restore := withResults(t, "2.0.0")
+	defer restore()
+
+	run := func(destination, extra string) job.OutputMsg {
+		userJSON := `{
+			"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+			"function": "ground",
+			"destination": "s3://venicegeo-sample-data/temp/` + destination + `"` + extra + `
+		}`
+		w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+		if w.Code != http.StatusOK {
+			t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+		}
+		var res job.OutputMsg
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	// The cached output is uploaded again, in case the object has changed.
+	run("ground.laz", "")
+	store.Put("s3://venicegeo-sample-data/temp/ground.laz", []byte("overwritten"))
+	if res := run("ground.laz", ""); res.Message != "Success (cached)" || res.Response["destination"] == nil {
+		t.Errorf("Expected cached result with the original destination, got %+v", res)
+	}
+	if b, _ := store.Get("s3://venicegeo-sample-data/temp/ground.laz"); string(b) != "ground" {
+		t.Errorf("Expected cached output to be uploaded again, got %q", b)
+	}
+	if len(rec.Calls()) != 1 {
+		t.Errorf("Expected PDAL to run once, ran %d times", len(rec.Calls()))
+	}
+
+	// The cached output is copied to a new destination.
+	res := run("copy.laz", "")
+	if b, ok := store.Get("s3://venicegeo-sample-data/temp/copy.laz"); !ok || string(b) != "ground" {
+		t.Errorf("Expected cached output to be uploaded, got %q", b)
+	}
+	if res.Response["destination"] == nil || !strings.Contains(string(*res.Response["destination"]), "copy.laz") {
+		t.Errorf("Expected the new destination, got %+v", res)
+	}
+	if len(rec.Calls()) != 1 {
+		t.Errorf("Expected PDAL to run once, ran %d times", len(rec.Calls()))
+	}
+
+	// Different options, a changed source, and no_cache all run PDAL again.
+	run("ground.laz", `, "options": {"slope": 2}`)
+	store.Put("s3://venicegeo-sample-data/pointcloud/samp71-utm.laz", []byte("new laz"))
+	run("ground.laz", "")
+	if res := run("ground.laz", `, "no_cache": true`); res.Message != "Success" {
+		t.Errorf("Expected no_cache to run the job, got %+v", res)
+	}
+	if len(rec.Calls()) != 4 {
+		t.Errorf("Expected PDAL to run 4 times, ran %d times", len(rec.Calls()))
+	}
+	if s := Results.Stats(); s.Hits != 2 || s.Misses != 3 || s.Entries != 3 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestResultCacheVersion(t *testing.T) {
+	rec := &pdaltest.Recorder{Output: []byte(`{"filename": "samp71-utm.laz"}`)}
+	_, teardown := setup(t, rec)
+	defer teardown()
+	dir, restore := withResults(t, "1.8.0")
+	defer restore()
+
+	userJSON := `{"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz", "function": "info"}`
+	if w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON); w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+
+	// Results survive a restart, but not an upgrade.
+	c, err := NewResultCache(dir, 1<<20, "1.8.0")
+	if err != nil || c.Stats().Entries != 1 {
+		t.Errorf("Expected the result to be kept, got %+v (%v)", c.Stats(), err)
+	}
+	c, err = NewResultCache(dir, 1<<20, "2.0.0")
+	if err != nil || c.Stats().Entries != 0 {
+		t.Errorf("Expected the result to be discarded, got %+v (%v)", c.Stats(), err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected discarded results to be removed, found %d files", len(files))
+	}
+}
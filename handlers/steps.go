@@ -0,0 +1,289 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-pdal/storage"
+)
+
+// MaxSteps is the largest number of steps a job may have.
+var MaxSteps = 10
+
+// Step is one function of a multi-step job, run against the output of the
+// previous step.
+type Step struct {
+	Function *string          `json:"function,omitempty"`
+	Options  *json.RawMessage `json:"options,omitempty"`
+}
+
+// StepResult reports how a step went.
+type StepResult struct {
+	Function string  `json:"function"`
+	Seconds  float64 `json:"seconds"`
+	// Output is the JSON output of a step, such as info, that produces JSON
+	// rather than a file, unless it is the final step, whose output is the
+	// response.
+	Output *json.RawMessage `json:"output,omitempty"`
+}
+
+// link is a function of a chain, with its options.
+type link struct {
+	fn      *functions.Function
+	options *json.RawMessage
+}
+
+/*
+chain is the functions that a job runs, in order. A job given a single
+function is a chain of one.
+
+Each function that produces a file reads the file produced by the one before
+it (or the source), while functions that produce JSON, such as info, leave it
+for the next. Only the last file produced is kept as the output of the job.
+*/
+type chain []link
+
+// chain resolves the function or steps of msg, returning a ValidationError
+// (or, for a job with a single, unrecognized function, a plain error) if they
+// are not valid.
+func (msg InputMsg) chain() (chain, error) {
+	if msg.Function != nil || len(msg.Steps) == 0 {
+		if len(msg.Steps) > 0 {
+			return nil, errors.New("Must provide either a function or steps, not both")
+		}
+		if msg.Function == nil {
+			return nil, errors.New("Must provide a function")
+		}
+		fn, ok := functions.Lookup(*msg.Function)
+		if !ok {
+			return nil, errors.New("Unrecognized function")
+		}
+		if _, err := fn.ParseOptions(msg.Options); err != nil {
+			return nil, err
+		}
+		return chain{{fn, msg.Options}}, nil
+	}
+
+	var errs functions.ValidationError
+	if msg.Options != nil {
+		errs = append(errs, functions.FieldError{Field: "options", Message: "must be given for each step"})
+	}
+	if len(msg.Steps) > MaxSteps {
+		errs = append(errs, functions.FieldError{Field: "steps", Message: "must number at most " + strconv.Itoa(MaxSteps)})
+	}
+	c := make(chain, 0, len(msg.Steps))
+	var raster string
+	for i, s := range msg.Steps {
+		field := "steps[" + strconv.Itoa(i) + "]"
+		if s.Function == nil {
+			errs = append(errs, functions.FieldError{Field: field + ".function", Message: "is required"})
+			continue
+		}
+		fn, ok := functions.Lookup(*s.Function)
+		if !ok {
+			errs = append(errs, functions.FieldError{Field: field + ".function", Message: "unrecognized function " + *s.Function})
+			continue
+		}
+		if _, err := fn.ParseOptions(s.Options); err != nil {
+			verr, _ := err.(functions.ValidationError)
+			for _, fe := range verr {
+				errs = append(errs, functions.FieldError{Field: field + "." + fe.Field, Message: fe.Message})
+			}
+		}
+		// Nothing can read a raster, so it must be the last file produced.
+		if raster != "" && fn.Output != functions.OutputJSON {
+			errs = append(errs, functions.FieldError{Field: raster + ".function", Message: "produces a raster, so must be the last step to produce a file"})
+			raster = ""
+		}
+		if fn.Output == functions.OutputRaster {
+			raster = field
+		}
+		c = append(c, link{fn, s.Options})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// output returns the function that produces the output of the chain, i.e.,
+// the last that produces a file or, failing that, the last.
+func (c chain) output() *functions.Function {
+	if i := c.outputIndex(); i >= 0 {
+		return c[i].fn
+	}
+	return c[len(c)-1].fn
+}
+
+// outputIndex returns the index of the last function to produce a file, or -1
+// if none does.
+func (c chain) outputIndex() int {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i].fn.Output != functions.OutputJSON {
+			return i
+		}
+	}
+	return -1
+}
+
+// producesFile reports whether the chain produces a file.
+func (c chain) producesFile() bool {
+	return c.outputIndex() >= 0
+}
+
+// endsWithFile reports whether the last function produces a file, rather than
+// reporting on one.
+func (c chain) endsWithFile() bool {
+	return c.outputIndex() == len(c)-1
+}
+
+// weight returns the weight of the heaviest function.
+func (c chain) weight() int {
+	w := 0
+	for _, l := range c {
+		if l.fn.Weight > w {
+			w = l.fn.Weight
+		}
+	}
+	return w
+}
+
+// timeLimit returns the total of the time limits of the functions.
+func (c chain) timeLimit() time.Duration {
+	var limit time.Duration
+	for _, l := range c {
+		limit += l.fn.TimeLimit()
+	}
+	return limit
+}
+
+// files returns the input and output file of each function, given the input
+// and output of the chain. Intermediate files are named for their step, with
+// path (e.g., Workspace.StepPath), keeping the extension of the input so that PDAL infers the same
+// writer.
+func (c chain) files(input, output string, path func(string) string) (inputs, outputs []string) {
+	ext := filepath.Ext(input)
+	if ext == "" {
+		ext = ".laz"
+	}
+	last := c.outputIndex()
+	current := input
+	for i, l := range c {
+		out := output
+		if i != last {
+			out = path("step-" + strconv.Itoa(i+1) + ext)
+		}
+		inputs = append(inputs, current)
+		outputs = append(outputs, out)
+		if l.fn.Output != functions.OutputJSON {
+			current = out
+		}
+	}
+	return inputs, outputs
+}
+
+// chainResult is the outcome of running a chain.
+type chainResult struct {
+	// output is the JSON output of the final function, if it produces JSON.
+	output []byte
+	// metadata is the functions.Metadata of the function that produced the
+	// output file, if any, describing the input of the chain.
+	metadata []byte
+	uploaded *storage.UploadResult
+	steps    []StepResult
+}
+
+// chainMetadata returns the functions.Metadata b of a step, describing input
+// as the input, if it is known, along with the input of the chain.
+func chainMetadata(b []byte, input *functions.Summary) ([]byte, *functions.Summary) {
+	var m functions.Metadata
+	if b == nil || json.Unmarshal(b, &m) != nil {
+		return b, input
+	}
+	if input == nil {
+		return b, m.Input
+	}
+	m.Input = input
+	if out, err := json.Marshal(m); err == nil {
+		b = out
+	}
+	return b, input
+}
+
+// run downloads the source of msg, unless it was uploaded with the request,
+// runs each function of the chain in turn within ws, and uploads the output to
+// the destination, if any.
+func (c chain) run(ctx context.Context, ws *Workspace, msg InputMsg) (chainResult, error) {
+	var res chainResult
+
+	// Interpret the last element of the source path as the input filename.
+	inputName, outputName := msg.paths(ws, c.output())
+	if msg.input == "" {
+		numBytes, err := storage.Download(ctx, msg.Source, inputName)
+		if err != nil {
+			return res, err
+		}
+		log.Println("Downloaded", numBytes, "bytes from", msg.Source)
+	}
+
+	// The input of the chain is that read by the first function to produce a
+	// file; later ones read intermediate files.
+	var input *functions.Summary
+	inputs, outputs := c.files(inputName, outputName, ws.StepPath)
+	for i, l := range c {
+		start := time.Now()
+		b, err := l.fn.Run(ctx, inputs[i], outputs[i], l.options)
+		if err != nil {
+			if len(c) > 1 {
+				log.Println("Step", i+1, "("+l.fn.Name+") failed:", err)
+			}
+			return res, err
+		}
+		step := StepResult{Function: l.fn.Name, Seconds: time.Since(start).Seconds()}
+
+		switch {
+		case l.fn.Output != functions.OutputJSON:
+			res.metadata, input = chainMetadata(b, input)
+		case i == len(c)-1:
+			res.output = b
+		case b != nil:
+			raw := json.RawMessage(b)
+			step.Output = &raw
+		}
+		res.steps = append(res.steps, step)
+	}
+
+	// If an output has been created, upload it to the destination.
+	if msg.Destination.IsZero() {
+		return res, nil
+	}
+	uploaded, err := storage.Upload(ctx, outputName, msg.Destination)
+	if err != nil {
+		return res, err
+	}
+	log.Println("Uploaded", uploaded.Size, "bytes to", uploaded.URL)
+	res.uploaded = &uploaded
+	return res, nil
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+	"github.com/venicegeo/pzsvc-sdk-go/job"
+)
+
+func TestSteps(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{
+		"step-1.laz": []byte("cropped"),
+		"step-2.laz": []byte("filtered"),
+		"step-3.laz": []byte("ground"),
+		"height.laz": []byte("height"),
+	}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"steps": [
+			{"function": "crop", "options": {"bounds": "([0,1],[0,1])"}},
+			{"function": "statistical"},
+			{"function": "ground", "options": {"slope": 0.5}},
+			{"function": "height"}
+		],
+		"destination": "s3://venicegeo-sample-data/temp/height.laz"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+
+	// Each step reads the file written by the one before.
+	pipelines := rec.Pipelines()
+	if len(pipelines) != 4 {
+		t.Fatalf("Expected 4 pipelines, got %d", len(pipelines))
+	}
+	files := []string{"samp71-utm.laz", "step-1.laz", "step-2.laz", "step-3.laz", "height.laz"}
+	for i, p := range pipelines {
+		if in, out := pipelineFiles(t, p); in != files[i] || out != files[i+1] {
+			t.Errorf("Step %d: expected %s -> %s, got %s", i+1, files[i], files[i+1], p)
+		}
+	}
+	if !strings.Contains(string(pipelines[2]), `"slope":0.5`) {
+		t.Errorf("Expected ground options to be passed, got %s", pipelines[2])
+	}
+
+	// Only the final output is uploaded.
+	if b, ok := store.Get("s3://venicegeo-sample-data/temp/height.laz"); !ok || string(b) != "height" {
+		t.Errorf("Expected output to be uploaded, got %q", b)
+	}
+	for _, name := range files[1:4] {
+		if _, ok := store.Get("s3://venicegeo-sample-data/temp/" + name); ok {
+			t.Errorf("Expected intermediate %s not to be uploaded", name)
+		}
+	}
+
+	var res job.OutputMsg
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	var steps []StepResult
+	if raw := res.Response["steps"]; raw != nil {
+		json.Unmarshal(*raw, &steps)
+	}
+	if len(steps) != 4 || steps[0].Function != "crop" || steps[3].Function != "height" {
+		t.Errorf("Unexpected steps in response %s", w.Body)
+	}
+	if res.Response["destination"] == nil {
+		t.Errorf("Expected destination in response %s", w.Body)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestStepsNamedLikeIntermediates(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"step-1.laz": []byte("ground")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+
+	userJSON := `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"steps": [{"function": "crop", "options": {"bounds": "([0,1],[0,1])"}}, {"function": "ground"}],
+		"destination": "s3://venicegeo-sample-data/temp/step-1.laz"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+
+	// The intermediate file is not the output, though they share a name.
+	var files []string
+	for _, b := range rec.Pipelines() {
+		var p struct {
+			Pipeline []map[string]interface{} `json:"pipeline"`
+		}
+		json.Unmarshal(b, &p)
+		for _, stage := range p.Pipeline {
+			if name, ok := stage["filename"].(string); ok {
+				files = append(files, name)
+			}
+		}
+	}
+	if len(files) < 4 || files[1] != files[2] || files[1] == files[3] || files[0] == files[3] {
+		t.Errorf("Expected distinct intermediate and output files, got %v", files)
+	}
+	if _, ok := store.Get("s3://venicegeo-sample-data/temp/step-1.laz"); !ok {
+		t.Error("Expected output to be uploaded")
+	}
+	assertWorkspacesRemoved(t)
+}
+
+// metadataSequence gives each PDAL invocation the next of its metadata.
+type metadataSequence struct {
+	*pdaltest.Recorder
+	metadata [][]byte
+}
+
+func (m *metadataSequence) Run(ctx context.Context, args ...string) ([]byte, error) {
+	m.Recorder.Metadata, m.metadata = m.metadata[0], m.metadata[1:]
+	return m.Recorder.Run(ctx, args...)
+}
+
+func TestStepsMetadata(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{
+		"step-1.laz": []byte("cropped"),
+		"ground.laz": pdaltest.LASHeader(5, [6]float64{0, 0, 0, 1, 1, 1}),
+	}}
+	_, teardown := setup(t, rec)
+	defer teardown()
+	defer pdaltest.Install(&metadataSequence{rec, [][]byte{
+		[]byte(`{"stages": {"readers.las": {"count": 100}, "filters.crop": {}, "writers.las": {}}}`),
+		[]byte(`{"stages": {"readers.las": {"count": 20}, "filters.smrf": {}, "writers.las": {}}}`),
+	}})()
+
+	userJSON := `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"steps": [
+			{"function": "crop", "options": {"bounds": "([0,1],[0,1])"}},
+			{"function": "ground"}
+		],
+		"destination": "s3://venicegeo-sample-data/temp/ground.laz"
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	var res struct {
+		Response struct {
+			Metadata functions.Metadata `json:"metadata"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	// The input is the source, not the intermediate file read by ground.
+	m := res.Response.Metadata
+	if m.Input == nil || *m.Input.Points != 100 || m.Output == nil || *m.Output.Points != 5 ||
+		m.Stages["filters.smrf"] == nil {
+		t.Errorf("Expected the metadata of the chain in the response, got %s", w.Body)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestStepsInfo(t *testing.T) {
+	rec := &pdaltest.Recorder{
+		Output: []byte(`{"filename": "step-1.laz"}`),
+		Files:  map[string][]byte{"step-1.laz": []byte("cropped"), "output.laz": []byte("ground")},
+	}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	// A JSON step in the middle reports on the file before it; a JSON step at
+	// the end gives the response.
+	userJSON := `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"steps": [
+			{"function": "crop", "options": {"bounds": "([0,1],[0,1])"}},
+			{"function": "info"},
+			{"function": "ground"},
+			{"function": "info"}
+		]
+	}`
+	w := post(PdalHandler, "/api/v1/pdal?sync=true", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	calls := rec.Calls()
+	if len(calls) != 4 || filepath.Base(calls[1][1]) != "step-1.laz" || filepath.Base(calls[3][1]) != "output.laz" {
+		t.Errorf("Unexpected PDAL invocations %v", calls)
+	}
+	var res job.OutputMsg
+	json.Unmarshal(w.Body.Bytes(), &res)
+	var steps []StepResult
+	if raw := res.Response["steps"]; raw != nil {
+		json.Unmarshal(*raw, &steps)
+	}
+	if len(steps) != 4 || steps[1].Output == nil || steps[3].Output != nil || res.Response["filename"] == nil {
+		t.Errorf("Unexpected response %s", w.Body)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestStepsInvalid(t *testing.T) {
+	_, teardown := setup(t, &pdaltest.Recorder{})
+	defer teardown()
+
+	tests := []struct {
+		steps string
+		want  string
+	}{
+		{`[{"function": "crop"}]`, "steps[0]"},
+		{`[{"function": "ground"}, {"function": "fail"}]`, "steps[1].function"},
+		{`[{"function": "ground"}, {"options": {}}]`, "steps[1].function"},
+		{`[{"function": "ground", "options": {"slope": -1}}]`, "steps[0].slope"},
+		{`[{"function": "dtm"}, {"function": "ground"}]`, "steps[0].function"},
+	}
+	for _, tt := range tests {
+		userJSON := `{
+			"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+			"steps": ` + tt.steps + `
+		}`
+		w := post(PdalHandler, "/api/v1/pdal", userJSON)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: StatusBadRequest mentioning %s expected: %d %s", tt.steps, tt.want, w.Code, w.Body)
+		}
+	}
+
+	w := post(PdalHandler, "/api/v1/pdal", `{
+		"source": "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz",
+		"function": "ground",
+		"steps": [{"function": "ground"}]
+	}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected for both function and steps: %d", w.Code)
+	}
+	assertWorkspacesRemoved(t)
+}
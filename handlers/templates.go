@@ -0,0 +1,559 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/venicegeo/pzsvc-pdal/functions"
+)
+
+// Templates holds the pipeline templates. It is nil until configured.
+var Templates *TemplateStore
+
+var (
+	// templateName is the form of template names, which also name their
+	// files.
+	templateName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	// placeholder matches a parameter, e.g., ${resolution}, in a template.
+	placeholder = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// parameterTypes are the types that template parameters may have.
+var parameterTypes = []string{"boolean", "integer", "number", "string"}
+
+/*
+Template is a named pipeline with ${param} placeholders.
+
+Each parameter is described by a schema, giving its type (boolean, integer,
+number, or string), and optionally its default, description, and constraints.
+Parameters without a default are required. A string that is just a
+placeholder is replaced by the value itself, keeping its type, while
+placeholders within longer strings are replaced by the value's text.
+*/
+type Template struct {
+	Name        string                       `json:"name"`
+	Description string                       `json:"description,omitempty"`
+	Parameters  map[string]*functions.Schema `json:"parameters,omitempty"`
+	Pipeline    []interface{}                `json:"pipeline"`
+}
+
+// check describes every problem with the template.
+func (t *Template) check() functions.ValidationError {
+	var errs functions.ValidationError
+	if !templateName.MatchString(t.Name) {
+		errs = append(errs, functions.FieldError{Field: "name", Message: "must be lowercase letters, digits, - and _"})
+	}
+
+	names := t.parameterNames()
+	for _, name := range names {
+		p := t.Parameters[name]
+		field := "parameters." + name
+		if p == nil || !contains(parameterTypes, p.Type) {
+			errs = append(errs, functions.FieldError{Field: field + ".type", Message: "must be one of " + strings.Join(parameterTypes, ", ")})
+			continue
+		}
+		if p.Pattern != "" {
+			if _, err := regexp.Compile(p.Pattern); err != nil {
+				errs = append(errs, functions.FieldError{Field: field + ".pattern", Message: err.Error()})
+				continue
+			}
+		}
+		if p.Default == nil {
+			continue
+		}
+		b, _ := json.Marshal(p.Default)
+		one := &functions.Schema{Properties: map[string]*functions.Schema{name: p}}
+		for _, fe := range one.Validate(map[string]json.RawMessage{name: b}) {
+			errs = append(errs, functions.FieldError{Field: field + ".default", Message: fe.Message})
+		}
+	}
+
+	if len(t.Pipeline) == 0 {
+		errs = append(errs, functions.FieldError{Field: "pipeline", Message: "must have at least one stage"})
+	}
+	used := make(map[string]bool)
+	walkStrings(t.Pipeline, func(s string) {
+		for _, m := range placeholder.FindAllStringSubmatch(s, -1) {
+			used[m[1]] = true
+		}
+	})
+	var undeclared []string
+	for name := range used {
+		if _, ok := t.Parameters[name]; !ok {
+			undeclared = append(undeclared, name)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, name := range undeclared {
+		errs = append(errs, functions.FieldError{Field: "pipeline", Message: "uses undeclared parameter " + name})
+	}
+	return errs
+}
+
+// checkPipeline checks the pipeline, with the parameters' defaults
+// substituted, as PipelineHandler would, so that a template cannot be saved
+// that breaks its rules. Stages using a parameter without a default cannot be
+// checked until the template is executed, when every stage is checked again.
+func (t *Template) checkPipeline() functions.ValidationError {
+	values := t.Defaults()
+	for name := range t.Parameters {
+		if _, ok := values[name]; !ok {
+			values[name] = "${" + name + "}"
+		}
+	}
+	stages, _ := substitute(t.Pipeline, values).([]interface{})
+	b, err := json.Marshal(map[string]interface{}{"pipeline": stages})
+	if err != nil {
+		return functions.ValidationError{{Field: "pipeline", Message: err.Error()}}
+	}
+	_, err = parsePipeline(b)
+	verrs, ok := err.(functions.ValidationError)
+	if !ok {
+		if err != nil {
+			return functions.ValidationError{{Field: "pipeline", Message: err.Error()}}
+		}
+		return nil
+	}
+
+	var errs functions.ValidationError
+	for _, fe := range verrs {
+		if k, _ := fieldStage(fe.Field); k >= 0 && k < len(stages) {
+			unresolved := false
+			walkStrings(stages[k], func(s string) {
+				unresolved = unresolved || placeholder.MatchString(s)
+			})
+			if unresolved {
+				continue
+			}
+		}
+		errs = append(errs, fe)
+	}
+	return errs
+}
+
+// parameterNames returns the sorted names of the template's parameters.
+func (t *Template) parameterNames() []string {
+	names := make([]string, 0, len(t.Parameters))
+	for name := range t.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// JSONSchema describes the template's parameters, as a function's options are
+// described.
+func (t *Template) JSONSchema() *functions.Schema {
+	s := &functions.Schema{
+		Schema:               functions.SchemaVersion,
+		Title:                t.Name,
+		Description:          t.Description,
+		Type:                 "object",
+		Properties:           t.Parameters,
+		AdditionalProperties: new(bool),
+	}
+	for _, name := range t.parameterNames() {
+		if t.Parameters[name].Default == nil {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s
+}
+
+// Defaults returns the parameters that have defaults, with their defaults.
+func (t *Template) Defaults() map[string]interface{} {
+	defaults := make(map[string]interface{})
+	for name, p := range t.Parameters {
+		if p.Default != nil {
+			defaults[name] = p.Default
+		}
+	}
+	return defaults
+}
+
+// Substitute returns the template's stages with its placeholders replaced by
+// the given parameters, or else their defaults. Every problem with the
+// parameters is reported in a ValidationError.
+func (t *Template) Substitute(params map[string]json.RawMessage) ([]interface{}, error) {
+	var errs functions.ValidationError
+	for _, fe := range t.JSONSchema().Validate(params) {
+		errs = append(errs, functions.FieldError{Field: "parameters." + fe.Field, Message: fe.Message})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	values := t.Defaults()
+	for name, raw := range params {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		values[name] = v
+	}
+	stages, _ := substitute(t.Pipeline, values).([]interface{})
+	return stages, nil
+}
+
+// substitute returns a copy of v with its placeholders replaced by values.
+func substitute(v interface{}, values map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if m := placeholder.FindStringSubmatch(v); m != nil && m[0] == v {
+			return values[m[1]]
+		}
+		return placeholder.ReplaceAllStringFunc(v, func(s string) string {
+			return fmt.Sprint(values[s[2:len(s)-1]])
+		})
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = substitute(e, values)
+		}
+		return a
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = substitute(e, values)
+		}
+		return m
+	}
+	return v
+}
+
+// walkStrings calls fn with every string within v.
+func walkStrings(v interface{}, fn func(string)) {
+	switch v := v.(type) {
+	case string:
+		fn(v)
+	case []interface{}:
+		for _, e := range v {
+			walkStrings(e, fn)
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			walkStrings(e, fn)
+		}
+	}
+}
+
+// contains reports whether a contains s.
+func contains(a []string, s string) bool {
+	for _, e := range a {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+TemplateStore holds pipeline templates, each persisted as <name>.json in its
+directory, so that they survive restarts.
+*/
+type TemplateStore struct {
+	dir string
+
+	mu        sync.RWMutex
+	templates map[string]*Template
+}
+
+// NewTemplateStore constructs a TemplateStore in dir, loading the templates
+// left there by a previous TemplateStore. Files that are not valid templates
+// are skipped.
+func NewTemplateStore(dir string) (*TemplateStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &TemplateStore{dir: dir, templates: make(map[string]*Template)}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var t Template
+		if err := json.Unmarshal(b, &t); err != nil || t.Name+".json" != fi.Name() || len(t.check()) > 0 {
+			log.Println("Skipping invalid template", fi.Name())
+			continue
+		}
+		s.templates[t.Name] = &t
+	}
+	return s, nil
+}
+
+// path returns the name of the file holding the named template.
+func (s *TemplateStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Get returns the named template.
+func (s *TemplateStore) Get(name string) (*Template, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.templates[name]
+	return t, ok
+}
+
+// Names returns the sorted names of all templates.
+func (s *TemplateStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.templates))
+	for name := range s.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Put checks and saves t, replacing any template of the same name, and
+// reports whether it is new. Problems with t are reported in a
+// ValidationError.
+func (s *TemplateStore) Put(t *Template) (bool, error) {
+	errs := t.check()
+	if len(errs) == 0 {
+		errs = t.checkPipeline()
+	}
+	if len(errs) > 0 {
+		return false, errs
+	}
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	part := s.path(t.Name) + ".part"
+	if err := ioutil.WriteFile(part, b, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(part, s.path(t.Name)); err != nil {
+		os.Remove(part)
+		return false, err
+	}
+	_, replaced := s.templates[t.Name]
+	s.templates[t.Name] = t
+	return !replaced, nil
+}
+
+// Delete removes the named template, reporting whether there was one.
+func (s *TemplateStore) Delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.templates[name]; !ok {
+		return false, nil
+	}
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	delete(s.templates, name)
+	return true, nil
+}
+
+// TemplateMsg describes a template, as a function is described.
+type TemplateMsg struct {
+	*Template
+	// Options are the parameters' defaults.
+	Options map[string]interface{} `json:"options"`
+	Schema  *functions.Schema      `json:"schema"`
+}
+
+// TemplateExecution is the body of a request to execute a template.
+type TemplateExecution struct {
+	Parameters map[string]json.RawMessage `json:"parameters"`
+	// Sources are read by readers placed before the template's stages, so
+	// that the template's first filter takes them all. They are storage
+	// locations, kept as given so that any method and headers survive until
+	// the pipeline is parsed.
+	Sources []json.RawMessage `json:"sources"`
+}
+
+// templateStore returns Templates, or an error if they are not configured.
+func templateStore() (*TemplateStore, *AppError) {
+	if Templates == nil {
+		return nil, &AppError{nil, "Templates are not configured", http.StatusNotFound}
+	}
+	return Templates, nil
+}
+
+// getTemplate returns the template named in ps, or a 404 error.
+func getTemplate(ps httprouter.Params) (*Template, *AppError) {
+	s, e := templateStore()
+	if e != nil {
+		return nil, e
+	}
+	t, ok := s.Get(ps.ByName("name"))
+	if !ok {
+		return nil, &AppError{nil, "Unknown template " + ps.ByName("name"), http.StatusNotFound}
+	}
+	return t, nil
+}
+
+// writeJSON responds with v and the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) *AppError {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	return nil
+}
+
+// ListTemplatesHandler lists the names of the templates.
+func ListTemplatesHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	s, e := templateStore()
+	if e != nil {
+		return e
+	}
+	type ListTemplates struct {
+		Templates []string `json:"templates"`
+	}
+	return writeJSON(w, http.StatusOK, ListTemplates{s.Names()})
+}
+
+// TemplateHandler describes the named template, including the schema of its
+// parameters and their defaults.
+func TemplateHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *AppError {
+	t, e := getTemplate(ps)
+	if e != nil {
+		return e
+	}
+	return writeJSON(w, http.StatusOK, TemplateMsg{t, t.Defaults(), t.JSONSchema()})
+}
+
+// PutTemplateHandler creates or replaces the named template, responding with
+// 201 Created or 200 OK, and its description. Invalid templates, including
+// those whose pipeline breaks the rules of PipelineHandler once the defaults
+// are substituted, are refused with 400, listing every problem.
+func PutTemplateHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *AppError {
+	s, e := templateStore()
+	if e != nil {
+		return e
+	}
+	if r.Body == nil {
+		return &AppError{nil, "No JSON", http.StatusBadRequest}
+	}
+	limitBody(w, r)
+
+	// Throw 500 if we cannot read the body, or 413 if it is too large.
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+	var t Template
+	if err := json.Unmarshal(b, &t); err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+	if t.Name == "" {
+		t.Name = ps.ByName("name")
+	}
+	if t.Name != ps.ByName("name") {
+		return &AppError{nil, "Template name " + t.Name + " does not match " + ps.ByName("name"), http.StatusBadRequest}
+	}
+
+	created, err := s.Put(&t)
+	if err != nil {
+		return &AppError{err, err.Error(), errorStatus(err)}
+	}
+	log.Println("Saved template", t.Name)
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	return writeJSON(w, status, TemplateMsg{&t, t.Defaults(), t.JSONSchema()})
+}
+
+// DeleteTemplateHandler removes the named template, responding with 204 No
+// Content.
+func DeleteTemplateHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *AppError {
+	s, e := templateStore()
+	if e != nil {
+		return e
+	}
+	ok, err := s.Delete(ps.ByName("name"))
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	if !ok {
+		return &AppError{nil, "Unknown template " + ps.ByName("name"), http.StatusNotFound}
+	}
+	log.Println("Deleted template", ps.ByName("name"))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ExecuteTemplateHandler runs the named template as a pipeline, with the given
+// parameters and sources, responding as PipelineHandler does.
+func ExecuteTemplateHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) *AppError {
+	t, e := getTemplate(ps)
+	if e != nil {
+		return e
+	}
+
+	var msg TemplateExecution
+	if r.Body != nil {
+		limitBody(w, r)
+
+		// Throw 500 if we cannot read the body, or 413 if it is too large.
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return bodyError(err)
+		}
+		if err := json.Unmarshal(b, &msg); err != nil {
+			return &AppError{err, err.Error(), http.StatusBadRequest}
+		}
+	}
+
+	templated, err := t.Substitute(msg.Parameters)
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+	stages := make([]interface{}, 0, len(msg.Sources)+len(templated))
+	for _, src := range msg.Sources {
+		stages = append(stages, src)
+	}
+	stages = append(stages, templated...)
+
+	b, err := json.Marshal(map[string]interface{}{"pipeline": stages})
+	if err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	log.Println("Executing template", t.Name, "as:", string(b))
+	return runPipeline(w, r, b)
+}
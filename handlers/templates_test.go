@@ -0,0 +1,268 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+)
+
+const groundTemplate = `{
+	"description": "Keep the ground, and write it where asked",
+	"parameters": {
+		"class": {"type": "integer", "default": 2, "minimum": 0, "maximum": 31},
+		"destination": {"type": "string", "description": "where to write the ground"}
+	},
+	"pipeline": [
+		{"type": "filters.range", "limits": "Classification[${class}:${class}]"},
+		{"type": "filters.outlier", "multiplier": "${class}"},
+		"${destination}"
+	]
+}`
+
+// serveTemplate calls a template handler with the named template.
+func serveTemplate(h func(http.ResponseWriter, *http.Request, httprouter.Params) *AppError, method, name, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "/api/v1/templates/"+name, strings.NewReader(body))
+	ps := httprouter.Params{{Key: "name", Value: name}}
+	return serve(func(w http.ResponseWriter, r *http.Request) *AppError { return h(w, r, ps) }, req)
+}
+
+// setupTemplates installs an empty TemplateStore, returning its directory and
+// a function that removes it.
+func setupTemplates(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Templates, err = NewTemplateStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		Templates = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir, teardown := setupTemplates(t)
+	defer teardown()
+
+	w := serveTemplate(PutTemplateHandler, "PUT", "ground", groundTemplate)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("StatusCreated expected: %d %s", w.Code, w.Body)
+	}
+	w = serveTemplate(PutTemplateHandler, "PUT", "ground", groundTemplate)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+
+	// Templates are described as functions are.
+	w = serveTemplate(TemplateHandler, "GET", "ground", "")
+	var desc struct {
+		Name    string                 `json:"name"`
+		Options map[string]interface{} `json:"options"`
+		Schema  struct {
+			Properties map[string]interface{} `json:"properties"`
+			Required   []string               `json:"required"`
+		} `json:"schema"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &desc); err != nil {
+		t.Fatal(err)
+	}
+	if desc.Name != "ground" || desc.Options["class"] != 2.0 || len(desc.Schema.Properties) != 2 ||
+		len(desc.Schema.Required) != 1 || desc.Schema.Required[0] != "destination" {
+		t.Errorf("Unexpected description %s", w.Body)
+	}
+
+	// Templates survive restarts.
+	s, err := NewTemplateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := s.Names(); len(names) != 1 || names[0] != "ground" {
+		t.Errorf("Expected the template to be reloaded, got %v", names)
+	}
+
+	w = post(ListTemplatesHandler, "/api/v1/templates", "")
+	if !strings.Contains(w.Body.String(), `"templates":["ground"]`) {
+		t.Errorf("Unexpected list %s", w.Body)
+	}
+
+	w = serveTemplate(DeleteTemplateHandler, "DELETE", "ground", "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("StatusNoContent expected: %d %s", w.Code, w.Body)
+	}
+	w = serveTemplate(TemplateHandler, "GET", "ground", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("StatusNotFound expected: %d %s", w.Code, w.Body)
+	}
+	if s, _ := NewTemplateStore(dir); len(s.Names()) != 0 {
+		t.Errorf("Expected the template to be deleted, got %v", s.Names())
+	}
+}
+
+func TestTemplatesInvalid(t *testing.T) {
+	_, teardown := setupTemplates(t)
+	defer teardown()
+
+	userJSON := `{
+		"parameters": {
+			"class": {"type": "integer", "default": "two"},
+			"window": {"type": "object"},
+			"name": {"type": "string", "pattern": "(", "default": "x"}
+		},
+		"pipeline": [{"type": "filters.range", "limits": "Classification[${class}:${clas}]"}]
+	}`
+	w := serveTemplate(PutTemplateHandler, "PUT", "Ground", userJSON)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("StatusBadRequest expected: %d %s", w.Code, w.Body)
+	}
+	for _, want := range []string{`"name"`, "parameters.class.default", "parameters.window.type", "parameters.name.pattern",
+		"undeclared parameter clas"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in response %s", want, w.Body)
+		}
+	}
+	if len(Templates.Names()) != 0 {
+		t.Error("Expected the template not to be saved")
+	}
+
+	// The pipeline is checked with the defaults, except for stages that use
+	// parameters without one.
+	userJSON = `{
+		"parameters": {
+			"out": {"type": "string", "default": "/etc/passwd"},
+			"dir": {"type": "string"}
+		},
+		"pipeline": [
+			{"type": "filters.python", "script": "evil.py"},
+			{"type": "writers.las", "filename": "${out}"},
+			{"type": "writers.las", "filename": "${dir}/out.laz"}
+		]
+	}`
+	w = serveTemplate(PutTemplateHandler, "PUT", "evil", userJSON)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("StatusBadRequest expected: %d %s", w.Code, w.Body)
+	}
+	for _, want := range []string{"pipeline[0].type", "pipeline[1].filename"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %s in response %s", want, w.Body)
+		}
+	}
+	if strings.Contains(w.Body.String(), "pipeline[2]") {
+		t.Errorf("Expected the stage using dir to go unchecked, got %s", w.Body)
+	}
+	if len(Templates.Names()) != 0 {
+		t.Error("Expected the template not to be saved")
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	var tmpl Template
+	if err := json.Unmarshal([]byte(groundTemplate), &tmpl); err != nil {
+		t.Fatal(err)
+	}
+	stages, err := tmpl.Substitute(map[string]json.RawMessage{
+		"class":       json.RawMessage(`6`),
+		"destination": json.RawMessage(`"s3://bucket/ground.laz"`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(stages)
+	want := `[{"limits":"Classification[6:6]","type":"filters.range"},{"multiplier":6,"type":"filters.outlier"},"s3://bucket/ground.laz"]`
+	if string(b) != want {
+		t.Errorf("Expected %s, got %s", want, b)
+	}
+
+	// Parameters are checked against their schema.
+	_, err = tmpl.Substitute(map[string]json.RawMessage{"class": json.RawMessage(`40`), "extra": json.RawMessage(`1`)})
+	for _, want := range []string{"parameters.class", "parameters.extra", "parameters.destination: is required"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %s in %v", want, err)
+		}
+	}
+}
+
+func TestExecuteTemplate(t *testing.T) {
+	rec := &pdaltest.Recorder{Files: map[string][]byte{"upload_file-0.laz": []byte("ground")}}
+	store, teardown := setup(t, rec)
+	defer teardown()
+	_, teardownTemplates := setupTemplates(t)
+	defer teardownTemplates()
+
+	if w := serveTemplate(PutTemplateHandler, "PUT", "ground", groundTemplate); w.Code != http.StatusCreated {
+		t.Fatalf("StatusCreated expected: %d %s", w.Code, w.Body)
+	}
+	userJSON := `{
+		"parameters": {"destination": "s3://venicegeo-sample-data/temp/ground.laz"},
+		"sources": [{"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"}]
+	}`
+	w := serveTemplate(ExecuteTemplateHandler, "POST", "ground", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	if b, ok := store.Get("s3://venicegeo-sample-data/temp/ground.laz"); !ok || string(b) != "ground" {
+		t.Errorf("Expected output to be uploaded, got %q", b)
+	}
+	p := string(rec.LastPipeline())
+	if !strings.Contains(p, "download_file-0.laz") || !strings.Contains(p, "Classification[2:2]") {
+		t.Errorf("Expected the source to be read and defaults used, got %s", p)
+	}
+	assertWorkspacesRemoved(t)
+
+	// Substituted pipelines are sandboxed as any other.
+	w = serveTemplate(ExecuteTemplateHandler, "POST", "ground", `{"parameters": {"destination": "/etc/passwd"}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected: %d %s", w.Code, w.Body)
+	}
+	w = serveTemplate(ExecuteTemplateHandler, "POST", "ground", `{}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "parameters.destination") {
+		t.Errorf("StatusBadRequest expected: %d %s", w.Code, w.Body)
+	}
+	w = serveTemplate(ExecuteTemplateHandler, "POST", "missing", `{}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("StatusNotFound expected: %d %s", w.Code, w.Body)
+	}
+
+	// Sources keep their headers.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xyz" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("fake laz"))
+	}))
+	defer ts.Close()
+	userJSON = `{
+		"parameters": {"destination": "s3://venicegeo-sample-data/temp/ground.laz"},
+		"sources": [{"url": "` + ts.URL + `/samp71-utm.laz", "headers": {"Authorization": "Bearer xyz"}}]
+	}`
+	w = serveTemplate(ExecuteTemplateHandler, "POST", "ground", userJSON)
+	if w.Code != http.StatusOK {
+		t.Errorf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	assertWorkspacesRemoved(t)
+}
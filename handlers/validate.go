@@ -0,0 +1,268 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+)
+
+// validateWeight is the weight of validating a pipeline in the worker pool.
+const validateWeight = 1
+
+// StageDiagnostic describes the problems found with a stage of a pipeline.
+type StageDiagnostic struct {
+	Stage int    `json:"stage"`
+	Type  string `json:"type,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	// Errors make the pipeline invalid.
+	Errors []string `json:"errors,omitempty"`
+	// Warnings describe what could not be checked, e.g., inputs that would
+	// have been downloaded.
+	Warnings []string `json:"warnings,omitempty"`
+	// Unchecked is set if PDAL did not get as far as checking the stage.
+	Unchecked bool `json:"unchecked,omitempty"`
+}
+
+// PipelineValidation is the result of validating a pipeline. It is valid if
+// no errors were found, and complete if PDAL checked every stage and found
+// nothing wrong.
+type PipelineValidation struct {
+	Valid    bool              `json:"valid"`
+	Complete bool              `json:"complete"`
+	Stages   []StageDiagnostic `json:"stages"`
+	// Errors are those that PDAL did not attribute to a stage.
+	Errors []string `json:"errors,omitempty"`
+	// Pipeline is the rewritten pipeline that PDAL validated, if it got that
+	// far.
+	Pipeline []interface{} `json:"pipeline,omitempty"`
+}
+
+// stage returns the diagnostic of the k-th stage, or nil if there is none.
+func (v *PipelineValidation) stage(k int) *StageDiagnostic {
+	if k < 0 || k >= len(v.Stages) {
+		return nil
+	}
+	return &v.Stages[k]
+}
+
+// addError attributes an error to the k-th stage, or to the pipeline if there
+// is no such stage.
+func (v *PipelineValidation) addError(k int, msg string) {
+	if d := v.stage(k); d != nil {
+		d.Errors = append(d.Errors, msg)
+	} else {
+		v.Errors = append(v.Errors, msg)
+	}
+	v.Valid = false
+}
+
+// fieldStage returns the index of the stage that a field of the pipeline,
+// e.g., "pipeline[2].type", belongs to, and the rest of the field.
+func fieldStage(field string) (int, string) {
+	s, ok := strings.CutPrefix(field, "pipeline[")
+	if !ok {
+		return -1, field
+	}
+	i, rest, ok := strings.Cut(s, "]")
+	if !ok {
+		return -1, field
+	}
+	k, err := strconv.Atoi(i)
+	if err != nil {
+		return -1, field
+	}
+	return k, strings.TrimPrefix(rest, ".")
+}
+
+var (
+	driversMu sync.Mutex
+	// drivers are the names of the installed PDAL drivers, once known.
+	drivers map[string]bool
+)
+
+// installedDrivers returns the names of the stages that the installed PDAL
+// has drivers for. PDAL is only asked once it has answered.
+func installedDrivers(ctx context.Context) (map[string]bool, error) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if drivers != nil {
+		return drivers, nil
+	}
+
+	b, err := functions.PDAL.Run(ctx, "--drivers", "--showjson")
+	if err != nil {
+		return nil, err
+	}
+	var list []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("error listing PDAL drivers: %v", err)
+	}
+	found := make(map[string]bool, len(list))
+	for _, d := range list {
+		found[d.Name] = true
+	}
+	drivers = found
+	return drivers, nil
+}
+
+/*
+ValidatePipelineHandler checks a pipeline, as PipelineHandler would run it,
+without downloading or running anything.
+
+Every stage is checked as PipelineHandler checks it, and against the drivers
+that PDAL has installed. If those checks pass, the pipeline is rewritten as it
+would be run, and checked by "pdal pipeline --validate". Since inputs are not
+downloaded, PDAL failing to open one is reported as a warning on its reader,
+and the stages after it are marked unchecked, so the validation is not
+complete. Stages are numbered from 0, as in the fields of their errors. The
+response, with 200 OK whether or not the pipeline is valid, gives the
+problems found with each stage.
+*/
+func ValidatePipelineHandler(w http.ResponseWriter, r *http.Request) *AppError {
+	b, e := readPipeline(w, r)
+	if e != nil {
+		return e
+	}
+
+	stages, err := parsePipeline(b)
+	verrs, invalid := err.(functions.ValidationError)
+	if err != nil && !invalid {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+
+	res := PipelineValidation{Valid: true, Stages: make([]StageDiagnostic, len(stages))}
+	for k, s := range stages {
+		res.Stages[k] = StageDiagnostic{Stage: k, Kind: s.kind}
+		res.Stages[k].Type, _ = s.object["type"].(string)
+	}
+	for _, fe := range verrs {
+		k, field := fieldStage(fe.Field)
+		msg := fe.Message
+		if field != "" {
+			msg = field + " " + msg
+		}
+		res.addError(k, msg)
+	}
+
+	// PDAL is only asked once a worker is free, as for any other job.
+	t, err := Workers.Reserve(validateWeight)
+	if err != nil {
+		return poolFullError(w)
+	}
+	defer t.Release()
+	if err := t.Wait(r.Context()); err != nil {
+		return &AppError{err, err.Error(), http.StatusServiceUnavailable}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), functions.DefaultTimeout)
+	defer cancel()
+
+	// Stage types that PDAL would not recognize are reported all at once,
+	// rather than one at a time by PDAL.
+	if installed, err := installedDrivers(ctx); err != nil {
+		log.Println("Not checking stage types, as the installed drivers are unknown:", err)
+	} else {
+		for k, d := range res.Stages {
+			if d.Type != "" && !installed[d.Type] {
+				res.addError(k, "type "+d.Type+" is not installed")
+			}
+		}
+	}
+
+	if res.Valid {
+		if err := validate(ctx, stages, &res); err != nil {
+			return &AppError{err, err.Error(), errorStatus(err)}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		return &AppError{err, err.Error(), http.StatusInternalServerError}
+	}
+	return nil
+}
+
+// validate rewrites stages in a workspace as PipelineHandler would, and
+// checks them with PDAL, adding any problems found to res. It returns an
+// error only if PDAL could not be asked.
+func validate(ctx context.Context, stages []pipelineStage, res *PipelineValidation) error {
+	ws, err := NewWorkspace()
+	if err != nil {
+		return err
+	}
+	defer ws.Remove()
+
+	p := rewritePipeline(ws, stages)
+	res.Pipeline = p.stages
+	name, err := p.write(ws)
+	if err != nil {
+		return err
+	}
+
+	out, err := functions.PDAL.Run(ctx, "pipeline", name, "--validate")
+	log.Println(string(out))
+	pe, ok := err.(*functions.PdalError)
+	if err != nil && !ok {
+		return contextError(ctx, err)
+	}
+	if pe == nil {
+		res.Complete = true
+		return nil
+	}
+
+	// Find the stage PDAL complained about, by the input it could not open or
+	// else by its type.
+	k := -1
+	for i, s := range stages {
+		if !s.ref.IsZero() && s.kind == stageReader && pe.Code == functions.ErrInvalidInput &&
+			strings.Contains(pe.Message, filepath.Base(rewrittenFilename(p.stages[i]))) {
+			res.Stages[i].Warnings = append(res.Stages[i].Warnings, "input was not downloaded, so was not checked: "+pe.Message)
+			for j := i + 1; j < len(res.Stages); j++ {
+				res.Stages[j].Unchecked = true
+			}
+			return nil
+		}
+		if k < 0 && pe.Stage != "" && res.Stages[i].Type == pe.Stage {
+			k = i
+		}
+	}
+	res.addError(k, pe.Message)
+	return nil
+}
+
+// rewrittenFilename returns the filename of a rewritten stage.
+func rewrittenFilename(stage interface{}) string {
+	if object, ok := stage.(map[string]interface{}); ok {
+		name, _ := object["filename"].(string)
+		return name
+	}
+	name, _ := stage.(string)
+	return name
+}
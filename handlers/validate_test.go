@@ -0,0 +1,199 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+)
+
+// driverLister lists installedJSON as PDAL's drivers, leaving everything else
+// to the Recorder.
+type driverLister struct {
+	*pdaltest.Recorder
+	installedJSON string
+}
+
+func (d driverLister) Run(ctx context.Context, args ...string) ([]byte, error) {
+	if len(args) > 0 && args[0] == "--drivers" {
+		return []byte(d.installedJSON), nil
+	}
+	return d.Recorder.Run(ctx, args...)
+}
+
+func setupValidate(t *testing.T, rec *pdaltest.Recorder) func() {
+	_, teardown := setup(t, rec)
+	restore := pdaltest.Install(driverLister{rec, `[
+		{"name": "readers.las", "description": "ASPRS LAS 1.0 - 1.4 read support."},
+		{"name": "filters.crop", "description": "Filter points inside or outside a bounding box."},
+		{"name": "filters.range", "description": "Pass only points given a dimension/range."},
+		{"name": "writers.las", "description": "ASPRS LAS 1.0 - 1.4 writer."}
+	]`})
+	return func() {
+		restore()
+		teardown()
+		drivers = nil
+	}
+}
+
+func validatePipeline(t *testing.T, userJSON string) PipelineValidation {
+	w := post(ValidatePipelineHandler, "/api/v1/pipeline/validate", userJSON)
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusOK expected: %d %s", w.Code, w.Body)
+	}
+	var res PipelineValidation
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestValidatePipeline(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	defer setupValidate(t, rec)()
+
+	userJSON := `{
+		"pipeline": [
+			{"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+			{"type": "filters.crop", "bounds": "([0,1],[0,1])"},
+			"s3://venicegeo-sample-data/temp/cropped.laz"
+		]
+	}`
+	res := validatePipeline(t, userJSON)
+	if !res.Valid || !res.Complete || len(res.Stages) != 3 || len(res.Pipeline) != 3 {
+		t.Fatalf("Expected a valid pipeline, got %+v", res)
+	}
+	if last := rec.Last(); len(last) != 3 || last[0] != "pipeline" || last[2] != "--validate" {
+		t.Errorf("Expected pdal pipeline --validate, got %v", last)
+	}
+	p := string(rec.LastPipeline())
+	if !strings.Contains(p, "download_file-0.laz") || !strings.Contains(p, "upload_file-0.laz") {
+		t.Errorf("Expected the pipeline to be rewritten as it would be run, got %s", p)
+	}
+	if res.Stages[1].Type != "filters.crop" || res.Stages[1].Kind != stageFilter || res.Stages[2].Kind != stageWriter {
+		t.Errorf("Unexpected stages %+v", res.Stages)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestValidatePipelineRemoteInput(t *testing.T) {
+	rec := &pdaltest.Recorder{
+		ExitCode: 1,
+		Stderr:   []byte("PDAL: Unable to open stream for '" + WorkspaceRoot + "/job-1/download_file-0.laz' with error 'No such file or directory'"),
+	}
+	defer setupValidate(t, rec)()
+
+	// The input is not downloaded, so PDAL stops at its reader, but nothing
+	// is wrong with the pipeline.
+	res := validatePipeline(t, `{
+		"pipeline": [
+			"https://example.com/pointcloud/samp71-utm.laz",
+			{"type": "filters.crop", "bounds": "([0,1],[0,1])"},
+			"s3://venicegeo-sample-data/temp/cropped.laz"
+		]
+	}`)
+	if !res.Valid || res.Complete {
+		t.Errorf("Expected a valid but incomplete validation, got %+v", res)
+	}
+	if len(res.Stages[0].Warnings) != 1 || res.Stages[0].Unchecked || !res.Stages[1].Unchecked || !res.Stages[2].Unchecked {
+		t.Errorf("Expected the stages after the input to go unchecked, got %+v", res.Stages)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestValidatePipelineInvalid(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	defer setupValidate(t, rec)()
+
+	// Problems found before PDAL is asked are all reported, by stage.
+	userJSON := `{
+		"pipeline": [
+			{"type": "readers.las", "filename": "/etc/passwd"},
+			{"type": "filters.python", "script": "evil.py"},
+			{"type": "filters.smrf"},
+			{"type": "writers.las", "filename": "out.laz"}
+		]
+	}`
+	res := validatePipeline(t, userJSON)
+	if res.Valid {
+		t.Fatalf("Expected an invalid pipeline, got %+v", res)
+	}
+	want := map[int]string{0: "filename", 1: "filters.python is not allowed", 2: "filters.smrf is not installed"}
+	for k, msg := range want {
+		if errs := res.Stages[k].Errors; len(errs) == 0 || !strings.Contains(errs[0], msg) {
+			t.Errorf("Expected stage %d to have error %q, got %v", k, msg, errs)
+		}
+	}
+	if len(res.Stages[3].Errors) != 0 {
+		t.Errorf("Expected no errors for the writer, got %v", res.Stages[3].Errors)
+	}
+	if len(rec.Pipelines()) != 0 {
+		t.Error("Expected PDAL not to be asked to validate the pipeline")
+	}
+
+	// Problems found by PDAL are reported with their stage.
+	rec.ExitCode = 1
+	rec.Stderr = []byte("PDAL: filters.range: Invalid 'limits' option: 'Classification'")
+	userJSON = `{
+		"pipeline": [
+			{"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"},
+			{"type": "filters.range", "limits": "Classification"},
+			"s3://venicegeo-sample-data/temp/ground.laz"
+		]
+	}`
+	res = validatePipeline(t, userJSON)
+	if res.Valid || len(res.Stages[1].Errors) != 1 || !strings.Contains(res.Stages[1].Errors[0], "limits") {
+		t.Errorf("Expected filters.range to be invalid, got %+v", res)
+	}
+
+	// Inputs are not downloaded, so PDAL cannot open them.
+	rec.Stderr = []byte("PDAL: Unable to open stream for '" + WorkspaceRoot + "/job-1/download_file-0.laz' with error 'No such file or directory'")
+	res = validatePipeline(t, userJSON)
+	if !res.Valid || res.Complete || len(res.Stages[0].Warnings) != 1 || res.Stages[0].Unchecked {
+		t.Errorf("Expected a warning for the unread input, got %+v", res)
+	}
+	if !res.Stages[1].Unchecked || !res.Stages[2].Unchecked || len(res.Stages[1].Errors) != 0 {
+		t.Errorf("Expected the stages after the input to go unchecked, got %+v", res)
+	}
+
+	w := post(ValidatePipelineHandler, "/api/v1/pipeline/validate", `{"stages": []}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("StatusBadRequest expected: %d %s", w.Code, w.Body)
+	}
+	assertWorkspacesRemoved(t)
+}
+
+func TestValidatePipelineDriversUnknown(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	_, teardown := setup(t, rec)
+	defer teardown()
+	defer pdaltest.Install(driverLister{rec, "not json"})()
+	defer func() { drivers = nil }()
+
+	res := validatePipeline(t, `{"pipeline": ["s3://venicegeo-sample-data/pointcloud/samp71-utm.laz", {"type": "filters.smrf"}, {"filename": "out.laz"}]}`)
+	if !res.Valid {
+		t.Errorf("Expected stage types to go unchecked, got %+v", res)
+	}
+	if drivers != nil {
+		t.Error("Expected drivers not to be cached")
+	}
+}
@@ -18,29 +18,32 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
+	"path"
 	"strconv"
+
+	"github.com/venicegeo/pzsvc-pdal/functions"
+	"github.com/venicegeo/pzsvc-pdal/storage"
 )
 
 // VoOptions defines options for the VO function.
 type VoOptions struct {
-	Filename    *string `json:"filename"` // list of input file paths
-	AGL         float64 `json:"agl"`
-	MaxSize     uint16  `json:"max_size"`
-	MinSize     uint16  `json:"min_size"`
-	Resolution  float64 `json:"resolution"`
-	Tolerance   float64 `json:"tolerance"`
-	Z0Tolerance float64 `json:"z0_tolerance"`
-	Denoise     bool    `json:"denoise"`
-	InSRS       *string `json:"in_srs"`
-	OutSRS      *string `json:"out_srs"`
+	Filename    *storage.Ref `json:"filename"` // location of the input
+	AGL         float64      `json:"agl"`
+	MaxSize     uint16       `json:"max_size"`
+	MinSize     uint16       `json:"min_size"`
+	Resolution  float64      `json:"resolution"`
+	Tolerance   float64      `json:"tolerance"`
+	Z0Tolerance float64      `json:"z0_tolerance"`
+	Denoise     bool         `json:"denoise"`
+	InSRS       *string      `json:"in_srs"`
+	OutSRS      *string      `json:"out_srs"`
 }
 
 // NewVoOptions constructs VoOptions with default values.
@@ -48,6 +51,67 @@ func NewVoOptions() *VoOptions {
 	return &VoOptions{AGL: 20.0, MaxSize: 65535, MinSize: 1, Resolution: 10, Tolerance: 3, Z0Tolerance: 6.0}
 }
 
+// JSONSchema describes VoOptions. The in_srs and out_srs options must be given
+// together.
+func (o *VoOptions) JSONSchema() *functions.Schema {
+	zero, maxUint16 := 0.0, 65535.0
+	size := func(description string, def uint16) *functions.Schema {
+		min := 1.0
+		return &functions.Schema{
+			Description: description,
+			Type:        "integer",
+			Default:     def,
+			Minimum:     &min,
+			Maximum:     &maxUint16,
+			Units:       "points",
+		}
+	}
+	distance := func(description string, def float64, exclusive bool) *functions.Schema {
+		return &functions.Schema{
+			Description:      description,
+			Type:             "number",
+			Default:          def,
+			Minimum:          &zero,
+			ExclusiveMinimum: exclusive,
+			Units:            "coordinate system units",
+		}
+	}
+	return &functions.Schema{
+		Schema:      functions.SchemaVersion,
+		Title:       "vo",
+		Description: "Options for the /vo endpoint",
+		Type:        "object",
+		Properties: map[string]*functions.Schema{
+			"filename":     storageSchema("location of the input point cloud"),
+			"agl":          distance("minimum height above ground of vector objects", o.AGL, false),
+			"max_size":     size("maximum number of points in a vector object", o.MaxSize),
+			"min_size":     size("minimum number of points in a vector object", o.MinSize),
+			"resolution":   distance("resolution of the grid used to segment objects", o.Resolution, true),
+			"tolerance":    distance("tolerance used to simplify object outlines", o.Tolerance, false),
+			"z0_tolerance": distance("tolerance used to identify the ground surface", o.Z0Tolerance, false),
+			"denoise": {
+				Description: "remove statistical outliers prior to extraction",
+				Type:        "boolean",
+				Default:     o.Denoise,
+			},
+			"in_srs": {
+				Description: "spatial reference system of the input, e.g., EPSG:4326",
+				Type:        "string",
+			},
+			"out_srs": {
+				Description: "spatial reference system to reproject to, e.g., EPSG:32615",
+				Type:        "string",
+			},
+		},
+		Required:             []string{"filename"},
+		AdditionalProperties: new(bool),
+		Dependencies: map[string][]string{
+			"in_srs":  {"out_srs"},
+			"out_srs": {"in_srs"},
+		},
+	}
+}
+
 func getFloatAsString(name string, val float64) string {
 	return name + "=" + strconv.FormatFloat(val, 'f', -1, 64)
 }
@@ -56,6 +120,9 @@ func getUintAsString(name string, val uint16) string {
 	return name + "=" + strconv.FormatUint(uint64(val), 10)
 }
 
+// voWeight is the weight of a VO job in the worker pool.
+const voWeight = 2
+
 // VoHandler handles PDAL jobs.
 func VoHandler(w http.ResponseWriter, r *http.Request) *AppError {
 	if r.Body == nil {
@@ -68,28 +135,52 @@ func VoHandler(w http.ResponseWriter, r *http.Request) *AppError {
 	}
 
 	opts := NewVoOptions()
-	if b != nil {
-		if err := json.Unmarshal(b, &opts); err != nil {
-			return &AppError{err, err.Error(), http.StatusInternalServerError}
-		}
-	}
 
-	if opts.Filename == nil {
-		return &AppError{err, "No filename", http.StatusInternalServerError}
+	// Validate the options before anything is downloaded, throwing 400 with
+	// every problem found.
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+	if errs := opts.JSONSchema().Validate(raw); len(errs) > 0 {
+		return &AppError{errs, errs.Error(), http.StatusBadRequest}
+	}
+	if err := json.Unmarshal(b, &opts); err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
+	}
+	if opts.Filename == nil || opts.Filename.IsZero() {
+		errs := functions.ValidationError{{Field: "filename", Message: "is required"}}
+		return &AppError{errs, errs.Error(), http.StatusBadRequest}
+	}
+	if err := opts.Filename.Check(); err != nil {
+		return &AppError{err, err.Error(), http.StatusBadRequest}
 	}
 
-	s3url, err := url.Parse(*opts.Filename)
+	t, err := Workers.Reserve(voWeight)
 	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+		return poolFullError(w)
+	}
+	defer t.Release()
+	if err := t.Wait(r.Context()); err != nil {
+		return &AppError{err, err.Error(), http.StatusServiceUnavailable}
 	}
 
-	name, _, err := inferAndDownload(s3url)
+	ws, err := NewWorkspace()
 	if err != nil {
 		return &AppError{err, err.Error(), http.StatusInternalServerError}
 	}
+	defer ws.Remove()
 
-	outFile := "out.json"
-	os.Remove(outFile)
+	ctx, cancel := context.WithTimeout(r.Context(), functions.DefaultTimeout)
+	defer cancel()
+
+	name := ws.DownloadPath(path.Ext(opts.Filename.Base()))
+	if _, err := storage.Download(ctx, *opts.Filename, name); err != nil {
+		err = contextError(ctx, err)
+		return &AppError{err, err.Error(), errorStatus(err)}
+	}
+
+	outFile := ws.Path("out.json")
 
 	args := []string{
 		"translate", name, outFile,
@@ -110,9 +201,9 @@ func VoHandler(w http.ResponseWriter, r *http.Request) *AppError {
 		args = append(args, "-f", "filters.statisticaloutlier", "--filters.statisticaloutlier.extract=true")
 	}
 	log.Println("PDAL CLI called with args", args)
-	out, err := exec.Command("pdal", args...).CombinedOutput()
+	out, err := functions.PDAL.Run(ctx, args...)
 	if err != nil {
-		return &AppError{err, err.Error(), http.StatusInternalServerError}
+		return &AppError{err, err.Error(), errorStatus(err)}
 	}
 	log.Println("PDAL CLI responded with")
 	log.Println(string(out))
@@ -135,12 +226,7 @@ func VoHandler(w http.ResponseWriter, r *http.Request) *AppError {
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, buffer.String())
-
-	// TODO(chambbj): there is a case where we have assigned a projected, which
-	// created another file that needs to be cleaned up...may be better in the
-	// future to create/use a temp dir that just gets cleared, wiping everything
-	os.Remove(name)
+	fmt.Fprint(w, buffer.String())
 
 	return nil
 }
@@ -0,0 +1,46 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-pdal/functions/pdaltest"
+)
+
+func TestVoErrors(t *testing.T) {
+	rec := &pdaltest.Recorder{}
+	_, teardown := setup(t, rec)
+	defer teardown()
+
+	for _, userJSON := range []string{
+		`{}`,
+		`{"filename": null}`,
+		`{"filename": {}}`,
+		`{"filename": "ftp://host/in.laz"}`,
+	} {
+		w := post(VoHandler, "/api/v1/vo", userJSON)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: StatusBadRequest expected: %d %s", userJSON, w.Code, w.Body)
+		}
+	}
+	if len(rec.Calls()) != 0 {
+		t.Error("Expected PDAL not to run")
+	}
+	assertWorkspacesRemoved(t)
+}
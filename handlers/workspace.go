@@ -0,0 +1,140 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WorkspaceRoot is the directory under which per-job workspaces are created.
+// It must not be shared by concurrently running instances of the service, as
+// CleanWorkspaces removes every job- directory it finds there. Only those are
+// removed: by default, the input cache, result cache and templates live here
+// too, and must survive restarts.
+var WorkspaceRoot = filepath.Join(os.TempDir(), "pzsvc-pdal")
+
+const workspacePrefix = "job-"
+
+// stepsDir is the directory, within a workspace, holding the intermediate
+// files of a chain of steps.
+const stepsDir = "steps"
+
+// Workspace is a scratch directory owned by a single job. Every file that is
+// downloaded, produced, or uploaded on behalf of the job lives here, so that
+// concurrent jobs cannot clobber one another.
+type Workspace struct {
+	Dir string
+
+	mu        sync.Mutex
+	readerNum int
+	writerNum int
+}
+
+// NewWorkspace creates a new, empty workspace beneath WorkspaceRoot.
+func NewWorkspace() (*Workspace, error) {
+	if err := os.MkdirAll(WorkspaceRoot, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(WorkspaceRoot, workspacePrefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(filepath.Join(dir, stepsDir), 0755); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Workspace{Dir: dir}, nil
+}
+
+// Path returns the location of the named file within the workspace. Only the
+// final element of name is used, and one that names no file (e.g., "..", as
+// for a URL ending in "/..") is replaced by "file", so the result never
+// escapes the workspace.
+func (ws *Workspace) Path(name string) string {
+	base := filepath.Base(name)
+	if base == "." || base == ".." || base == string(filepath.Separator) {
+		base = "file"
+	}
+	return filepath.Join(ws.Dir, base)
+}
+
+// StepPath returns the location of the named intermediate file of a chain of
+// steps. Intermediate files are kept in a directory of their own, so that they
+// cannot collide with files named after the source or destination.
+func (ws *Workspace) StepPath(name string) string {
+	return filepath.Join(ws.Dir, stepsDir, filepath.Base(name))
+}
+
+// DownloadPath returns a unique path for the next downloaded input, preserving
+// the given extension so that PDAL can infer the appropriate reader.
+func (ws *Workspace) DownloadPath(ext string) string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	name := "download_file-" + strconv.Itoa(ws.readerNum) + ext
+	ws.readerNum++
+	return ws.Path(name)
+}
+
+// UploadPath returns a unique path for the next output to be uploaded,
+// preserving the given extension so that PDAL can infer the appropriate
+// writer.
+func (ws *Workspace) UploadPath(ext string) string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	name := "upload_file-" + strconv.Itoa(ws.writerNum) + ext
+	ws.writerNum++
+	return ws.Path(name)
+}
+
+// Remove deletes the workspace and everything in it.
+func (ws *Workspace) Remove() {
+	if err := os.RemoveAll(ws.Dir); err != nil {
+		log.Println("Error removing workspace", ws.Dir, err)
+	}
+}
+
+// CleanWorkspaces removes any workspaces (job- directories) left beneath
+// WorkspaceRoot, e.g., by a previous instance of the service that crashed
+// mid-job, leaving everything else there alone. It should be called once at
+// startup, before any jobs are accepted.
+func CleanWorkspaces() (int, error) {
+	entries, err := ioutil.ReadDir(WorkspaceRoot)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), workspacePrefix) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(WorkspaceRoot, e.Name())); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkspacePath(t *testing.T) {
+	ws := &Workspace{Dir: filepath.Join("root", "job-1")}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"in.laz", "in.laz"},
+		{"../../etc/passwd", "passwd"},
+		{"..", "file"},
+		{".", "file"},
+		{"", "file"},
+		{"/", "file"},
+	}
+	for _, tt := range tests {
+		if got := ws.Path(tt.name); got != filepath.Join(ws.Dir, tt.want) {
+			t.Errorf("%q: expected %s, got %s", tt.name, filepath.Join(ws.Dir, tt.want), got)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// InputCache, if set, holds copies of downloaded objects for reuse by later
+// downloads of the same version of the object.
+var InputCache *Cache
+
+/*
+Cache is an on-disk cache of downloaded objects, shared by concurrent jobs.
+
+Objects are keyed by URL and version, i.e., their ETag or, failing that, their
+size and modification time, so each download costs a Stat to find the current
+version. Objects whose version is unknown, local files, and objects larger than
+the cache are not cached. Once the cache holds more than its maximum size, the
+least recently used objects that are not being copied out are evicted.
+
+Concurrent downloads of the same object wait for the first to finish, rather
+than downloading it again.
+*/
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry
+	lru       list.List // of *cacheEntry, most recently used first
+	size      int64
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// cacheEntry is a cached object, or one being downloaded.
+type cacheEntry struct {
+	key  string
+	path string
+	size int64
+	refs int           // jobs using or waiting for the entry
+	done chan struct{} // closed once the download finishes
+	err  error         // why the download failed, if it did
+	elem *list.Element // in the LRU list, once downloaded
+}
+
+// NewCache constructs a Cache holding at most maxSize bytes in dir, removing
+// anything left there by a previous Cache.
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if isCacheFile(e.Name()) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &Cache{dir: dir, maxSize: maxSize, entries: make(map[string]*cacheEntry)}, nil
+}
+
+// cacheKey identifies the given version of the object at rawurl.
+func cacheKey(rawurl string, info Info) string {
+	sum := sha256.Sum256([]byte(rawurl + "\n" + info.Version()))
+	return hex.EncodeToString(sum[:])
+}
+
+// isCacheFile reports whether name is that of a cached object, or one being
+// downloaded.
+func isCacheFile(name string) bool {
+	if filepath.Ext(name) == ".part" {
+		name = name[:len(name)-len(".part")]
+	}
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// Download copies the object that ref refers to to the local file name, from
+// the cache if possible, returning the number of bytes copied.
+func (c *Cache) Download(ctx context.Context, ref Ref, name string) (int64, error) {
+	u, err := url.Parse(ref.URL)
+	if err != nil || u.Scheme == "file" {
+		return download(ctx, ref, name)
+	}
+	// The Stat also checks that any headers given grant access to the object.
+	// Some URLs, e.g., presigned S3 URLs, cannot be Stat'd, but may still be
+	// downloaded.
+	info, err := StatRef(ctx, ref)
+	if err != nil || info.Version() == "" || info.Size > c.maxSize {
+		return download(ctx, ref, name)
+	}
+
+	e, err := c.acquire(ctx, ref, cacheKey(ref.URL, info))
+	if err != nil {
+		return 0, err
+	}
+	defer c.release(e)
+
+	// The copy is the job's own: a link would let a pipeline that writes to
+	// its input corrupt the entry for every other job.
+	os.Remove(name)
+	if err := copyFile(e.path, name); err != nil {
+		return 0, err
+	}
+	return e.size, nil
+}
+
+// acquire returns the downloaded entry for key, downloading it if need be.
+// The caller must release the entry once done with it.
+func (c *Cache) acquire(ctx context.Context, ref Ref, key string) (*cacheEntry, error) {
+	for {
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		if !ok {
+			break
+		}
+		e.refs++
+		c.mu.Unlock()
+
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			c.release(e)
+			return nil, ctx.Err()
+		}
+		if e.err != nil {
+			// Whoever was downloading it failed, perhaps only because they
+			// gave up, so try again ourselves.
+			c.release(e)
+			continue
+		}
+		c.mu.Lock()
+		c.hits++
+		c.lru.MoveToFront(e.elem)
+		c.mu.Unlock()
+		return e, nil
+	}
+
+	// The lock is still held.
+	e := &cacheEntry{key: key, path: filepath.Join(c.dir, key), refs: 1, done: make(chan struct{})}
+	c.entries[key] = e
+	c.misses++
+	c.mu.Unlock()
+
+	// Entries are read-only, as they are never modified once downloaded.
+	n, err := download(ctx, ref, e.path+".part")
+	if err == nil {
+		err = os.Chmod(e.path+".part", 0444)
+	}
+	if err == nil {
+		err = os.Rename(e.path+".part", e.path)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		os.Remove(e.path + ".part")
+		delete(c.entries, key)
+		e.err = err
+		e.refs--
+		close(e.done)
+		return nil, err
+	}
+	e.size = n
+	e.elem = c.lru.PushFront(e)
+	c.size += n
+	c.evict()
+	close(e.done)
+	return e, nil
+}
+
+// release gives up the caller's use of e.
+func (c *Cache) release(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refs--
+	c.evict()
+}
+
+// evict removes the least recently used entries not in use until the cache
+// is within its maximum size. The caller must hold c.mu.
+func (c *Cache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.size > c.maxSize; {
+		prev := elem.Prev()
+		e := elem.Value.(*cacheEntry)
+		if e.refs == 0 {
+			if err := os.Remove(e.path); err != nil {
+				log.Println("Error evicting", e.path, err)
+			}
+			c.lru.Remove(elem)
+			delete(c.entries, e.key)
+			c.size -= e.size
+			c.evictions++
+		}
+		elem = prev
+	}
+}
+
+// CacheStats describes the state of a Cache.
+type CacheStats struct {
+	MaxSize   int64 `json:"max_size"`
+	Size      int64 `json:"size"`
+	Entries   int   `json:"entries"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// Stats returns the current state of the Cache.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		MaxSize:   c.maxSize,
+		Size:      c.size,
+		Entries:   c.lru.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// copyFile copies the file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
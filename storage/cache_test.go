@@ -0,0 +1,132 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/venicegeo/pzsvc-pdal/storage"
+	"github.com/venicegeo/pzsvc-pdal/storage/storagetest"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := storagetest.NewMemory()
+	defer storagetest.Install("s3", mem)()
+	mem.Put("s3://bucket/a.laz", []byte("aaaaaaaa"))
+	mem.Put("s3://bucket/b.laz", []byte("bbbbbbbb"))
+
+	// Leftovers from a previous run are removed, but nothing else.
+	cacheDir := filepath.Join(dir, "cache")
+	os.MkdirAll(cacheDir, 0755)
+	stale := filepath.Join(cacheDir, "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.part")
+	ioutil.WriteFile(stale, nil, 0644)
+	ioutil.WriteFile(filepath.Join(cacheDir, "keep"), nil, 0644)
+	c, err := storage.NewCache(cacheDir, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Expected stale download to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "keep")); err != nil {
+		t.Error("Expected unrelated file to be kept")
+	}
+
+	ctx := context.Background()
+	download := func(rawurl string, i int) string {
+		name := filepath.Join(dir, strconv.Itoa(i)+filepath.Ext(rawurl))
+		if n, err := c.Download(ctx, storage.URLRef(rawurl), name); err != nil || n != 8 {
+			t.Fatalf("Unexpected download of %d bytes from %s (%v)", n, rawurl, err)
+		}
+		b, _ := ioutil.ReadFile(name)
+		return string(b)
+	}
+
+	// Jobs get their own copies, so changing one leaves the cache intact.
+	download("s3://bucket/a.laz", 1)
+	ioutil.WriteFile(filepath.Join(dir, "1.laz"), []byte("xxxxxxxx"), 0644)
+	if got := download("s3://bucket/a.laz", 2); got != "aaaaaaaa" {
+		t.Errorf("Unexpected cached contents %q", got)
+	}
+	if n := mem.Opens("s3://bucket/a.laz"); n != 1 {
+		t.Errorf("Expected a single download, got %d", n)
+	}
+
+	// A changed object has a new ETag, so is downloaded again.
+	mem.Put("s3://bucket/a.laz", []byte("AAAAAAAA"))
+	if got := download("s3://bucket/a.laz", 3); got != "AAAAAAAA" {
+		t.Errorf("Expected changed object to be downloaded, got %q", got)
+	}
+
+	// Only one object fits, so the least recently used is evicted.
+	download("s3://bucket/b.laz", 4)
+	s := c.Stats()
+	if s.Hits != 1 || s.Misses != 3 || s.Entries != 1 || s.Size != 8 || s.Evictions != 2 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	// Evicted objects survive in the files they were copied to.
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "3.laz")); string(b) != "AAAAAAAA" {
+		t.Errorf("Expected evicted object to survive, got %q", b)
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := storagetest.NewMemory()
+	defer storagetest.Install("s3", mem)()
+	mem.Put("s3://bucket/a.laz", []byte("aaaaaaaa"))
+	c, err := storage.NewCache(filepath.Join(dir, "cache"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := filepath.Join(dir, strconv.Itoa(i)+".laz")
+			if _, err := c.Download(context.Background(), storage.URLRef("s3://bucket/a.laz"), name); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := mem.Opens("s3://bucket/a.laz"); n != 1 {
+		t.Errorf("Expected a single download, got %d", n)
+	}
+	if s := c.Stats(); s.Hits != 9 || s.Misses != 1 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+}
@@ -0,0 +1,33 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package storage reads and writes the point clouds, rasters, and other objects that the PDAL microservice consumes and produces.
+
+Objects are named by URL, and each URL scheme is handled by a registered Backend:
+
+	s3://bucket/key            S3
+	http://host/path           HTTP(S); objects are read with GET and written with PUT
+	https://host/path
+	file:///path               a local directory, if one has been registered with a FileSystem root
+
+Source and destination locations in requests are decoded as a Ref, which accepts either a URL string or, as the service has always accepted, an S3 object of the form
+
+	{"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"}
+
+Download and Upload copy objects to and from a job's workspace.
+*/
+package storage
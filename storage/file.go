@@ -0,0 +1,152 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+FileSystem is a Backend for file:///path URLs, which name files beneath Root.
+
+It is not registered by default, as it exposes the local filesystem. Paths
+cannot escape Root: file:///../etc/passwd names Root/etc/passwd.
+*/
+type FileSystem struct {
+	Root string
+}
+
+// path returns the local path named by u.
+func (b FileSystem) path(u *url.URL) (string, error) {
+	if b.Root == "" {
+		return "", errors.New("No root directory for file storage")
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", errors.New("File location " + u.String() + " must not name a host")
+	}
+	return filepath.Join(b.Root, filepath.FromSlash(path.Clean("/"+u.Path))), nil
+}
+
+// Open implements Backend.
+func (b FileSystem) Open(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	name, err := b.path(u)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// fileWriter writes to a temporary file, which replaces the object on Close.
+type fileWriter struct {
+	*os.File
+	name string
+}
+
+func (w *fileWriter) Close() error {
+	w.File.Chmod(0644)
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return os.Rename(w.File.Name(), w.name)
+}
+
+func (w *fileWriter) CloseWithError(error) error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// Create implements Backend. The object appears only once it is complete.
+func (b FileSystem) Create(ctx context.Context, u *url.URL) (io.WriteCloser, error) {
+	name, err := b.path(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+"-")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: file, name: name}, nil
+}
+
+// info describes fi, the file that u refers to.
+func (b FileSystem) info(u *url.URL, fi os.FileInfo) Info {
+	return Info{URL: u.String(), Size: fi.Size(), ModTime: fi.ModTime()}
+}
+
+// Stat implements Backend.
+func (b FileSystem) Stat(ctx context.Context, u *url.URL) (Info, error) {
+	name, err := b.path(u)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return Info{}, err
+	}
+	if fi.IsDir() {
+		return Info{}, errors.New(u.String() + " is a directory")
+	}
+	return b.info(u, fi), nil
+}
+
+// List implements Backend, listing every file whose path begins with the
+// URL's path.
+func (b FileSystem) List(ctx context.Context, u *url.URL) ([]Info, error) {
+	prefix, err := b.path(u)
+	if err != nil {
+		return nil, err
+	}
+	dir := prefix
+	if fi, err := os.Stat(prefix); err != nil || !fi.IsDir() {
+		dir = filepath.Dir(prefix)
+	}
+
+	var infos []Info
+	err = filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Root, name)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, b.info(&url.URL{Scheme: "file", Path: "/" + filepath.ToSlash(rel)}, fi))
+		return nil
+	})
+	return infos, err
+}
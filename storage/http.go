@@ -0,0 +1,198 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// HTTP is a Backend for http:// and https:// URLs. Objects are read with GET
+// and written with PUT or, if the Ref says so, POST (as multipart/form-data).
+// Any headers given in the Ref are sent with each request.
+type HTTP struct {
+	Client *http.Client
+}
+
+func init() {
+	Register("http", HTTP{})
+	Register("https", HTTP{})
+}
+
+func (b HTTP) client() *http.Client {
+	if b.Client != nil {
+		return b.Client
+	}
+	return http.DefaultClient
+}
+
+// StatusError describes an unexpected HTTP response.
+type StatusError struct {
+	Method string
+	URL    string
+	Status string
+	Code   int
+}
+
+func (e *StatusError) Error() string {
+	return "Error with " + e.Method + " " + e.URL + ": " + e.Status
+}
+
+// Temporary reports whether the request is worth retrying, i.e., whether the
+// server failed.
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500
+}
+
+func statusError(req *http.Request, resp *http.Response) error {
+	return &StatusError{Method: req.Method, URL: req.URL.String(), Status: resp.Status, Code: resp.StatusCode}
+}
+
+// newRequest creates a request with any headers given for the Ref being
+// transferred.
+func newRequest(ctx context.Context, method string, u *url.URL, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if ref, ok := refFromContext(ctx); ok {
+		for k, v := range ref.Headers {
+			req.Header.Set(k, v)
+		}
+	}
+	return req, nil
+}
+
+// Open implements Backend.
+func (b HTTP) Open(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	req, err := newRequest(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, statusError(req, resp)
+	}
+	return resp.Body, nil
+}
+
+// httpWriter streams an upload, recording the response.
+type httpWriter struct {
+	*pipeWriter
+	result UploadResult
+}
+
+func (w *httpWriter) Result() UploadResult {
+	return w.result
+}
+
+// Create implements Backend, streaming the object in the body of a PUT or, if
+// the Ref gives the method POST, as the "file" part of a multipart/form-data
+// POST. If the size of the object is known, as it is for Upload, it is sent as
+// the Content-Length, since many servers (e.g., S3, for presigned URLs) refuse
+// chunked uploads.
+func (b HTTP) Create(ctx context.Context, u *url.URL) (io.WriteCloser, error) {
+	method := "PUT"
+	if ref, ok := refFromContext(ctx); ok && ref.Method != "" {
+		method = ref.Method
+	}
+
+	w := &httpWriter{}
+	w.pipeWriter = newPipeWriter(func(r io.Reader) error {
+		body, contentType, overhead := r, "", int64(0)
+		if method == "POST" {
+			body, contentType, overhead = multipartBody(r, path.Base(u.Path))
+		}
+		req, err := newRequest(ctx, method, u, body)
+		if err != nil {
+			return err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if size, ok := sizeFromContext(ctx); ok {
+			req.ContentLength = size + overhead
+			if req.ContentLength == 0 {
+				req.Body = http.NoBody
+			}
+		}
+		resp, err := b.client().Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return statusError(req, resp)
+		}
+
+		w.result = UploadResult{URL: resp.Request.URL.String(), Status: resp.StatusCode}
+		if loc, err := resp.Location(); err == nil {
+			w.result.URL = loc.String()
+		}
+		return nil
+	})
+	return w, nil
+}
+
+// multipartBody wraps r as the "file" part of a multipart/form-data body,
+// returning the body, its content type, and the number of bytes it adds to r.
+func multipartBody(r io.Reader, filename string) (io.Reader, string, int64) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.CreateFormFile("file", filename)
+	n := buf.Len()
+	mw.Close()
+	head, tail := buf.Bytes()[:n], buf.Bytes()[n:]
+	body := io.MultiReader(bytes.NewReader(head), r, bytes.NewReader(tail))
+	return body, mw.FormDataContentType(), int64(buf.Len())
+}
+
+// Stat implements Backend.
+func (b HTTP) Stat(ctx context.Context, u *url.URL) (Info, error) {
+	req, err := newRequest(ctx, "HEAD", u, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp, err := b.client().Do(req)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Info{}, statusError(req, resp)
+	}
+	info := Info{URL: u.String(), Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	if t, err := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
+}
+
+// List is not supported over HTTP.
+func (b HTTP) List(ctx context.Context, u *url.URL) ([]Info, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import "io"
+
+// pipeWriter feeds what is written to it to a transfer running in the
+// background, e.g., an upload that consumes an io.Reader. Close waits for the
+// transfer to finish and returns its result.
+type pipeWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+// newPipeWriter starts transfer, which reads everything written to the
+// returned writer.
+func newPipeWriter(transfer func(io.Reader) error) *pipeWriter {
+	pr, pw := io.Pipe()
+	p := &pipeWriter{PipeWriter: pw, done: make(chan error, 1)}
+	go func() {
+		err := transfer(pr)
+		// Unblock any writer if the transfer gave up early.
+		pr.CloseWithError(err)
+		p.done <- err
+	}()
+	return p
+}
+
+// Close completes the transfer.
+func (p *pipeWriter) Close() error {
+	p.PipeWriter.Close()
+	return <-p.done
+}
+
+// CloseWithError abandons the transfer.
+func (p *pipeWriter) CloseWithError(err error) error {
+	p.PipeWriter.CloseWithError(err)
+	<-p.done
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+/*
+Ref refers to a stored object by URL, e.g., "s3://bucket/key",
+"https://host/path", or "file:///path".
+
+In JSON, a Ref may be given as a URL string, as an S3 object (as has long been
+accepted),
+
+	{"bucket": "venicegeo-sample-data", "key": "pointcloud/samp71-utm.laz"}
+
+or, for HTTP(S), as an object giving the method used to upload (PUT, the
+default, or POST, which sends the file as multipart/form-data) and any headers
+to send, e.g., for authorization:
+
+	{
+		"url": "https://example.com/upload",
+		"method": "POST",
+		"headers": {"Authorization": "Bearer ..."}
+	}
+
+It is always encoded as a URL string, so that headers are not revealed.
+*/
+type Ref struct {
+	URL     string
+	Method  string
+	Headers map[string]string
+}
+
+// URLRef refers to the object at rawurl.
+func URLRef(rawurl string) Ref {
+	return Ref{URL: rawurl}
+}
+
+// S3Ref refers to the given S3 object.
+func S3Ref(bucket, key string) Ref {
+	return URLRef("s3://" + bucket + "/" + strings.TrimLeft(key, "/"))
+}
+
+// UnmarshalJSON accepts any form of Ref.
+func (r *Ref) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*r = URLRef(s)
+		return nil
+	}
+
+	var obj struct {
+		Bucket  string            `json:"bucket"`
+		Key     string            `json:"key"`
+		URL     string            `json:"url"`
+		Method  string            `json:"method"`
+		Headers map[string]string `json:"headers"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&obj); err != nil {
+		return errors.New(`storage location must be a URL, an object with "bucket" and "key", or an object with "url"`)
+	}
+	switch {
+	case obj.URL != "" && obj.Bucket == "" && obj.Key == "":
+		*r = Ref{URL: obj.URL, Method: strings.ToUpper(obj.Method), Headers: obj.Headers}
+	case obj.URL == "" && obj.Method == "" && obj.Headers == nil:
+		if obj.Bucket == "" || obj.Key == "" {
+			return errors.New(`storage location must give both "bucket" and "key"`)
+		}
+		*r = S3Ref(obj.Bucket, obj.Key)
+	default:
+		return errors.New(`storage location must give either "url" or "bucket" and "key"`)
+	}
+	return nil
+}
+
+// MarshalJSON encodes only the URL.
+func (r Ref) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.URL)
+}
+
+// String returns the URL.
+func (r Ref) String() string {
+	return r.URL
+}
+
+// IsZero reports whether r refers to nothing.
+func (r Ref) IsZero() bool {
+	return r.URL == ""
+}
+
+// Check returns an error if r does not name a location that some Backend
+// handles, or gives a method or headers for anything but HTTP(S).
+func (r Ref) Check() error {
+	if err := Check(r.URL); err != nil {
+		return err
+	}
+	if r.Method == "" && r.Headers == nil {
+		return nil
+	}
+	if u, _ := url.Parse(r.URL); u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("Only HTTP(S) locations may give a method or headers")
+	}
+	switch r.Method {
+	case "", "PUT", "POST":
+		return nil
+	}
+	return errors.New("Unsupported upload method " + r.Method + ", expected PUT or POST")
+}
+
+// Base returns the last element of the path in r.
+func (r Ref) Base() string {
+	return Base(r.URL)
+}
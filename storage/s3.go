@@ -0,0 +1,228 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3 is a Backend for s3://bucket/key URLs.
+//
+// The S3 client cannot be interrupted, so the context is only consulted
+// between requests.
+type S3 struct {
+	config S3Config
+
+	mu      sync.Mutex
+	regions map[string]string // detected bucket regions
+}
+
+// NewS3 constructs an S3 Backend with the given configuration.
+func NewS3(config S3Config) *S3 {
+	return &S3{config: config, regions: make(map[string]string)}
+}
+
+func init() {
+	Register("s3", NewS3(S3Config{}))
+}
+
+// session returns a session configured for bucket.
+func (b *S3) session(bucket string) *session.Session {
+	cfg := &aws.Config{
+		Region:      aws.String(b.region(bucket)),
+		Credentials: b.creds(bucket),
+	}
+	if b.config.Endpoint != "" {
+		cfg.Endpoint = aws.String(b.config.Endpoint)
+	}
+	if b.config.PathStyle {
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	return session.New(cfg)
+}
+
+// creds returns the credentials for bucket, or nil for the defaults.
+func (b *S3) creds(bucket string) *credentials.Credentials {
+	profile := b.config.Profile
+	if p := b.config.Buckets[bucket].Profile; p != "" {
+		profile = p
+	}
+	if profile == "" {
+		return nil
+	}
+	return credentials.NewSharedCredentials(b.config.CredentialsFile, profile)
+}
+
+/*
+region returns the region of bucket. In order, we use
+
+  - the region configured for the bucket,
+  - the default region, if configured,
+  - the region reported by S3, unless we are using another endpoint, and
+  - DefaultRegion.
+
+Regions reported by S3 are remembered.
+*/
+func (b *S3) region(bucket string) string {
+	if r := b.config.Buckets[bucket].Region; r != "" {
+		return r
+	}
+	if b.config.Region != "" {
+		return b.config.Region
+	}
+	if b.config.Endpoint != "" {
+		return DefaultRegion
+	}
+
+	b.mu.Lock()
+	r, ok := b.regions[bucket]
+	b.mu.Unlock()
+	if ok {
+		return r
+	}
+
+	r = DefaultRegion
+	cfg := &aws.Config{Region: aws.String(DefaultRegion), Credentials: b.creds(bucket)}
+	out, err := s3.New(session.New(cfg)).GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		// Perhaps we may not ask, but may still read. Try again next time.
+		log.Println("Unable to detect region of bucket", bucket+":", err)
+		return r
+	}
+	switch loc := aws.StringValue(out.LocationConstraint); loc {
+	case "":
+	case "EU":
+		r = "eu-west-1"
+	default:
+		r = loc
+	}
+
+	b.mu.Lock()
+	b.regions[bucket] = r
+	b.mu.Unlock()
+	return r
+}
+
+// bucketKey splits an s3:// URL into its bucket and key.
+func bucketKey(u *url.URL) (string, string, error) {
+	key := strings.TrimLeft(u.Path, "/")
+	if u.Host == "" {
+		return "", "", errors.New("S3 location " + u.String() + " has no bucket")
+	}
+	return u.Host, key, nil
+}
+
+// Open implements Backend.
+func (b *S3) Open(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	bucket, key, err := bucketKey(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out, err := s3.New(b.session(bucket)).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Create implements Backend, uploading in parts as the object is written.
+func (b *S3) Create(ctx context.Context, u *url.URL) (io.WriteCloser, error) {
+	bucket, key, err := bucketKey(u)
+	if err != nil {
+		return nil, err
+	}
+	uploader := s3manager.NewUploader(b.session(bucket))
+	return newPipeWriter(func(r io.Reader) error {
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Body:   r,
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	}), nil
+}
+
+// Stat implements Backend.
+func (b *S3) Stat(ctx context.Context, u *url.URL) (Info, error) {
+	bucket, key, err := bucketKey(u)
+	if err != nil {
+		return Info{}, err
+	}
+	out, err := s3.New(b.session(bucket)).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{URL: u.String(), Size: aws.Int64Value(out.ContentLength)}
+	if out.LastModified != nil {
+		info.ModTime = *out.LastModified
+	}
+	info.ETag = aws.StringValue(out.ETag)
+	return info, nil
+}
+
+// List implements Backend, listing every object whose key begins with the
+// URL's path.
+func (b *S3) List(ctx context.Context, u *url.URL) ([]Info, error) {
+	bucket, prefix, err := bucketKey(u)
+	if err != nil {
+		return nil, err
+	}
+	var infos []Info
+	err = s3.New(b.session(bucket)).ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			info := Info{
+				URL:  S3Ref(bucket, aws.StringValue(obj.Key)).URL,
+				Size: aws.Int64Value(obj.Size),
+			}
+			if obj.LastModified != nil {
+				info.ModTime = *obj.LastModified
+			}
+			infos = append(infos, info)
+		}
+		return ctx.Err() == nil
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	return infos, err
+}
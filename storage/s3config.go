@@ -0,0 +1,123 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// DefaultRegion is used for buckets whose region is neither configured nor
+// detected.
+const DefaultRegion = "us-east-1"
+
+/*
+S3Config configures access to S3, or to an S3-compatible object store such as
+MinIO.
+
+For example, to use a local MinIO server,
+
+	{
+		"endpoint": "http://localhost:9000",
+		"path_style": true,
+		"profile": "minio"
+	}
+
+or, for real S3 with a bucket that needs its own credentials,
+
+	{
+		"region": "us-west-2",
+		"buckets": {
+			"venicegeo-sample-data": {"region": "us-east-1"},
+			"partner-data": {"profile": "partner"}
+		}
+	}
+*/
+type S3Config struct {
+	// Endpoint, if set, replaces the AWS endpoint, e.g.,
+	// "http://localhost:9000". Bucket regions are not detected.
+	Endpoint string `json:"endpoint,omitempty"`
+	// PathStyle addresses buckets as endpoint/bucket/key rather than
+	// bucket.endpoint/key, as most S3-compatible stores require.
+	PathStyle bool `json:"path_style,omitempty"`
+	// Region is the default region. If unset, each bucket's region is
+	// detected, falling back to DefaultRegion.
+	Region string `json:"region,omitempty"`
+	// Profile names the credentials to use from CredentialsFile. If unset,
+	// the usual AWS environment variables, shared profile, and instance role
+	// are tried in turn.
+	Profile string `json:"profile,omitempty"`
+	// CredentialsFile is the shared credentials file holding Profile, by
+	// default ~/.aws/credentials.
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	// Buckets overrides the region or profile for individual buckets.
+	Buckets map[string]S3BucketConfig `json:"buckets,omitempty"`
+}
+
+// S3BucketConfig overrides S3Config for a single bucket.
+type S3BucketConfig struct {
+	Region  string `json:"region,omitempty"`
+	Profile string `json:"profile,omitempty"`
+}
+
+// LoadS3Config reads an S3Config from the JSON file name.
+func LoadS3Config(name string) (S3Config, error) {
+	var cfg S3Config
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(b, &cfg)
+	return cfg, err
+}
+
+/*
+S3ConfigFromEnv overrides cfg with any of the following environment
+variables that are set.
+
+	S3_ENDPOINT               Endpoint
+	S3_PATH_STYLE             PathStyle ("true" or "false")
+	S3_REGION or AWS_REGION   Region
+	S3_PROFILE                Profile
+	AWS_SHARED_CREDENTIALS_FILE  CredentialsFile
+*/
+func S3ConfigFromEnv(cfg S3Config) (S3Config, error) {
+	if v := os.Getenv("S3_ENDPOINT"); v != "" {
+		cfg.Endpoint = v
+	}
+	if v := os.Getenv("S3_PATH_STYLE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.PathStyle = b
+	}
+	if v := os.Getenv("S3_REGION"); v != "" {
+		cfg.Region = v
+	} else if v := os.Getenv("AWS_REGION"); v != "" {
+		cfg.Region = v
+	}
+	if v := os.Getenv("S3_PROFILE"); v != "" {
+		cfg.Profile = v
+	}
+	if v := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); v != "" {
+		cfg.CredentialsFile = v
+	}
+	return cfg, nil
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNotSupported is returned by backends that cannot perform an operation,
+// e.g., listing over HTTP.
+var ErrNotSupported = errors.New("operation not supported by this storage backend")
+
+// Info describes a stored object.
+type Info struct {
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time,omitempty"`
+	// ETag identifies the version of the object, if the backend knows it.
+	ETag string `json:"etag,omitempty"`
+}
+
+// Version identifies the version of the object, i.e., its ETag or, failing
+// that, its size and modification time. It is empty if neither is known.
+func (i Info) Version() string {
+	if i.ETag != "" {
+		return i.ETag
+	}
+	if i.ModTime.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(i.Size, 10) + "@" + strconv.FormatInt(i.ModTime.UnixNano(), 10)
+}
+
+// Backend reads and writes objects named by URL. Each Backend handles the URL
+// schemes it is registered for.
+type Backend interface {
+	// Open returns the contents of the object.
+	Open(ctx context.Context, u *url.URL) (io.ReadCloser, error)
+	// Create returns a writer for the object. The object is only complete
+	// once Close has returned without error. If the writer also has a
+	// CloseWithError method, as io.PipeWriter does, it is used to abandon a
+	// failed transfer, and if it has a Result method, returning an
+	// UploadResult, that describes the completed object. Errors with a
+	// Temporary method that returns true are retried.
+	Create(ctx context.Context, u *url.URL) (io.WriteCloser, error)
+	// Stat describes the object.
+	Stat(ctx context.Context, u *url.URL) (Info, error)
+	// List describes the objects whose URLs begin with u.
+	List(ctx context.Context, u *url.URL) ([]Info, error)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]Backend)
+)
+
+// Register makes b handle URLs with the given scheme, replacing any Backend
+// previously registered for it.
+func Register(scheme string, b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[scheme] = b
+}
+
+// Lookup returns the Backend registered for scheme.
+func Lookup(scheme string) (Backend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	b, ok := backends[scheme]
+	return b, ok
+}
+
+// resolve parses rawurl, returning the Backend that handles it.
+func resolve(rawurl string) (Backend, *url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, ok := Lookup(u.Scheme)
+	if !ok {
+		return nil, nil, errors.New("Unsupported storage location " + rawurl)
+	}
+	return b, u, nil
+}
+
+// Open returns the contents of the object at rawurl.
+func Open(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	b, u, err := resolve(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return b.Open(ctx, u)
+}
+
+// Create returns a writer for the object at rawurl.
+func Create(ctx context.Context, rawurl string) (io.WriteCloser, error) {
+	b, u, err := resolve(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return b.Create(ctx, u)
+}
+
+// Stat describes the object at rawurl.
+func Stat(ctx context.Context, rawurl string) (Info, error) {
+	b, u, err := resolve(rawurl)
+	if err != nil {
+		return Info{}, err
+	}
+	return b.Stat(ctx, u)
+}
+
+// List describes the objects whose URLs begin with rawurl.
+func List(ctx context.Context, rawurl string) ([]Info, error) {
+	b, u, err := resolve(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return b.List(ctx, u)
+}
+
+// Check returns an error if rawurl does not name a location that some Backend
+// handles.
+func Check(rawurl string) error {
+	_, _, err := resolve(rawurl)
+	return err
+}
+
+// Base returns the last element of the path in rawurl, e.g., "samp71-utm.laz"
+// for "s3://venicegeo-sample-data/pointcloud/samp71-utm.laz".
+func Base(rawurl string) string {
+	if u, err := url.Parse(rawurl); err == nil {
+		rawurl = u.Path
+	}
+	return path.Base(rawurl)
+}
+
+// copyContext copies src to dst, abandoning the copy if ctx is done first.
+func copyContext(ctx context.Context, dst io.Writer, src io.ReadCloser) (int64, error) {
+	stop := context.AfterFunc(ctx, func() { src.Close() })
+	defer stop()
+	n, err := io.Copy(dst, src)
+	if err != nil && ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
+
+// refKey is the context key for the Ref being transferred.
+type refKey struct{}
+
+// withRef makes the method and headers given in ref available to the Backend.
+func withRef(ctx context.Context, ref Ref) context.Context {
+	return context.WithValue(ctx, refKey{}, ref)
+}
+
+// refFromContext returns the Ref being transferred, if any.
+func refFromContext(ctx context.Context) (Ref, bool) {
+	ref, ok := ctx.Value(refKey{}).(Ref)
+	return ref, ok
+}
+
+// sizeKey is the context key for the size of the object being written.
+type sizeKey struct{}
+
+// withSize tells the Backend how many bytes will be written, for protocols,
+// such as HTTP, in which the length is best declared up front.
+func withSize(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, sizeKey{}, size)
+}
+
+// sizeFromContext returns the size of the object being written, if known.
+func sizeFromContext(ctx context.Context) (int64, bool) {
+	size, ok := ctx.Value(sizeKey{}).(int64)
+	return size, ok
+}
+
+// StatRef describes the object that ref refers to, sending any headers it
+// gives.
+func StatRef(ctx context.Context, ref Ref) (Info, error) {
+	return Stat(withRef(ctx, ref), ref.URL)
+}
+
+// Download copies the object that ref refers to to the local file name,
+// returning the number of bytes copied. The InputCache is used, if any.
+func Download(ctx context.Context, ref Ref, name string) (int64, error) {
+	if c := InputCache; c != nil {
+		return c.Download(ctx, ref, name)
+	}
+	return download(ctx, ref, name)
+}
+
+// download makes an uncached Download.
+func download(ctx context.Context, ref Ref, name string) (int64, error) {
+	ctx = withRef(ctx, ref)
+	r, err := Open(ctx, ref.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	file, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := copyContext(ctx, file, r)
+	if err != nil {
+		return n, err
+	}
+	return n, file.Close()
+}
+
+// UploadResult describes a completed upload.
+type UploadResult struct {
+	// URL is the final location of the object. For HTTP(S), it is taken from
+	// the Location header of the response, if any, or else is the URL that
+	// was uploaded to, after any redirects.
+	URL string `json:"url"`
+	// Status is the HTTP status of the response, for HTTP(S) uploads.
+	Status int   `json:"status,omitempty"`
+	Size   int64 `json:"size"`
+}
+
+// UploadRetries is the number of times a failed upload is retried, if the
+// failure is temporary, e.g., a 5xx response.
+var UploadRetries = 3
+
+// RetryDelay is the delay before retrying an upload, doubling each time.
+var RetryDelay = time.Second
+
+// temporary reports whether err is worth retrying.
+func temporary(err error) bool {
+	t, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && t.Temporary()
+}
+
+// Upload copies the local file name to the object that ref refers to. Temporary
+// failures are retried.
+func Upload(ctx context.Context, name string, ref Ref) (UploadResult, error) {
+	delay := RetryDelay
+	for attempt := 0; ; attempt++ {
+		res, err := upload(ctx, name, ref)
+		if err == nil || !temporary(err) || attempt >= UploadRetries {
+			return res, err
+		}
+		log.Println("Retrying upload to", ref, "after", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return res, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// upload makes a single attempt at Upload.
+func upload(ctx context.Context, name string, ref Ref) (UploadResult, error) {
+	res := UploadResult{URL: ref.URL}
+	file, err := os.Open(name)
+	if err != nil {
+		return res, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return res, err
+	}
+
+	ctx = withSize(withRef(ctx, ref), fi.Size())
+	w, err := Create(ctx, ref.URL)
+	if err != nil {
+		return res, err
+	}
+	res.Size, err = copyContext(ctx, w, file)
+	if err != nil {
+		abort(w, err)
+		return res, err
+	}
+	if err := w.Close(); err != nil {
+		return res, err
+	}
+	if r, ok := w.(interface {
+		Result() UploadResult
+	}); ok {
+		size := res.Size
+		res = r.Result()
+		res.Size = size
+	}
+	return res, nil
+}
+
+// abort closes w without completing the object, if w supports it.
+func abort(w io.WriteCloser, err error) {
+	if a, ok := w.(interface {
+		CloseWithError(error) error
+	}); ok {
+		a.CloseWithError(err)
+		return
+	}
+	w.Close()
+}
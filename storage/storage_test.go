@@ -0,0 +1,315 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/venicegeo/pzsvc-pdal/storage"
+	"github.com/venicegeo/pzsvc-pdal/storage/storagetest"
+)
+
+func TestRef(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+		ok   bool
+	}{
+		{`"s3://bucket/key.laz"`, "s3://bucket/key.laz", true},
+		{`"https://host/key.laz"`, "https://host/key.laz", true},
+		{`{"bucket": "bucket", "key": "dir/key.laz"}`, "s3://bucket/dir/key.laz", true},
+		{`{"url": "https://host/key.laz", "method": "post"}`, "https://host/key.laz", true},
+		{`{"bucket": "bucket"}`, "", false},
+		{`{"type": "filters.crop"}`, "", false},
+		{`1`, "", false},
+	}
+	for _, tt := range tests {
+		var r storage.Ref
+		err := json.Unmarshal([]byte(tt.json), &r)
+		if (err == nil) != tt.ok || r.URL != tt.want {
+			t.Errorf("%s: expected %q (ok %v), got %q (%v)", tt.json, tt.want, tt.ok, r, err)
+		}
+	}
+
+	if b := storage.URLRef("s3://bucket/dir/key.laz").Base(); b != "key.laz" {
+		t.Errorf("Expected key.laz, got %s", b)
+	}
+	if err := storage.URLRef("ftp://host/key.laz").Check(); err == nil {
+		t.Error("Expected ftp to be unsupported")
+	}
+
+	var r storage.Ref
+	json.Unmarshal([]byte(`{"url": "https://host/key.laz", "method": "post", "headers": {"Authorization": "Bearer xyz"}}`), &r)
+	if r.Method != "POST" || r.Headers["Authorization"] != "Bearer xyz" || r.Check() != nil {
+		t.Errorf("Unexpected ref %+v", r)
+	}
+	if b, _ := json.Marshal(r); string(b) != `"https://host/key.laz"` {
+		t.Errorf("Expected headers not to be echoed, got %s", b)
+	}
+	for _, ref := range []storage.Ref{
+		{URL: "https://host/key.laz", Method: "DELETE"},
+		{URL: "s3://bucket/key.laz", Headers: map[string]string{"Authorization": "Bearer xyz"}},
+	} {
+		if err := ref.Check(); err == nil {
+			t.Errorf("Expected %+v to be rejected", ref)
+		}
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	root, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer storagetest.Install("file", storage.FileSystem{Root: root})()
+
+	local := filepath.Join(root, "local.laz")
+	ioutil.WriteFile(local, []byte("fake laz"), 0644)
+
+	ctx := context.Background()
+	if _, err := storage.Upload(ctx, local, storage.URLRef("file:///out/../../copy.laz")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(root, "copy.laz"))
+	if err != nil || string(b) != "fake laz" {
+		t.Errorf("Expected upload to stay within the root, got %q (%v)", b, err)
+	}
+
+	info, err := storage.Stat(ctx, "file:///copy.laz")
+	if err != nil || info.Size != 8 {
+		t.Errorf("Unexpected info %+v (%v)", info, err)
+	}
+
+	infos, err := storage.List(ctx, "file:///co")
+	if err != nil || len(infos) != 1 || infos[0].URL != "file:///copy.laz" {
+		t.Errorf("Unexpected listing %+v (%v)", infos, err)
+	}
+
+	out := filepath.Join(root, "download.laz")
+	if n, err := storage.Download(ctx, storage.URLRef("file:///copy.laz"), out); err != nil || n != 8 {
+		t.Errorf("Unexpected download of %d bytes (%v)", n, err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var put []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT":
+			put, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/in.laz":
+			w.Write([]byte("fake laz"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "in.laz")
+
+	ctx := context.Background()
+	if _, err := storage.Download(ctx, storage.URLRef(ts.URL+"/in.laz"), name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Download(ctx, storage.URLRef(ts.URL+"/missing.laz"), name); err == nil {
+		t.Error("Expected 404 to fail the download")
+	}
+	if _, err := storage.Upload(ctx, name, storage.URLRef(ts.URL+"/out.laz")); err != nil {
+		t.Fatal(err)
+	}
+	if string(put) != "fake laz" {
+		t.Errorf("Expected upload to be PUT, got %q", put)
+	}
+	if _, err := storage.List(ctx, ts.URL); err != storage.ErrNotSupported {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestHTTPUpload(t *testing.T) {
+	origDelay := storage.RetryDelay
+	storage.RetryDelay = time.Millisecond
+	defer func() { storage.RetryDelay = origDelay }()
+
+	var attempts int
+	var auth, file string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		f, hdr, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(f)
+		file = hdr.Filename + ": " + string(b)
+		w.Header().Set("Location", "/objects/42")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "local.laz")
+	ioutil.WriteFile(name, []byte("fake laz"), 0644)
+
+	ref := storage.Ref{
+		URL:     ts.URL + "/upload/out.laz",
+		Method:  "POST",
+		Headers: map[string]string{"Authorization": "Bearer xyz"},
+	}
+	res, err := storage.Upload(context.Background(), name, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected the 503 to be retried once, got %d attempts", attempts)
+	}
+	if auth != "Bearer xyz" || file != "out.laz: fake laz" {
+		t.Errorf("Unexpected upload %q with %q", file, auth)
+	}
+	if res.URL != ts.URL+"/objects/42" || res.Status != http.StatusCreated || res.Size != 8 {
+		t.Errorf("Unexpected result %+v", res)
+	}
+
+	// Client errors are not retried.
+	attempts = 0
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	_, err = storage.Upload(context.Background(), name, ref)
+	if e, ok := err.(*storage.StatusError); !ok || e.Code != http.StatusForbidden || attempts != 1 {
+		t.Errorf("Expected a single 403, got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestHTTPUploadLength(t *testing.T) {
+	var lengths []int64
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// As S3 does for presigned URLs.
+		if r.ContentLength < 0 {
+			http.Error(w, "length required", http.StatusLengthRequired)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		lengths = append(lengths, r.ContentLength)
+		bodies = append(bodies, string(b))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "local.laz")
+	ioutil.WriteFile(name, []byte("fake laz"), 0644)
+
+	for _, method := range []string{"PUT", "POST"} {
+		ref := storage.Ref{URL: ts.URL + "/upload/out.laz", Method: method}
+		if _, err := storage.Upload(context.Background(), name, ref); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+	}
+	if len(lengths) != 2 || lengths[0] != 8 || bodies[0] != "fake laz" {
+		t.Errorf("Expected the PUT to give its length, got %v %q", lengths, bodies)
+	}
+	if len(lengths) == 2 && (lengths[1] != int64(len(bodies[1])) || !strings.Contains(bodies[1], "fake laz")) {
+		t.Errorf("Expected the POST to give its length, got %v %q", lengths, bodies)
+	}
+}
+
+func TestS3Endpoint(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if r.Header.Get("Authorization") == "" {
+			t.Error("Expected a signed request")
+		}
+		w.Write([]byte("fake laz"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "pzsvc-pdal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	creds := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(creds, []byte("[minio]\naws_access_key_id = minio\naws_secret_access_key = minio123\n"), 0600)
+
+	defer storagetest.Install("s3", storage.NewS3(storage.S3Config{
+		Endpoint:        ts.URL,
+		PathStyle:       true,
+		Profile:         "minio",
+		CredentialsFile: creds,
+	}))()
+
+	name := filepath.Join(dir, "in.laz")
+	if _, err := storage.Download(context.Background(), storage.URLRef("s3://bucket/pointcloud/in.laz"), name); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "GET /bucket/pointcloud/in.laz" {
+		t.Errorf("Expected a single path-style GET, got %v", paths)
+	}
+}
+
+func TestS3ConfigFromEnv(t *testing.T) {
+	t.Setenv("S3_ENDPOINT", "http://localhost:9000")
+	t.Setenv("S3_PATH_STYLE", "true")
+	t.Setenv("AWS_REGION", "us-west-2")
+	t.Setenv("S3_PROFILE", "minio")
+
+	cfg, err := storage.S3ConfigFromEnv(storage.S3Config{Region: "eu-west-1", Profile: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := storage.S3Config{Endpoint: "http://localhost:9000", PathStyle: true, Region: "us-west-2", Profile: "minio"}
+	if cfg.Endpoint != want.Endpoint || cfg.PathStyle != want.PathStyle ||
+		cfg.Region != want.Region || cfg.Profile != want.Profile {
+		t.Errorf("Expected %+v, got %+v", want, cfg)
+	}
+
+	t.Setenv("S3_PATH_STYLE", "sometimes")
+	if _, err := storage.S3ConfigFromEnv(storage.S3Config{}); err == nil {
+		t.Error("Expected invalid S3_PATH_STYLE to be rejected")
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2016, RadiantBlue Technologies, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package storagetest provides an in-memory storage backend for use in tests.
+
+For example,
+
+	mem := storagetest.NewMemory()
+	mem.Put("s3://venicegeo-sample-data/pointcloud/samp71-utm.laz", []byte("fake laz"))
+	defer storagetest.Install("s3", mem)()
+
+	// ... exercise code that reads and writes s3:// URLs ...
+
+	if _, ok := mem.Get("s3://venicegeo-sample-data/temp/out.laz"); !ok {
+		t.Error("expected output to be uploaded")
+	}
+*/
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pzsvc-pdal/storage"
+)
+
+// Memory is a storage.Backend holding objects in memory, keyed by URL. The ETag
+// of each object is the MD5 of its contents, as for S3.
+type Memory struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	opens   map[string]int
+}
+
+// NewMemory constructs an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string][]byte), opens: make(map[string]int)}
+}
+
+// Put stores data at rawurl.
+func (m *Memory) Put(rawurl string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[rawurl] = data
+}
+
+// Get returns the data stored at rawurl.
+func (m *Memory) Get(rawurl string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[rawurl]
+	return b, ok
+}
+
+// Opens returns the number of times the object at rawurl has been opened,
+// e.g., to check whether it was downloaded.
+func (m *Memory) Opens(rawurl string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.opens[rawurl]
+}
+
+// Open implements storage.Backend.
+func (m *Memory) Open(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	b, ok := m.Get(u.String())
+	if !ok {
+		return nil, errors.New("NoSuchKey: " + u.String())
+	}
+	m.mu.Lock()
+	m.opens[u.String()]++
+	m.mu.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// memoryWriter stores its contents on Close.
+type memoryWriter struct {
+	bytes.Buffer
+	m      *Memory
+	rawurl string
+}
+
+func (w *memoryWriter) Close() error {
+	w.m.Put(w.rawurl, w.Bytes())
+	return nil
+}
+
+func (w *memoryWriter) CloseWithError(error) error {
+	return nil
+}
+
+// Create implements storage.Backend.
+func (m *Memory) Create(ctx context.Context, u *url.URL) (io.WriteCloser, error) {
+	return &memoryWriter{m: m, rawurl: u.String()}, nil
+}
+
+// Stat implements storage.Backend.
+func (m *Memory) Stat(ctx context.Context, u *url.URL) (storage.Info, error) {
+	b, ok := m.Get(u.String())
+	if !ok {
+		return storage.Info{}, errors.New("NoSuchKey: " + u.String())
+	}
+	return storage.Info{URL: u.String(), Size: int64(len(b)), ETag: etag(b)}, nil
+}
+
+func etag(b []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(b))
+}
+
+// List implements storage.Backend.
+func (m *Memory) List(ctx context.Context, u *url.URL) ([]storage.Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var infos []storage.Info
+	for rawurl, b := range m.objects {
+		if strings.HasPrefix(rawurl, u.String()) {
+			infos = append(infos, storage.Info{URL: rawurl, Size: int64(len(b)), ETag: etag(b)})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].URL < infos[j].URL })
+	return infos, nil
+}
+
+// Install registers b for scheme, returning a function that restores the
+// original Backend, if any.
+func Install(scheme string, b storage.Backend) func() {
+	orig, ok := storage.Lookup(scheme)
+	storage.Register(scheme, b)
+	return func() {
+		if ok {
+			storage.Register(scheme, orig)
+		}
+	}
+}